@@ -26,7 +26,11 @@ package main
 import "github.com/kardianos/osext"
 import "gopkg.in/alecthomas/kingpin.v2"
 import "github.com/topfreegames/apm/lib/cli"
+import "github.com/topfreegames/apm/lib/logs"
 import "github.com/topfreegames/apm/lib/master"
+import "github.com/topfreegames/apm/lib/preparable"
+import "github.com/topfreegames/apm/lib/process"
+import "github.com/topfreegames/apm/lib/utils"
 
 import "github.com/sevlyar/go-daemon"
 
@@ -35,36 +39,112 @@ import "path/filepath"
 import "syscall"
 import "os"
 import "os/signal"
+import "time"
 
 import log "github.com/Sirupsen/logrus"
 
 var (
 	app     = kingpin.New("apm", "Aguia Process Manager.")
-	dns     = app.Flag("dns", "TCP Dns host.").Default(":9876").String()
+	dns     = app.Flag("dns", "TCP Dns host. (Ex: :9876) The server only listens on TCP when it is set, and the client uses it instead of the unix socket.").String()
+	socket  = app.Flag("socket", "Unix socket path. Defaults to apm.sock in the default APM folder, .apmenv next to the apm binary. The server listens on apm.sock next to its --config-file.").String()
 	timeout = app.Flag("timeout", "Timeout to connect to client").Default("30s").Duration()
+	token   = app.Flag("token", "Token sent to the server over TCP.").Envar("APM_TOKEN").String()
+	tlsOn   = app.Flag("tls", "Use TLS over TCP.").Bool()
+	tlsCA   = app.Flag("tls-ca", "CA file used to verify the server certificate over TCP. Implies --tls.").String()
+	tlsCert = app.Flag("tls-cert", "Client certificate file, for servers that require mutual TLS. Implies --tls.").String()
+	tlsKey  = app.Flag("tls-key", "Client private key file.").String()
 
 	serveStop           = app.Command("serve-stop", "Stop APM server instance.")
 	serveStopConfigFile = serveStop.Flag("config-file", "Config file location").String()
 
 	serve           = app.Command("serve", "Create APM server instance.")
 	serveConfigFile = serve.Flag("config-file", "Config file location").String()
+	serveHTTP       = serve.Flag("http", "Also serve the REST API on this address. (Ex: :9877)").String()
+	serveMetrics    = serve.Flag("metrics", "Serve Prometheus metrics on GET /metrics of this address. (Ex: :9878)").String()
+	serveTLSCert    = serve.Flag("tls-cert", "Certificate file. Enables TLS on the TCP and HTTP listeners.").String()
+	serveTLSKey     = serve.Flag("tls-key", "Private key file of --tls-cert.").String()
+	serveClientCA   = serve.Flag("tls-client-ca", "Require client certificates signed by this CA file.").String()
+	serveAdmin      = serve.Flag("admin-token", "Token allowed to call every method. Can be repeated.").Strings()
+	serveReadOnly   = serve.Flag("read-only-token", "Token only allowed to query status. Can be repeated.").Strings()
 
 	resurrect     = app.Command("resurrect", "Resurrect all previously save processes.")
 
-	bin           = app.Command("bin", "Create bin process.")
-	binSourcePath = bin.Flag("source", "Go project source path. (Ex: github.com/topfreegames/apm)").Required().String()
-	binName       = bin.Arg("name", "Process name.").Required().String()
-	binKeepAlive  = bin.Flag("keep-alive", "Keep process alive forever.").Required().Bool()
-	binArgs       = bin.Flag("args", "External args.").Strings()
-
-	restart     = app.Command("restart", "Restart a process.")
-	restartName = restart.Arg("name", "Process name.").Required().String()
+	bin            = app.Command("bin", "Create bin process.")
+	binSourcePath  = bin.Flag("source", "Go package import path, or the path of a module root, a package inside a module or a build directory. (Ex: github.com/topfreegames/apm, ./cmd/api)").Required().String()
+	binName        = bin.Arg("name", "Process name.").Required().String()
+	binArgs        = bin.Flag("args", "External args.").Strings()
+	binBuildEnv    = bin.Flag("build-env", "Build environment variable as KEY=VALUE. (Ex: CGO_ENABLED=0) Can be repeated.").StringMap()
+	binTags        = bin.Flag("tags", "Build tag. Can be repeated.").Strings()
+	binLDFlags     = bin.Flag("ldflags", "Flags passed to go build -ldflags. (Ex: -X main.version=1.2.0)").String()
+	binBuildArgs   = bin.Flag("build-arg", "Extra go build arg. (Ex: -trimpath) Can be repeated.").Strings()
+	binBuildCmd    = bin.Flag("build-cmd", "Command run with sh from the source directory before go build. (Ex: make build)").String()
+	binBuildOutput = bin.Flag("build-output", "Binary written by --build-cmd, relative to the source directory. Replaces go build.").String()
+	binKeep        = bin.Flag("keep-versions", "Built versions kept to roll back to.").Default("5").Int()
+	binNoWait      = bin.Flag("no-wait", "Only queue the build and print its ID. See apm builds.").Bool()
+	binFlags       = addProcFlags(bin)
+	binWait        = addWaitFlags(bin)
+
+	run      = app.Command("run", "Run an already built binary or script. (Ex: apm run worker --keep-alive -- python worker.py)")
+	runName  = run.Arg("name", "Process name.").Required().String()
+	runCmd   = run.Arg("cmd", "Command followed by its args.").Required().Strings()
+	runFlags = addProcFlags(run)
+	runWait  = addWaitFlags(run)
+
+	restart            = app.Command("restart", "Restart a process.")
+	restartName        = restart.Arg("name", "Process name.").Required().String()
+	restartStopTimeout = restart.Flag("stop-timeout", "Override the process stop timeout for this restart.").Duration()
+	restartWait        = addWaitFlags(restart)
+
+	rebuild            = app.Command("rebuild", "Build a process again from its source and restart it on the new binary. A failed build leaves it running.")
+	rebuildName        = rebuild.Arg("name", "Process name.").Required().String()
+	rebuildStopTimeout = rebuild.Flag("stop-timeout", "Override the process stop timeout for the restart.").Duration()
+	rebuildNoWait      = rebuild.Flag("no-wait", "Only queue the build and print its ID. See apm builds.").Bool()
+	rebuildWait        = addWaitFlags(rebuild)
+
+	builds = app.Command("builds", "List the last build jobs.")
+
+	buildLog     = app.Command("build-log", "Print the output of a build job.")
+	buildLogID   = buildLog.Arg("id", "Build job ID.").Required().Int()
+	buildLogWait = buildLog.Flag("wait", "Wait for the build to finish first.").Bool()
+
+	versions     = app.Command("versions", "List the built versions of a process. The current one is marked with a *.")
+	versionsName = versions.Arg("name", "Process name.").Required().String()
+
+	rollback            = app.Command("rollback", "Restart a process on a previous version, without building anything.")
+	rollbackName        = rollback.Arg("name", "Process name.").Required().String()
+	rollbackVersion     = rollback.Arg("version", "Version to run. Defaults to the one built before the current one.").Int()
+	rollbackStopTimeout = rollback.Flag("stop-timeout", "Override the process stop timeout for the restart.").Duration()
+	rollbackWait        = addWaitFlags(rollback)
 
 	start     = app.Command("start", "Start a process.")
 	startName = start.Arg("name", "Process name.").Required().String()
-
-	stop     = app.Command("stop", "Stop a process.")
-	stopName = stop.Arg("name", "Process name.").Required().String()
+	startWait = addWaitFlags(start)
+
+	stop        = app.Command("stop", "Stop a process.")
+	stopName    = stop.Arg("name", "Process name.").Required().String()
+	stopTimeout = stop.Flag("stop-timeout", "Override the process stop timeout for this stop.").Duration()
+
+	env          = app.Command("env", "Change a process environment. Changes take effect on the next restart.")
+	envSet       = env.Command("set", "Set environment variables.")
+	envSetName   = envSet.Arg("name", "Process name.").Required().String()
+	envSetVars   = envSet.Arg("vars", "Variables as KEY=VALUE.").Required().StringMap()
+	envUnset     = env.Command("unset", "Unset environment variables.")
+	envUnsetName = envUnset.Arg("name", "Process name.").Required().String()
+	envUnsetKeys = envUnset.Arg("keys", "Variable names.").Required().Strings()
+
+	logsCmd        = app.Command("logs", "Show and manage the out and err files of processes.")
+	logsShow       = logsCmd.Command("show", "Print the last lines of the out files. This is the default. (Ex: apm logs api worker -f)").Default()
+	logsShowNames  = logsShow.Arg("names", "Process names. Defaults to all processes.").Strings()
+	logsShowErr    = logsShow.Flag("err", "Print the err files instead of the out files.").Bool()
+	logsShowAll    = logsShow.Flag("all", "Print both the out and the err files. Err lines go to stderr.").Bool()
+	logsShowLines  = logsShow.Flag("lines", "Number of lines to print from each file.").Short('n').Default("10").Int()
+	logsShowFollow = logsShow.Flag("follow", "Keep printing new lines.").Short('f').Bool()
+	logsShowJSON   = logsShow.Flag("json", "Print each line as a JSON record.").Bool()
+	logsShowGrep   = logsShow.Flag("grep", "Only print lines whose field has this value. (Ex: --grep level=error) Can be repeated.").StringMap()
+	logsFlush      = logsCmd.Command("flush", "Empty the log files and delete the rotated ones.")
+	logsFlushName  = logsFlush.Arg("name", "Process name.").Required().String()
+	logsRotate     = logsCmd.Command("rotate", "Rotate the log files now.")
+	logsRotateName = logsRotate.Arg("name", "Process name.").Required().String()
 
 	delete     = app.Command("delete", "Delete a process.")
 	deleteName = delete.Arg("name", "Process name.").Required().String()
@@ -81,32 +161,380 @@ func main() {
 	case serve.FullCommand():
 		startRemoteMasterServer()
 	case resurrect.FullCommand():
-		cli := cli.InitCli(*dns, *timeout)
+		cli := initCli()
 		cli.Resurrect()
 	case bin.FullCommand():
-		cli := cli.InitCli(*dns, *timeout)
-		cli.StartGoBin(*binSourcePath, *binName, *binKeepAlive, *binArgs)
+		cli := initCli()
+		cli.StartGoBinWithOptions(&master.GoBin{
+			SourcePath:      sourcePath(*binSourcePath),
+			Name:            *binName,
+			KeepAlive:       *binFlags.keepAlive,
+			Args:            *binArgs,
+			StopTimeout:     *binFlags.stopTimeout,
+			RestartPolicy:   binFlags.restartPolicy(),
+			HealthCheck:     binFlags.healthCheck(),
+			ReadinessCheck:  binFlags.readinessCheck(),
+			Env:             *binFlags.env,
+			EnvFiles:        *binFlags.envFiles,
+			Cwd:             *binFlags.cwd,
+			Setsid:          *binFlags.setsid,
+			LogRotate:       binFlags.logRotate(),
+			Capture:         *binFlags.capture,
+			LogFormat:       *binFlags.logFormat,
+			LogSinks:        binFlags.logSinks(),
+			MetricsChildren: *binFlags.metricsChildren,
+			MemoryLimit:     binFlags.memoryLimit(),
+			Build: preparable.BuildConfig{
+				Env:     *binBuildEnv,
+				Tags:    *binTags,
+				LDFlags: *binLDFlags,
+				Args:    *binBuildArgs,
+				Command: *binBuildCmd,
+				Output:  *binBuildOutput,
+				Keep:    *binKeep,
+			},
+		}, !*binNoWait)
+		if !*binNoWait {
+			binWait.waitReady(cli, *binName)
+		}
+	case run.FullCommand():
+		cli := initCli()
+		cli.StartCommand(&master.Command{
+			Cmd:             (*runCmd)[0],
+			Name:            *runName,
+			KeepAlive:       *runFlags.keepAlive,
+			Args:            (*runCmd)[1:],
+			StopTimeout:     *runFlags.stopTimeout,
+			RestartPolicy:   runFlags.restartPolicy(),
+			HealthCheck:     runFlags.healthCheck(),
+			ReadinessCheck:  runFlags.readinessCheck(),
+			Env:             *runFlags.env,
+			EnvFiles:        *runFlags.envFiles,
+			Cwd:             *runFlags.cwd,
+			Setsid:          *runFlags.setsid,
+			LogRotate:       runFlags.logRotate(),
+			Capture:         *runFlags.capture,
+			LogFormat:       *runFlags.logFormat,
+			LogSinks:        runFlags.logSinks(),
+			MetricsChildren: *runFlags.metricsChildren,
+			MemoryLimit:     runFlags.memoryLimit(),
+		})
+		runWait.waitReady(cli, *runName)
 	case restart.FullCommand():
-		cli := cli.InitCli(*dns, *timeout)
-		cli.RestartProcess(*restartName)
+		cli := initCli()
+		cli.RestartProcessWithTimeout(*restartName, *restartStopTimeout)
+		restartWait.waitReady(cli, *restartName)
+	case rebuild.FullCommand():
+		cli := initCli()
+		cli.RebuildProcess(*rebuildName, *rebuildStopTimeout, !*rebuildNoWait)
+		if !*rebuildNoWait {
+			rebuildWait.waitReady(cli, *rebuildName)
+		}
+	case builds.FullCommand():
+		cli := initCli()
+		cli.Builds()
+	case buildLog.FullCommand():
+		cli := initCli()
+		cli.BuildLog(*buildLogID, *buildLogWait)
+	case versions.FullCommand():
+		cli := initCli()
+		cli.Versions(*versionsName)
+	case rollback.FullCommand():
+		cli := initCli()
+		cli.RollbackProcess(*rollbackName, *rollbackVersion, *rollbackStopTimeout)
+		rollbackWait.waitReady(cli, *rollbackName)
 	case start.FullCommand():
-		cli := cli.InitCli(*dns, *timeout)
+		cli := initCli()
 		cli.StartProcess(*startName)
+		startWait.waitReady(cli, *startName)
 	case stop.FullCommand():
-		cli := cli.InitCli(*dns, *timeout)
-		cli.StopProcess(*stopName)
+		cli := initCli()
+		cli.StopProcessWithTimeout(*stopName, *stopTimeout)
+	case envSet.FullCommand():
+		cli := initCli()
+		cli.SetEnv(*envSetName, *envSetVars)
+	case envUnset.FullCommand():
+		cli := initCli()
+		cli.UnsetEnv(*envUnsetName, *envUnsetKeys)
+	case logsShow.FullCommand():
+		streams := []string{"out"}
+		if *logsShowAll {
+			streams = []string{"out", "err"}
+		} else if *logsShowErr {
+			streams = []string{"err"}
+		}
+		options := &cli.LogsOptions{
+			Streams: streams,
+			Lines:   *logsShowLines,
+			Follow:  *logsShowFollow,
+			Grep:    *logsShowGrep,
+			JSON:    *logsShowJSON,
+		}
+		cli := initCli()
+		cli.Logs(*logsShowNames, options)
+	case logsFlush.FullCommand():
+		cli := initCli()
+		cli.FlushLogs(*logsFlushName)
+	case logsRotate.FullCommand():
+		cli := initCli()
+		cli.RotateLogs(*logsRotateName)
 	case delete.FullCommand():
-		cli := cli.InitCli(*dns, *timeout)
+		cli := initCli()
 		cli.DeleteProcess(*deleteName)
 	case save.FullCommand():
-		cli := cli.InitCli(*dns, *timeout)
+		cli := initCli()
 		cli.Save()
 	case status.FullCommand():
-		cli := cli.InitCli(*dns, *timeout)
+		cli := initCli()
 		cli.Status()
 	}
 }
 
+// initCli will connect to the server on the TCP address in case --dns is set, or on the
+// unix socket otherwise.
+// Returns a Cli instance.
+func initCli() *cli.Cli {
+	if *dns != "" {
+		return cli.DialCli("tcp", *dns, *timeout, &master.ClientConfig{
+			Token:   *token,
+			TLS:     *tlsOn,
+			TLSCA:   *tlsCA,
+			TLSCert: *tlsCert,
+			TLSKey:  *tlsKey,
+		})
+	}
+	if *socket == "" {
+		var err error
+		*socket, err = cli.DefaultSocketPath()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := os.Stat(*socket); err != nil {
+			log.Fatalf("No server socket at %s. The server listens on %s in the folder of its --config-file, "+
+				"so use --socket=<config folder>/%s in case it runs with another config file.\n", *socket, master.SocketFile, master.SocketFile)
+		}
+	}
+	return cli.DialCli("unix", *socket, *timeout, nil)
+}
+
+// sourcePath will turn source into an absolute path in case it is a local directory, since the
+// server builds it from its own working directory. Import paths are kept as they are.
+// Returns the source path sent to the server.
+func sourcePath(source string) string {
+	info, err := os.Stat(source)
+	if err != nil || !info.IsDir() {
+		return source
+	}
+	absPath, err := filepath.Abs(source)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return absPath
+}
+
+// procFlags holds the flags shared by the commands that create a process.
+type procFlags struct {
+	keepAlive       *bool
+	stopTimeout     *time.Duration
+	minBackoff      *time.Duration
+	maxBackoff      *time.Duration
+	maxRestarts     *int
+	restartWindow   *time.Duration
+	healthHTTP      *string
+	healthStatus    *int
+	healthTCP       *string
+	healthExec      *string
+	healthInterval  *time.Duration
+	healthTimeout   *time.Duration
+	healthFailures  *int
+	healthDelay     *time.Duration
+	readyHTTP       *string
+	readyStatus     *int
+	readyTCP        *string
+	readyNotify     *bool
+	readyInterval   *time.Duration
+	env             *map[string]string
+	envFiles        *[]string
+	cwd             *string
+	setsid          *bool
+	logMaxSize      *string
+	logMaxAge       *time.Duration
+	logKeep         *int
+	logCompress     *bool
+	capture         *bool
+	logFormat       *string
+	logSink         *[]string
+	metricsChildren *bool
+	maxMemory       *string
+	memoryChildren  *bool
+	memorySamples   *int
+}
+
+// addProcFlags will add the flags shared by the commands that create a process to cmd.
+// Returns the parsed flags.
+func addProcFlags(cmd *kingpin.CmdClause) *procFlags {
+	return &procFlags{
+		keepAlive:       cmd.Flag("keep-alive", "Keep process alive forever.").Required().Bool(),
+		stopTimeout:     cmd.Flag("stop-timeout", "Time given to the process to exit after SIGTERM before it is killed with SIGKILL.").Default("10s").Duration(),
+		minBackoff:      cmd.Flag("min-backoff", "Delay before restarting the process after it dies. Doubles on each restart.").Default("1s").Duration(),
+		maxBackoff:      cmd.Flag("max-backoff", "Maximum delay between restarts.").Default("1m").Duration(),
+		maxRestarts:     cmd.Flag("max-restarts", "Restarts allowed inside --restart-window before the process is marked as errored. A negative value allows unlimited restarts.").Default("5").Int(),
+		restartWindow:   cmd.Flag("restart-window", "Sliding window used to count restarts.").Default("1m").Duration(),
+		healthHTTP:      cmd.Flag("health-http", "Health check URL. The process is healthy while a GET answers with a 2xx or 3xx status, or --health-status. (Ex: http://localhost:8080/healthz)").String(),
+		healthStatus:    cmd.Flag("health-status", "Status expected by --health-http.").Int(),
+		healthTCP:       cmd.Flag("health-tcp", "Health check address. The process is healthy while it accepts connections on it. (Ex: localhost:5432)").String(),
+		healthExec:      cmd.Flag("health-exec", "Health check command, run with sh from the process cwd. The process is healthy while it exits with 0.").String(),
+		healthInterval:  cmd.Flag("health-interval", "Time between two health checks.").Default("10s").Duration(),
+		healthTimeout:   cmd.Flag("health-timeout", "Time a health check may take before it fails.").Default("5s").Duration(),
+		healthFailures:  cmd.Flag("health-failures", "Health checks that must fail in a row before the process is restarted.").Default("3").Int(),
+		healthDelay:     cmd.Flag("health-delay", "Time to wait after the process starts before the first health check.").Default("0s").Duration(),
+		readyHTTP:       cmd.Flag("ready-http", "The process is ready once a GET to this URL answers with 200, or --ready-status. (Ex: http://localhost:8080/ready)").String(),
+		readyStatus:     cmd.Flag("ready-status", "Status expected by --ready-http.").Int(),
+		readyTCP:        cmd.Flag("ready-tcp", "The process is ready once it accepts connections on this address. (Ex: localhost:8080)").String(),
+		readyNotify:     cmd.Flag("ready-notify", "The process is ready once it sends READY=1 to the socket in NOTIFY_SOCKET, as with sd_notify.").Bool(),
+		readyInterval:   cmd.Flag("ready-interval", "Time between two readiness checks.").Default("500ms").Duration(),
+		env:             cmd.Flag("env", "Environment variable as KEY=VALUE. Can be repeated.").StringMap(),
+		envFiles:        cmd.Flag("env-file", "File with KEY=VALUE lines read each time the process starts. Can be repeated.").Strings(),
+		cwd:             cmd.Flag("cwd", "Process working directory.").String(),
+		setsid:          cmd.Flag("setsid", "Start the process in its own session, not only in its own process group.").Bool(),
+		logMaxSize:      cmd.Flag("log-max-size", "Rotate the out and err files once they reach this size. (Ex: 500K, 10M, 1G) Zero disables it. Lines written while a file is rotated are lost.").Default("0").String(),
+		logMaxAge:       cmd.Flag("log-max-age", "Rotate the out and err files after they have been written for this long. Zero disables it.").Default("0s").Duration(),
+		logKeep:         cmd.Flag("log-keep", "Rotated files kept for each log file. Zero keeps them all.").Default("5").Int(),
+		logCompress:     cmd.Flag("log-compress", "Gzip the rotated files.").Bool(),
+		capture:         cmd.Flag("capture", "Read the output through pipes to timestamp and tag each line, and log restarts. The process is restarted when APM restarts.").Bool(),
+		logFormat:       cmd.Flag("log-format", "Store the output as text or as JSON records. JSON implies --capture.").Default("text").Enum("text", "json"),
+		logSink:         cmd.Flag("log-sink", "Send the output to file, syslog, syslog://host:port, syslog+tcp://host:port or json://host:port instead of the out and err files. Add file to keep them. Can be repeated. Implies --capture.").Strings(),
+		metricsChildren: cmd.Flag("metrics-children", "Add the CPU, memory, file descriptors, threads and IO of the process descendants to its metrics.").Bool(),
+		maxMemory:       cmd.Flag("max-memory", "Gracefully restart the process once its resident memory stays above this size. (Ex: 512M, 2G) Zero disables it.").Default("0").String(),
+		memoryChildren:  cmd.Flag("max-memory-children", "Add the resident memory of the process descendants before comparing it with --max-memory.").Bool(),
+		memorySamples:   cmd.Flag("max-memory-samples", "Samples, taken every 5s, that must be above --max-memory in a row before the process is restarted.").Default("3").Int(),
+	}
+}
+
+func (flags *procFlags) restartPolicy() process.RestartPolicy {
+	return process.RestartPolicy{
+		MinBackoff:  *flags.minBackoff,
+		MaxBackoff:  *flags.maxBackoff,
+		MaxRestarts: *flags.maxRestarts,
+		Window:      *flags.restartWindow,
+	}
+}
+
+func (flags *procFlags) healthCheck() process.HealthCheck {
+	check := process.HealthCheck{
+		Status:           *flags.healthStatus,
+		Interval:         *flags.healthInterval,
+		Timeout:          *flags.healthTimeout,
+		FailureThreshold: *flags.healthFailures,
+		InitialDelay:     *flags.healthDelay,
+	}
+	probes := 0
+	if *flags.healthHTTP != "" {
+		check.Type, check.URL = process.HealthCheckHTTP, *flags.healthHTTP
+		probes++
+	}
+	if *flags.healthTCP != "" {
+		check.Type, check.Address = process.HealthCheckTCP, *flags.healthTCP
+		probes++
+	}
+	if *flags.healthExec != "" {
+		check.Type, check.Command = process.HealthCheckExec, *flags.healthExec
+		probes++
+	}
+	if probes > 1 {
+		log.Fatal("Use only one of --health-http, --health-tcp and --health-exec.")
+	}
+	if err := check.Check(); err != nil {
+		log.Fatal(err)
+	}
+	return check
+}
+
+func (flags *procFlags) readinessCheck() process.ReadinessCheck {
+	check := process.ReadinessCheck{
+		Status:   *flags.readyStatus,
+		Interval: *flags.readyInterval,
+	}
+	checks := 0
+	if *flags.readyHTTP != "" {
+		check.Type, check.URL = process.HealthCheckHTTP, *flags.readyHTTP
+		checks++
+	}
+	if *flags.readyTCP != "" {
+		check.Type, check.Address = process.HealthCheckTCP, *flags.readyTCP
+		checks++
+	}
+	if *flags.readyNotify {
+		check.Type = process.ReadinessNotify
+		checks++
+	}
+	if checks > 1 {
+		log.Fatal("Use only one of --ready-http, --ready-tcp and --ready-notify.")
+	}
+	if err := check.Check(); err != nil {
+		log.Fatal(err)
+	}
+	return check
+}
+
+func (flags *procFlags) logRotate() logs.RotateConfig {
+	maxSize, err := utils.ParseSize(*flags.logMaxSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return logs.RotateConfig{
+		MaxSize:  maxSize,
+		MaxAge:   *flags.logMaxAge,
+		Keep:     *flags.logKeep,
+		Compress: *flags.logCompress,
+	}
+}
+
+func (flags *procFlags) memoryLimit() process.MemoryLimit {
+	maxMemory, err := utils.ParseSize(*flags.maxMemory)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return process.MemoryLimit{
+		MaxMemory: uint64(maxMemory),
+		Children:  *flags.memoryChildren,
+		Samples:   *flags.memorySamples,
+	}
+}
+
+func (flags *procFlags) logSinks() []logs.SinkConfig {
+	sinks := []logs.SinkConfig{}
+	for _, spec := range *flags.logSink {
+		sink, err := logs.ParseSink(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks
+}
+
+// waitFlags holds the flags of the commands that can wait for the process they start.
+type waitFlags struct {
+	wait    *bool
+	timeout *time.Duration
+}
+
+// addWaitFlags will add the flags to wait for the process to be ready to cmd.
+// Returns the parsed flags.
+func addWaitFlags(cmd *kingpin.CmdClause) *waitFlags {
+	return &waitFlags{
+		wait:    cmd.Flag("wait", "Wait until the process is ready, or running in case it has no readiness check.").Bool(),
+		timeout: cmd.Flag("wait-timeout", "Fail in case the process is not ready after this long.").Default("1m").Duration(),
+	}
+}
+
+func (flags *waitFlags) waitReady(cli *cli.Cli, name string) {
+	if *flags.wait {
+		cli.WaitReady(name, *flags.timeout)
+	}
+}
+
 func isDaemonRunning(ctx *daemon.Context) (bool, *os.Process, error) {
 	d, err := ctx.Search()
 
@@ -156,7 +584,25 @@ func startRemoteMasterServer() {
 	defer ctx.Release()
 
 	log.Info("Starting remote master server...")
-	remoteMaster := master.StartRemoteMasterServer(*dns, *serveConfigFile)
+	remoteMaster := master.StartRemoteMasterServerWithConfig(*dns, *serveConfigFile, &master.RemoteConfig{
+		TLSCert:        *serveTLSCert,
+		TLSKey:         *serveTLSKey,
+		TLSClientCA:    *serveClientCA,
+		AdminTokens:    *serveAdmin,
+		ReadOnlyTokens: *serveReadOnly,
+	})
+	if *serveHTTP != "" {
+		log.Infof("Starting REST API on %s...", *serveHTTP)
+		if err := remoteMaster.StartHTTPServer(*serveHTTP); err != nil {
+			log.Fatalf("Failed to start REST API due to %+v.", err)
+		}
+	}
+	if *serveMetrics != "" {
+		log.Infof("Starting metrics server on %s...", *serveMetrics)
+		if err := remoteMaster.StartMetricsServer(*serveMetrics); err != nil {
+			log.Fatalf("Failed to start metrics server due to %+v.", err)
+		}
+	}
 
 	sigsKill := make(chan os.Signal, 1)
 	signal.Notify(sigsKill,
@@ -1,21 +1,70 @@
 package cli
 
+import "github.com/topfreegames/apm/lib/logs"
 import "github.com/topfreegames/apm/lib/master"
+import "github.com/topfreegames/apm/lib/utils"
+import "github.com/kardianos/osext"
 
+import "encoding/json"
 import "math"
+import "os"
+import "sort"
 import "log"
 import "time"
 import "fmt"
+import "strings"
+import "path/filepath"
 
 // Cli is the command line client.
 type Cli struct {
 	remoteClient *master.RemoteClient
 }
 
-// InitCli initiates a remote client connecting to dsn.
+// InitCli initiates a remote client connecting to dsn. An empty dsn means the default unix
+// socket, see DefaultSocketPath, and so does a path or a dsn starting with unix://. Any other
+// dsn, such as :9876 or tcp://host:9876, is a TCP address.
 // Returns a Cli instance.
 func InitCli(dsn string, timeout time.Duration) *Cli {
-	client, err := master.StartRemoteClient(dsn, timeout)
+	network, address, err := parseDsn(dsn)
+	if err != nil {
+		log.Fatalf("Failed to start remote client due to: %+v\n", err)
+	}
+	return DialCli(network, address, timeout, nil)
+}
+
+// DefaultSocketPath will return the unix socket of a server running with the default config
+// file, that is apm.sock in the .apmenv folder next to the apm binary.
+// Returns a tuple with the socket path and an error in case there's any.
+func DefaultSocketPath() (string, error) {
+	folderPath, err := osext.ExecutableFolder()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(folderPath, ".apmenv", master.SocketFile), nil
+}
+
+// parseDsn will tell the network and the address of dsn, see InitCli.
+// Returns a tuple with the network, the address and an error in case there's any.
+func parseDsn(dsn string) (string, string, error) {
+	switch {
+	case dsn == "":
+		address, err := DefaultSocketPath()
+		return "unix", address, err
+	case strings.HasPrefix(dsn, "unix://"):
+		return "unix", strings.TrimPrefix(dsn, "unix://"), nil
+	case strings.HasPrefix(dsn, "tcp://"):
+		return "tcp", strings.TrimPrefix(dsn, "tcp://"), nil
+	case strings.Contains(dsn, "/"):
+		return "unix", dsn, nil
+	}
+	return "tcp", dsn, nil
+}
+
+// DialCli initiates a remote client connecting to address, either a unix socket path or a
+// TCP address depending on network. TCP connections are secured by config, which may be nil.
+// Returns a Cli instance.
+func DialCli(network string, address string, timeout time.Duration, config *master.ClientConfig) *Cli {
+	client, err := master.DialRemoteClient(network, address, timeout, config)
 	if err != nil {
 		log.Fatalf("Failed to start remote client due to: %+v\n", err)
 	}
@@ -41,24 +90,199 @@ func (cli *Cli) Resurrect() {
 		log.Fatalf("Failed to resurrect all previously save processes due to: %+v\n", err)
 	}
 }
+
 // StartGoBin will try to start a go binary process.
 // Returns a fatal error in case there's any.
 func (cli *Cli) StartGoBin(sourcePath string, name string, keepAlive bool, args []string) {
-	err := cli.remoteClient.StartGoBin(sourcePath, name, keepAlive, args)
+	cli.StartGoBinWithOptions(&master.GoBin{
+		SourcePath: sourcePath,
+		Name:       name,
+		KeepAlive:  keepAlive,
+		Args:       args,
+	}, true)
+}
+
+// StartGoBinWithOptions will try to start a go binary process with every option of goBin. The
+// build is queued on the server and, unless wait is false, waited for.
+// Returns a fatal error in case there's any.
+func (cli *Cli) StartGoBinWithOptions(goBin *master.GoBin, wait bool) {
+	goBin.EnvFiles = absPaths(goBin.EnvFiles)
+	goBin.Cwd = absPath(goBin.Cwd)
+	job, err := cli.remoteClient.SubmitGoBin(goBin)
 	if err != nil {
 		log.Fatalf("Failed to start go bin due to: %+v\n", err)
 	}
+	if !wait {
+		fmt.Printf("Build %d queued.\n", job.ID)
+		return
+	}
+	job = cli.waitBuild(job)
+	if job.Status == master.BuildFailed {
+		log.Fatalf("Failed to start go bin due to: ERROR: %s OUTPUT: %s\n", job.Error, job.Output)
+	}
+}
+
+// StartCommand will try to start an already built binary or script. A relative command path
+// is resolved from the current directory, since the server may run somewhere else.
+// Returns a fatal error in case there's any.
+func (cli *Cli) StartCommand(command *master.Command) {
+	if strings.Contains(command.Cmd, "/") {
+		command.Cmd = absPath(command.Cmd)
+	}
+	command.EnvFiles = absPaths(command.EnvFiles)
+	command.Cwd = absPath(command.Cwd)
+	err := cli.remoteClient.StartCommand(command)
+	if err != nil {
+		log.Fatalf("Failed to start command due to: %+v\n", err)
+	}
 }
 
 // RestartProcess will try to restart a process with procName. Note that this process
 // must have been already started through StartGoBin.
 func (cli *Cli) RestartProcess(procName string) {
-	err := cli.remoteClient.RestartProcess(procName)
+	cli.RestartProcessWithTimeout(procName, 0)
+}
+
+// RestartProcessWithTimeout will try to restart a process with procName. The process is killed
+// in case it does not stop within timeout, or its own stop timeout if timeout is zero.
+func (cli *Cli) RestartProcessWithTimeout(procName string, timeout time.Duration) {
+	err := cli.remoteClient.RestartProcessWithTimeout(procName, timeout)
 	if err != nil {
 		log.Fatalf("Failed to restart process due to: %+v\n", err)
 	}
 }
 
+// RebuildProcess will build the process with procName again and restart it on the new binary.
+// Note that this process must have been already started through StartGoBin. Unless wait is false,
+// the build is waited for and its output is printed. The process keeps running on its current
+// binary in case the build fails.
+func (cli *Cli) RebuildProcess(procName string, timeout time.Duration, wait bool) {
+	job, err := cli.remoteClient.SubmitRebuild(procName, timeout)
+	if err != nil {
+		log.Fatalf("Failed to rebuild process due to: %+v\n", err)
+	}
+	if !wait {
+		fmt.Printf("Build %d queued.\n", job.ID)
+		return
+	}
+	job = cli.waitBuild(job)
+	if job.Status == master.BuildFailed {
+		log.Fatalf("Failed to rebuild process due to: ERROR: %s OUTPUT: %s\n", job.Error, job.Output)
+	}
+	fmt.Print(job.Output)
+}
+
+// buildWaitInterval is how long the server is asked to wait for a build before replying, while
+// the client waits for it.
+const buildWaitInterval = 30 * time.Second
+
+// waitBuild will wait for job to finish.
+// Returns the finished job.
+func (cli *Cli) waitBuild(job master.BuildJob) master.BuildJob {
+	for !job.Finished() {
+		var err error
+		job, err = cli.remoteClient.GetBuild(job.ID, buildWaitInterval)
+		if err != nil {
+			log.Fatalf("Failed to get build due to: %+v\n", err)
+		}
+	}
+	return job
+}
+
+// Builds will print the last build jobs, oldest first.
+func (cli *Cli) Builds() {
+	jobs, err := cli.remoteClient.ListBuilds()
+	if err != nil {
+		log.Fatalf("Failed to list builds due to: %+v\n", err)
+	}
+	headers := []string{"id", "name", "kind", "status", "version", "queued", "duration"}
+	rows := [][]string{}
+	for _, job := range jobs {
+		version := "-"
+		if job.Version > 0 {
+			version = fmt.Sprintf("%d", job.Version)
+		}
+		duration := "-"
+		if job.Finished() {
+			duration = job.FinishedAt.Sub(job.StartedAt).Truncate(time.Millisecond).String()
+		} else if job.Status == master.BuildBuilding {
+			duration = time.Since(job.StartedAt).Truncate(time.Second).String()
+		}
+		rows = append(rows, []string{
+			fmt.Sprintf("%d", job.ID),
+			job.Name,
+			job.Kind,
+			job.Status,
+			version,
+			job.QueuedAt.Format("2006-01-02 15:04:05"),
+			duration,
+		})
+	}
+	printTable(headers, rows)
+}
+
+// BuildLog will print the output of the build job id, and the error of failed jobs on stderr.
+// With wait set, the job is waited for first. Otherwise unfinished jobs only print their status.
+func (cli *Cli) BuildLog(id int, wait bool) {
+	job, err := cli.remoteClient.GetBuild(id, 0)
+	if err != nil {
+		log.Fatalf("Failed to get build due to: %+v\n", err)
+	}
+	if wait {
+		job = cli.waitBuild(job)
+	}
+	if !job.Finished() {
+		fmt.Fprintf(os.Stderr, "Build %d is %s.\n", job.ID, job.Status)
+		return
+	}
+	fmt.Print(job.Output)
+	if job.Status == master.BuildFailed {
+		fmt.Fprintf(os.Stderr, "Build %d failed: %s\n", job.ID, job.Error)
+		os.Exit(1)
+	}
+}
+
+// RollbackProcess will restart the process with procName on one of its previous versions,
+// without building anything. A zero version means the one built before the current one.
+func (cli *Cli) RollbackProcess(procName string, version int, timeout time.Duration) {
+	err := cli.remoteClient.RollbackProcess(procName, version, timeout)
+	if err != nil {
+		log.Fatalf("Failed to roll back process due to: %+v\n", err)
+	}
+}
+
+// Versions will print the built versions of the process with procName. The version the process
+// runs is marked with a *.
+func (cli *Cli) Versions(procName string) {
+	response, err := cli.remoteClient.ListVersions(procName)
+	if err != nil {
+		log.Fatalf("Failed to list versions due to: %+v\n", err)
+	}
+	headers := []string{"version", "built", "revision", "checksum"}
+	rows := [][]string{}
+	for _, version := range response.Versions {
+		id := fmt.Sprintf("%d", version.ID)
+		if version.ID == response.Current {
+			id += "*"
+		}
+		revision := version.Revision
+		if revision == "" {
+			revision = "-"
+		}
+		checksum := version.Checksum
+		if len(checksum) > 12 {
+			checksum = checksum[:12]
+		}
+		rows = append(rows, []string{
+			id,
+			version.BuiltAt.Format("2006-01-02 15:04:05"),
+			revision,
+			checksum,
+		})
+	}
+	printTable(headers, rows)
+}
+
 // StartProcess will try to start a process with procName. Note that this process
 // must have been already started through StartGoBin.
 func (cli *Cli) StartProcess(procName string) {
@@ -68,14 +292,169 @@ func (cli *Cli) StartProcess(procName string) {
 	}
 }
 
+// WaitReady will wait up to timeout for the process with procName to be ready, or running in
+// case it has no readiness check.
+// Returns a fatal error, with the process status, in case it is not.
+func (cli *Cli) WaitReady(procName string, timeout time.Duration) {
+	err := cli.remoteClient.WaitReady(procName, timeout)
+	if err == nil {
+		fmt.Printf("Process %s is ready.\n", procName)
+		return
+	}
+	message := err.Error()
+	if response, statusErr := cli.remoteClient.MonitStatus(); statusErr == nil {
+		for _, proc := range response.Procs {
+			if proc.Name != procName {
+				continue
+			}
+			message = fmt.Sprintf("%s Its status is %s", message, proc.Status.Status)
+			if lastExit := proc.Status.LastExit(); lastExit != "" {
+				message = fmt.Sprintf("%s, last exit: %s", message, lastExit)
+			}
+			message += "."
+		}
+	}
+	log.Fatalf("Failed to wait for process due to: %s\n", message)
+}
+
 // StopProcess will try to stop a process named procName.
 func (cli *Cli) StopProcess(procName string) {
-	err := cli.remoteClient.StopProcess(procName)
+	cli.StopProcessWithTimeout(procName, 0)
+}
+
+// StopProcessWithTimeout will try to stop a process named procName. The process is killed in
+// case it does not stop within timeout, or its own stop timeout if timeout is zero.
+func (cli *Cli) StopProcessWithTimeout(procName string, timeout time.Duration) {
+	err := cli.remoteClient.StopProcessWithTimeout(procName, timeout)
 	if err != nil {
 		log.Fatalf("Failed to stop process due to: %+v\n", err)
 	}
 }
 
+// SetEnv will set environment variables on process procName. They take effect on its next restart.
+func (cli *Cli) SetEnv(procName string, vars map[string]string) {
+	err := cli.remoteClient.SetEnv(procName, vars)
+	if err != nil {
+		log.Fatalf("Failed to set env due to: %+v\n", err)
+	}
+}
+
+// UnsetEnv will remove environment variables from process procName. It takes effect on its next restart.
+func (cli *Cli) UnsetEnv(procName string, keys []string) {
+	err := cli.remoteClient.UnsetEnv(procName, keys)
+	if err != nil {
+		log.Fatalf("Failed to unset env due to: %+v\n", err)
+	}
+}
+
+// RotateLogs will rotate the out and err files of process procName without restarting it.
+func (cli *Cli) RotateLogs(procName string) {
+	err := cli.remoteClient.RotateLogs(procName)
+	if err != nil {
+		log.Fatalf("Failed to rotate logs due to: %+v\n", err)
+	}
+}
+
+// FlushLogs will empty the out and err files of process procName and delete their rotated files.
+func (cli *Cli) FlushLogs(procName string) {
+	err := cli.remoteClient.FlushLogs(procName)
+	if err != nil {
+		log.Fatalf("Failed to flush logs due to: %+v\n", err)
+	}
+}
+
+// logsPollInterval is how often Logs asks for new lines while following them.
+const logsPollInterval = 500 * time.Millisecond
+
+// logCursor is where Logs stopped reading a log file of a process.
+type logCursor struct {
+	name   string
+	stream string
+	offset int64
+}
+
+// LogsOptions are the options of Logs.
+type LogsOptions struct {
+	Streams []string          // Streams are the files to print, out and/or err.
+	Lines   int               // Lines is how many lines to print from each file.
+	Follow  bool              // Follow will keep printing new lines.
+	Grep    map[string]string // Grep only prints the lines whose fields have these values.
+	JSON    bool              // JSON will print each line as a JSON record.
+}
+
+// Logs will print the last lines of procNames, or of every process in case procNames is
+// empty. Lines are prefixed by the process name when there's more than one process and
+// err lines go to stderr.
+func (cli *Cli) Logs(procNames []string, options *LogsOptions) {
+	if len(procNames) == 0 {
+		procResponse, err := cli.remoteClient.MonitStatus()
+		if err != nil {
+			log.Fatalf("Failed to list processes due to: %+v\n", err)
+		}
+		for _, proc := range procResponse.Procs {
+			procNames = append(procNames, proc.Name)
+		}
+		sort.Strings(procNames)
+	}
+	width := 0
+	cursors := []*logCursor{}
+	for _, name := range procNames {
+		width = int(math.Max(float64(width), float64(len(name))))
+		for _, stream := range options.Streams {
+			cursors = append(cursors, &logCursor{name: name, stream: stream, offset: -1})
+		}
+	}
+	for {
+		for _, cursor := range cursors {
+			logLines, offset, err := cli.remoteClient.ReadLogs(&master.LogsRequest{
+				Name:   cursor.name,
+				Stream: cursor.stream,
+				Offset: cursor.offset,
+				Lines:  options.Lines,
+				Grep:   options.Grep,
+			})
+			if err != nil {
+				log.Fatalf("Failed to read logs of %s due to: %+v\n", cursor.name, err)
+			}
+			cursor.offset = offset
+			out := os.Stdout
+			if cursor.stream == "err" {
+				out = os.Stderr
+			}
+			for _, line := range logLines {
+				if options.JSON {
+					fmt.Fprintln(out, jsonRecord(cursor, line))
+				} else if len(procNames) > 1 {
+					fmt.Fprintf(out, "%-*s | %s\n", width, cursor.name, line)
+				} else {
+					fmt.Fprintln(out, line)
+				}
+			}
+		}
+		if !options.Follow {
+			return
+		}
+		time.Sleep(logsPollInterval)
+	}
+}
+
+// jsonRecord will turn a line read from the logs of cursor into a JSON record, filling the
+// proc and stream fields in case the line does not have them.
+func jsonRecord(cursor *logCursor, line string) string {
+	record := logs.ParseRecord(line)
+	if _, ok := record["proc"]; !ok {
+		record["proc"] = cursor.name
+	}
+	if _, ok := record["stream"]; !ok {
+		record["stream"] = cursor.stream
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Fatalf("Failed to encode log line due to: %+v\n", err)
+	}
+	return string(data)
+}
+
 // DeleteProcess will stop and delete all dependencies from process procName forever.
 func (cli *Cli) DeleteProcess(procName string) {
 	err := cli.remoteClient.DeleteProcess(procName)
@@ -90,36 +469,114 @@ func (cli *Cli) Status() {
 	if err != nil {
 		log.Fatalf("Failed to get status due to: %+v\n", err)
 	}
-	maxName := 0
-	for id := range procResponse.Procs {
-		proc := procResponse.Procs[id]
-		maxName = int(math.Max(float64(maxName), float64(len(proc.Name))))
-	}
-	totalSize := maxName + 51;
-	topBar := ""
-	for i := 1; i <= totalSize; i += 1 {
-		topBar += "-"
-	}
-	infoBar := fmt.Sprintf("|%s|%s|%s|%s|",
-		PadString("pid", 13),
-		PadString("name", maxName + 2),
-		PadString("status", 16),
-		PadString("keep-alive", 15))
-	fmt.Println(topBar)
-	fmt.Println(infoBar)
+	headers := []string{"pid", "name", "status", "health", "keep-alive", "restarts", "uptime", "last exit", "children", "cpu", "rss", "vsz", "fds", "threads", "read/write"}
+	rows := [][]string{}
 	for id := range procResponse.Procs {
 		proc := procResponse.Procs[id]
 		kp := "True"
 		if !proc.KeepAlive {
 			kp = "False"
 		}
-		fmt.Printf("|%s|%s|%s|%s|\n",
-			PadString(fmt.Sprintf("%d", proc.Pid), 13),
-			PadString(proc.Name, maxName + 2),
-			PadString(proc.Status.Status, 16),
-			PadString(kp, 15))
+		uptime := "-"
+		if proc.Uptime > 0 {
+			uptime = proc.Uptime.Truncate(time.Second).String()
+		}
+		lastExit := proc.Status.LastExit()
+		if lastExit == "" {
+			lastExit = "-"
+		}
+		restarts := fmt.Sprintf("%d", proc.Status.Restarts)
+		if proc.Status.MemoryRestarts > 0 {
+			restarts += fmt.Sprintf(" (+%d mem)", proc.Status.MemoryRestarts)
+		}
+		health := proc.Status.Health
+		if health == "" {
+			health = "-"
+		}
+		children := []string{}
+		for _, child := range proc.Children {
+			children = append(children, fmt.Sprintf("%d", child))
+		}
+		if len(children) == 0 {
+			children = append(children, "-")
+		}
+		usage := []string{"-", "-", "-", "-", "-", "-"}
+		if metrics := proc.Metrics; metrics != nil {
+			usage = []string{
+				fmt.Sprintf("%.1f%%", metrics.CPUPercent),
+				utils.FormatSize(metrics.RSS),
+				utils.FormatSize(metrics.VSZ),
+				fmt.Sprintf("%d", metrics.FDs),
+				fmt.Sprintf("%d", metrics.Threads),
+				utils.FormatSize(metrics.ReadBytes) + "/" + utils.FormatSize(metrics.WriteBytes),
+			}
+		}
+		row := []string{
+			fmt.Sprintf("%d", proc.Pid),
+			proc.Name,
+			proc.Status.Status,
+			health,
+			kp,
+			restarts,
+			uptime,
+			lastExit,
+			strings.Join(children, ","),
+		}
+		rows = append(rows, append(row, usage...))
+	}
+	printTable(headers, rows)
+}
+
+// printTable will print rows under headers, padding each column to its widest value.
+func printTable(headers []string, rows [][]string) {
+	widths := make([]int, len(headers))
+	for i, header := range headers {
+		widths[i] = len(header)
+		for _, row := range rows {
+			widths[i] = int(math.Max(float64(widths[i]), float64(len(row[i]))))
+		}
+		widths[i] += 4
 	}
+	totalSize := len(widths) + 1
+	for _, width := range widths {
+		totalSize += width
+	}
+	topBar := strings.Repeat("-", totalSize)
 	fmt.Println(topBar)
+	fmt.Println(formatRow(headers, widths))
+	for _, row := range rows {
+		fmt.Println(formatRow(row, widths))
+	}
+	fmt.Println(topBar)
+}
+
+func formatRow(row []string, widths []int) string {
+	line := "|"
+	for i := range row {
+		line += PadString(row[i], widths[i]) + "|"
+	}
+	return line
+}
+
+// absPath will resolve path from the current directory, since the server may run somewhere else.
+// Empty paths are kept empty.
+func absPath(path string) string {
+	if path == "" {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		log.Fatalf("Failed to resolve path %s due to: %+v\n", path, err)
+	}
+	return abs
+}
+
+func absPaths(paths []string) []string {
+	abs := []string{}
+	for _, path := range paths {
+		abs = append(abs, absPath(path))
+	}
+	return abs
 }
 
 // PadString will add totalSize spaces evenly to the right and left side of str.
@@ -0,0 +1,35 @@
+package cli
+
+import "path/filepath"
+import "testing"
+
+import "github.com/topfreegames/apm/lib/master"
+
+func TestParseDsn(t *testing.T) {
+	socket, err := DefaultSocketPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(socket) != master.SocketFile || filepath.Base(filepath.Dir(socket)) != ".apmenv" {
+		t.Errorf("DefaultSocketPath = %s, want .apmenv/%s", socket, master.SocketFile)
+	}
+	tests := []struct {
+		dsn     string
+		network string
+		address string
+	}{
+		{"", "unix", socket},
+		{"/var/run/apm.sock", "unix", "/var/run/apm.sock"},
+		{"./apm.sock", "unix", "./apm.sock"},
+		{"unix:///var/run/apm.sock", "unix", "/var/run/apm.sock"},
+		{":9876", "tcp", ":9876"},
+		{"localhost:9876", "tcp", "localhost:9876"},
+		{"tcp://10.0.0.1:9876", "tcp", "10.0.0.1:9876"},
+	}
+	for _, test := range tests {
+		network, address, err := parseDsn(test.dsn)
+		if err != nil || network != test.network || address != test.address {
+			t.Errorf("parseDsn(%q) = (%s, %s, %v), want (%s, %s)", test.dsn, network, address, err, test.network, test.address)
+		}
+	}
+}
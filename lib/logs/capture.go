@@ -0,0 +1,94 @@
+package logs
+
+import "bufio"
+import "io"
+import "os"
+import "sync"
+import "time"
+
+// TimeFormat is the RFC3339 format, with milliseconds, of the timestamp of captured lines.
+const TimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// MaxLineSize is the longest line captured at once. Longer lines are split.
+const MaxLineSize = 64 * 1024
+
+// Line is a line written by a process on one of its streams, or by APM about the process.
+type Line struct {
+	Proc    string    // Proc is the process name.
+	Pid     int       // Pid is the process id.
+	Time    time.Time // Time is when the line was read.
+	Stream  string    // Stream is out, err or apm for the marker lines written by APM.
+	Message string    // Message is the line, without its new line.
+}
+
+// String will format line as "<timestamp> [<stream>] <message>".
+// Returns the formatted line.
+func (line *Line) String() string {
+	return line.Time.Format(TimeFormat) + " [" + line.Stream + "] " + line.Message
+}
+
+// Capture will read the lines written to reader until it is closed, tagging them with
+// stream, the time they were read and the process they come from, and hand them to handle.
+// Returns an error in case there's any other than reader being closed.
+func Capture(reader io.Reader, proc string, pid int, stream string, handle func(*Line)) error {
+	buffered := bufio.NewReaderSize(reader, MaxLineSize)
+	for {
+		data, err := buffered.ReadSlice('\n')
+		if len(data) > 0 {
+			if data[len(data)-1] == '\n' {
+				data = data[:len(data)-1]
+			}
+			handle(&Line{
+				Proc:    proc,
+				Pid:     pid,
+				Time:    time.Now(),
+				Stream:  stream,
+				Message: string(data),
+			})
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF || err == os.ErrClosed {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// FileWriter appends lines to a file. The file is kept open in append mode, so lines keep
+// going to the right place after the file is rotated or flushed.
+type FileWriter struct {
+	sync.Mutex
+	file   *os.File
+	format string
+}
+
+// OpenFileWriter will open filename to append lines to it in format, FormatText or FormatJSON,
+// creating it in case it does not exist.
+// Returns a tuple with the FileWriter and an error in case there's any.
+func OpenFileWriter(filename string, format string) (*FileWriter, error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		return nil, err
+	}
+	return &FileWriter{file: file, format: format}, nil
+}
+
+// WriteLine will append line to the file, formatted by Line.Format.
+// Returns an error in case there's any.
+func (writer *FileWriter) WriteLine(line *Line) error {
+	writer.Lock()
+	defer writer.Unlock()
+	// A single write keeps the line whole when other writers append to the same file.
+	_, err := writer.file.Write([]byte(line.Format(writer.format) + "\n"))
+	return err
+}
+
+// Close will close the file.
+// Returns an error in case there's any.
+func (writer *FileWriter) Close() error {
+	return writer.file.Close()
+}
@@ -0,0 +1,128 @@
+package logs
+
+import "bytes"
+import "io"
+import "os"
+
+// tailBlockSize is how much Tail reads at a time, walking the file backwards.
+const tailBlockSize = 4096
+
+// MaxReadSize is the most ReadFrom reads at once, so a client following a busy file
+// catches up in several calls.
+const MaxReadSize = 256 * 1024
+
+// Tail will read the last n complete lines of filename that match filters, see MatchLine. A line
+// still being written, without its trailing new line, is left for the next ReadFrom. With n <= 0
+// no line is read, only the offset to follow the file from.
+// Returns a tuple with the lines, the offset to follow the file from and an error in case there's any.
+func Tail(filename string, n int, filters map[string]string) ([]string, int64, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return []string{}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	// Blocks are read backwards, keeping the partial first line of a block until the
+	// block before it completes it.
+	lines := []string{}
+	partial := []byte{}
+	start := info.Size()
+	offset := int64(-1)
+	for start > 0 && (offset < 0 || len(lines) < n) {
+		size := int64(tailBlockSize)
+		if start < size {
+			size = start
+		}
+		start -= size
+		block := make([]byte, size)
+		if _, err := file.ReadAt(block, start); err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		data := append(block, partial...)
+		if offset < 0 {
+			// The last line is left out until it is complete.
+			complete := bytes.LastIndexByte(data, '\n') + 1
+			if complete == 0 && start > 0 {
+				partial = data
+				continue
+			}
+			offset = start + int64(complete)
+			data = data[:complete]
+		}
+		first := bytes.IndexByte(data, '\n') + 1
+		if start == 0 {
+			first = 0
+		}
+		partial = data[:first]
+		blockLines := splitLines(data[first:])
+		for i := len(blockLines) - 1; i >= 0 && len(lines) < n; i-- {
+			if MatchLine(blockLines[i], filters) {
+				lines = append([]string{blockLines[i]}, lines...)
+			}
+		}
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return lines, offset, nil
+}
+
+// ReadFrom will read the complete lines written to filename after offset that match filters,
+// see MatchLine. Files that got smaller than offset were rotated or flushed, so they are read
+// from the start.
+// Returns a tuple with the lines, the offset to keep following the file from and an error in case there's any.
+func ReadFrom(filename string, offset int64, filters map[string]string) ([]string, int64, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return []string{}, 0, nil
+	}
+	if err != nil {
+		return nil, offset, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, offset, err
+	}
+	if info.Size() < offset {
+		offset = 0
+	}
+	size := info.Size() - offset
+	if size > MaxReadSize {
+		size = MaxReadSize
+	}
+	data := make([]byte, size)
+	read, err := file.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		return nil, offset, err
+	}
+	data = data[:read]
+	complete := bytes.LastIndexByte(data, '\n') + 1
+	if complete == 0 && int64(len(data)) == MaxReadSize {
+		// A single line longer than MaxReadSize is split instead of blocking the reader.
+		complete = len(data)
+	}
+	lines := []string{}
+	for _, line := range splitLines(data[:complete]) {
+		if MatchLine(line, filters) {
+			lines = append(lines, line)
+		}
+	}
+	return lines, offset + int64(complete), nil
+}
+
+func splitLines(data []byte) []string {
+	lines := []string{}
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(line) > 0 {
+			lines = append(lines, string(bytes.TrimSuffix(line, []byte("\n"))))
+		}
+	}
+	return lines
+}
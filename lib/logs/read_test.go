@@ -0,0 +1,131 @@
+package logs
+
+import "os"
+import "path/filepath"
+import "reflect"
+import "strings"
+import "testing"
+
+// numberedLines returns count lines of width bytes each, new line included, made of the
+// last digit of their number.
+func numberedLines(count int, width int) []string {
+	lines := []string{}
+	for i := 0; i < count; i++ {
+		line := strings.Repeat(string('0'+rune(i%10)), width-1)
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestTail(t *testing.T) {
+	long := numberedLines(10, 1000)
+	longContent := strings.Join(long, "\n") + "\n"
+	huge := strings.Repeat("x", 3*tailBlockSize)
+	jsonContent := `{"x":"1"}` + "\n" + `{"x":"2"}` + "\n" + `{"x":"1","y":2}` + "\n"
+	tests := []struct {
+		name       string
+		content    string
+		n          int
+		filters    map[string]string
+		wantLines  []string
+		wantOffset int64
+	}{
+		{"empty file", "", 5, nil, []string{}, 0},
+		{"fewer lines than n", "a\nb\n", 5, nil, []string{"a", "b"}, 4},
+		{"last lines", "a\nb\nc\nd\n", 2, nil, []string{"c", "d"}, 8},
+		{"zero lines", "a\nb\nc\n", 0, nil, []string{}, 6},
+		{"negative lines", "a\nb\nc\n", -1, nil, []string{}, 6},
+		{"zero lines with a partial last line", "a\nb\nc", 0, nil, []string{}, 4},
+		{"partial last line", "a\nb\nc", 5, nil, []string{"a", "b"}, 4},
+		{"only a partial line", "abc", 5, nil, []string{}, 0},
+		{"lines across blocks", longContent, 6, nil, long[4:], int64(len(longContent))},
+		{"all lines across blocks", longContent, 20, nil, long, int64(len(longContent))},
+		{"partial line longer than a block", "a\nb\n" + huge, 1, nil, []string{"b"}, 4},
+		{"zero lines before a partial line longer than a block", "a\nb\n" + huge, 0, nil, []string{}, 4},
+		{"line longer than a block", "a\n" + huge + "\nb\n", 2, nil, []string{huge, "b"}, int64(len(huge) + 5)},
+		{"filters", jsonContent, 5, map[string]string{"x": "1"}, []string{`{"x":"1"}`, `{"x":"1","y":2}`}, int64(len(jsonContent))},
+	}
+	for _, test := range tests {
+		filename := tempLogFile(t, test.content)
+		lines, offset, err := Tail(filename, test.n, test.filters)
+		os.RemoveAll(filepath.Dir(filename))
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(lines, test.wantLines) || offset != test.wantOffset {
+			t.Errorf("%s: Tail = (%d lines %q, %d), want (%d lines %q, %d)", test.name,
+				len(lines), abbreviate(lines), offset, len(test.wantLines), abbreviate(test.wantLines), test.wantOffset)
+		}
+	}
+}
+
+func TestTailMissingFile(t *testing.T) {
+	lines, offset, err := Tail("/nonexistent/app.out", 5, nil)
+	if err != nil || len(lines) != 0 || offset != 0 {
+		t.Errorf("Tail of a missing file = (%v, %d, %v), want no lines", lines, offset, err)
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		offset     int64
+		wantLines  []string
+		wantOffset int64
+	}{
+		{"from the start", "a\nb\n", 0, []string{"a", "b"}, 4},
+		{"from an offset", "a\nb\nc\n", 2, []string{"b", "c"}, 6},
+		{"at the end", "a\nb\n", 4, []string{}, 4},
+		{"partial last line", "a\nb\nc", 2, []string{"b"}, 4},
+		{"truncated file", "x\n", 100, []string{"x"}, 2},
+		{"truncated to nothing", "", 100, []string{}, 0},
+	}
+	for _, test := range tests {
+		filename := tempLogFile(t, test.content)
+		lines, offset, err := ReadFrom(filename, test.offset, nil)
+		os.RemoveAll(filepath.Dir(filename))
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(lines, test.wantLines) || offset != test.wantOffset {
+			t.Errorf("%s: ReadFrom = (%q, %d), want (%q, %d)", test.name, lines, offset, test.wantLines, test.wantOffset)
+		}
+	}
+}
+
+func TestFollowAfterTail(t *testing.T) {
+	filename := tempLogFile(t, "a\nb\npart")
+	defer os.RemoveAll(filepath.Dir(filename))
+	_, offset, err := Tail(filename, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("ial\nc\n")
+	file.Close()
+	lines, _, err := ReadFrom(filename, offset, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"partial", "c"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines after Tail(0) = %q, want %q", lines, want)
+	}
+}
+
+// abbreviate shortens long lines so failures stay readable.
+func abbreviate(lines []string) []string {
+	short := []string{}
+	for _, line := range lines {
+		if len(line) > 12 {
+			line = line[:12] + "..."
+		}
+		short = append(short, line)
+	}
+	return short
+}
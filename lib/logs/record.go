@@ -0,0 +1,127 @@
+package logs
+
+import "encoding/json"
+import "fmt"
+import "io"
+import "strings"
+import "time"
+
+const (
+	// FormatText writes captured lines as "<timestamp> [<stream>] <message>".
+	FormatText = "text"
+	// FormatJSON writes captured lines as JSON records with the proc, pid, stream, ts and
+	// message fields. Lines that already are JSON objects are merged into the record.
+	FormatJSON = "json"
+)
+
+// Record is a log line as a set of fields.
+type Record map[string]interface{}
+
+// Record will turn line into a record. The fields of a line that is a JSON object are kept
+// as they are, otherwise the line goes to the message field. The proc, pid, stream and ts
+// fields are always set by APM.
+// Returns the record.
+func (line *Line) Record() Record {
+	record, ok := parseJSON(line.Message)
+	if !ok {
+		record = Record{"message": line.Message}
+	}
+	record["proc"] = line.Proc
+	record["pid"] = line.Pid
+	record["stream"] = line.Stream
+	record["ts"] = line.Time.Format(TimeFormat)
+	return record
+}
+
+// Format will format line as text or JSON, depending on format.
+// Returns the formatted line, without a new line.
+func (line *Line) Format(format string) string {
+	if format != FormatJSON {
+		return line.String()
+	}
+	data, err := json.Marshal(line.Record())
+	if err != nil {
+		return line.String()
+	}
+	return string(data)
+}
+
+// ParseRecord will parse a line read from a log file, written either as a JSON record, as
+// text by a capturing process or as is by the process itself.
+// Returns the record, with at least the message field for lines that are not JSON.
+func ParseRecord(line string) Record {
+	if record, ok := parseJSON(line); ok {
+		return record
+	}
+	// "<timestamp> [<stream>] <message>"
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) == 3 && strings.HasPrefix(parts[1], "[") && strings.HasSuffix(parts[1], "]") {
+		if _, err := time.Parse(TimeFormat, parts[0]); err == nil {
+			return Record{
+				"ts":      parts[0],
+				"stream":  strings.Trim(parts[1], "[]"),
+				"message": parts[2],
+			}
+		}
+	}
+	return Record{"message": line}
+}
+
+// Match will check whether the record has all the fields of filters with the same value.
+// Nested fields are separated by dots, such as request.method.
+// Returns true in case it does.
+func (record Record) Match(filters map[string]string) bool {
+	for field, value := range filters {
+		found, ok := record.lookup(field)
+		if !ok || fmt.Sprint(found) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (record Record) lookup(field string) (interface{}, bool) {
+	var current interface{} = map[string]interface{}(record)
+	for _, key := range strings.Split(field, ".") {
+		fields, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = fields[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// MatchLine will parse line and check whether it matches filters. Every line matches
+// empty filters.
+// Returns true in case it does.
+func MatchLine(line string, filters map[string]string) bool {
+	return len(filters) == 0 || ParseRecord(line).Match(filters)
+}
+
+// parseJSON will parse line as a JSON object. Numbers are kept as written, so that 1234567
+// is not turned into 1.234567e+06 when matched or written again.
+// Returns the record and true in case line is a JSON object.
+func parseJSON(line string) (Record, bool) {
+	if !isJSONObject(line) {
+		return nil, false
+	}
+	record := Record{}
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	if decoder.Decode(&record) != nil {
+		return nil, false
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, false
+	}
+	return record, true
+}
+
+func isJSONObject(line string) bool {
+	line = strings.TrimSpace(line)
+	return strings.HasPrefix(line, "{") && strings.HasSuffix(line, "}")
+}
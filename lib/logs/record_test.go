@@ -0,0 +1,57 @@
+package logs
+
+import "reflect"
+import "testing"
+import "time"
+
+func TestParseRecord(t *testing.T) {
+	tests := []struct {
+		line string
+		want Record
+	}{
+		{`{"msg":"hello","level":"info"}`, Record{"msg": "hello", "level": "info"}},
+		{"2024-01-02T03:04:05.000Z [err] boom", Record{"ts": "2024-01-02T03:04:05.000Z", "stream": "err", "message": "boom"}},
+		{"plain line", Record{"message": "plain line"}},
+		{"{not json}", Record{"message": "{not json}"}},
+		{`{"a":1} {"b":2}`, Record{"message": `{"a":1} {"b":2}`}},
+	}
+	for _, test := range tests {
+		if got := ParseRecord(test.line); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseRecord(%q) = %v, want %v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestRecordMatch(t *testing.T) {
+	record := ParseRecord(`{"pid":1234567,"ratio":0.5,"big":12345678901234567890,"ok":true,"request":{"method":"GET"}}`)
+	tests := []struct {
+		filters map[string]string
+		want    bool
+	}{
+		{nil, true},
+		{map[string]string{"pid": "1234567"}, true},
+		{map[string]string{"ratio": "0.5"}, true},
+		{map[string]string{"big": "12345678901234567890"}, true},
+		{map[string]string{"ok": "true"}, true},
+		{map[string]string{"request.method": "GET"}, true},
+		{map[string]string{"pid": "1234567", "request.method": "POST"}, false},
+		{map[string]string{"pid": "1.234567e+06"}, false},
+		{map[string]string{"missing": ""}, false},
+		{map[string]string{"pid.nested": "1"}, false},
+	}
+	for _, test := range tests {
+		if got := record.Match(test.filters); got != test.want {
+			t.Errorf("Match(%v) = %t, want %t", test.filters, got, test.want)
+		}
+	}
+}
+
+func TestLineFormatJSON(t *testing.T) {
+	line := &Line{Proc: "app", Pid: 1234567, Stream: "out", Time: time.Unix(0, 0).UTC(), Message: `{"count":1234567,"ts":"ignored"}`}
+	record := ParseRecord(line.Format(FormatJSON))
+	for field, want := range map[string]string{"proc": "app", "pid": "1234567", "stream": "out", "count": "1234567", "ts": "1970-01-01T00:00:00.000Z"} {
+		if !record.Match(map[string]string{field: want}) {
+			t.Errorf("formatted record %v does not have %s=%s", record, field, want)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+/*
+Logs package rotates, compresses and prunes the out and err files of the processes managed by APM.
+*/
+package logs
+
+import "compress/gzip"
+import "encoding/json"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+import "github.com/topfreegames/apm/lib/utils"
+
+// segmentTimeFormat is the suffix added to the name of rotated files. It sorts by date.
+const segmentTimeFormat = "20060102T150405.000"
+
+// RotateConfig defines when the log files of a process are rotated and how many rotated
+// files are kept. Zero values disable the matching rule.
+type RotateConfig struct {
+	MaxSize  int64         `json:"max_size"` // MaxSize rotates a file once it grows past this many bytes.
+	MaxAge   time.Duration `json:"max_age"`  // MaxAge rotates a non empty file after it has been written for this long.
+	Keep     int           `json:"keep"`     // Keep is how many rotated files are kept. Zero keeps them all.
+	Compress bool          `json:"compress"` // Compress will gzip the rotated files.
+}
+
+// MarshalJSON will encode config with its durations as strings such as 1m30s.
+// Returns a tuple with the JSON object and an error in case there's any.
+func (config RotateConfig) MarshalJSON() ([]byte, error) {
+	type plain RotateConfig
+	return json.Marshal(&struct {
+		plain
+		MaxAge utils.Duration `json:"max_age"`
+	}{plain(config), utils.Duration(config.MaxAge)})
+}
+
+// UnmarshalJSON will decode config, with its durations as strings such as 1m30s or
+// numbers of nanoseconds.
+// Returns an error in case there's any.
+func (config *RotateConfig) UnmarshalJSON(data []byte) error {
+	type plain RotateConfig
+	return json.Unmarshal(data, &struct {
+		*plain
+		MaxAge *utils.Duration `json:"max_age"`
+	}{(*plain)(config), (*utils.Duration)(&config.MaxAge)})
+}
+
+// Enabled will check whether files should be rotated automatically.
+// Returns true in case they should.
+func (config RotateConfig) Enabled() bool {
+	return config.MaxSize > 0 || config.MaxAge > 0
+}
+
+// Rotator rotates log files that are kept open in append mode by the processes. The file
+// is copied to a new segment and then truncated, so the process keeps its file descriptor
+// and does not need to be restarted. Lines written between the copy and the truncation are lost.
+type Rotator struct {
+	sync.Mutex
+	rotatedAt map[string]time.Time
+}
+
+// NewRotator will create a Rotator.
+// Returns the Rotator instance.
+func NewRotator() *Rotator {
+	return &Rotator{
+		rotatedAt: make(map[string]time.Time),
+	}
+}
+
+// RotateIfNeeded will rotate filename in case it is bigger than config.MaxSize or it has
+// been written for longer than config.MaxAge.
+// Returns a tuple with whether the file was rotated and an error in case there's any.
+func (rotator *Rotator) RotateIfNeeded(filename string, config RotateConfig, now time.Time) (bool, error) {
+	if !config.Enabled() {
+		return false, nil
+	}
+	rotator.Lock()
+	defer rotator.Unlock()
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.Size() == 0 {
+		return false, nil
+	}
+	tooBig := config.MaxSize > 0 && info.Size() >= config.MaxSize
+	tooOld := config.MaxAge > 0 && now.Sub(rotator.lastRotation(filename, now)) >= config.MaxAge
+	if !tooBig && !tooOld {
+		return false, nil
+	}
+	return true, rotator.rotate(filename, config, now)
+}
+
+// Rotate will rotate filename right away, unless it is empty.
+// Returns an error in case there's any.
+func (rotator *Rotator) Rotate(filename string, config RotateConfig, now time.Time) error {
+	rotator.Lock()
+	defer rotator.Unlock()
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) || (err == nil && info.Size() == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return rotator.rotate(filename, config, now)
+}
+
+// Flush will empty filename and delete all its rotated files.
+// Returns an error in case there's any.
+func (rotator *Rotator) Flush(filename string, now time.Time) error {
+	rotator.Lock()
+	defer rotator.Unlock()
+	if err := os.Truncate(filename, 0); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	segments, err := Segments(filename)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if err := os.Remove(segment); err != nil {
+			return err
+		}
+	}
+	rotator.rotatedAt[filename] = now
+	return nil
+}
+
+// lastRotation returns when filename was last rotated. Files never rotated by this
+// instance start counting from their newest segment, or from now.
+func (rotator *Rotator) lastRotation(filename string, now time.Time) time.Time {
+	if rotatedAt, ok := rotator.rotatedAt[filename]; ok {
+		return rotatedAt
+	}
+	rotatedAt := now
+	if segments, err := Segments(filename); err == nil && len(segments) > 0 {
+		if t, err := segmentTime(filename, segments[len(segments)-1]); err == nil {
+			rotatedAt = t
+		}
+	}
+	rotator.rotatedAt[filename] = rotatedAt
+	return rotatedAt
+}
+
+// NOT Thread Safe. Lock should be acquired before calling it.
+func (rotator *Rotator) rotate(filename string, config RotateConfig, now time.Time) error {
+	segment := filename + "." + now.UTC().Format(segmentTimeFormat)
+	if err := copyFile(filename, segment); err != nil {
+		return err
+	}
+	if err := os.Truncate(filename, 0); err != nil {
+		return err
+	}
+	rotator.rotatedAt[filename] = now
+	if config.Compress {
+		if err := compressFile(segment); err != nil {
+			return err
+		}
+	}
+	return prune(filename, config.Keep)
+}
+
+// Segments will list the rotated files of filename, oldest first.
+// Returns a tuple with the segment paths and an error in case there's any.
+func Segments(filename string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Dir(filename))
+	if err != nil {
+		return nil, err
+	}
+	segments := []string{}
+	for _, entry := range entries {
+		segment := filepath.Join(filepath.Dir(filename), entry.Name())
+		if _, err := segmentTime(filename, segment); err == nil {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// segmentTime parses the rotation time out of the name of a segment of filename.
+func segmentTime(filename string, segment string) (time.Time, error) {
+	suffix := strings.TrimPrefix(segment, filename+".")
+	if suffix == segment {
+		return time.Time{}, os.ErrNotExist
+	}
+	return time.Parse(segmentTimeFormat, strings.TrimSuffix(suffix, ".gz"))
+}
+
+// prune deletes the oldest segments of filename, keeping the newest keep ones.
+func prune(filename string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	segments, err := Segments(filename)
+	if err != nil {
+		return err
+	}
+	for len(segments) > keep {
+		if err := os.Remove(segments[0]); err != nil {
+			return err
+		}
+		segments = segments[1:]
+	}
+	return nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// compressFile replaces filename with filename.gz.
+func compressFile(filename string) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(filename+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(out)
+	if _, err := io.Copy(writer, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
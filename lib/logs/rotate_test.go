@@ -0,0 +1,120 @@
+package logs
+
+import "compress/gzip"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+import "time"
+
+func tempLogFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "apm-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "app.out")
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func readFile(t *testing.T, filename string) string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotateIfNeededBySize(t *testing.T) {
+	filename := tempLogFile(t, "0123456789\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+	rotator := NewRotator()
+	now := time.Unix(1000, 0)
+	if rotated, err := rotator.RotateIfNeeded(filename, RotateConfig{MaxSize: 100}, now); rotated || err != nil {
+		t.Fatalf("RotateIfNeeded below MaxSize = (%t, %v), want (false, nil)", rotated, err)
+	}
+	if rotated, err := rotator.RotateIfNeeded(filename, RotateConfig{MaxSize: 10}, now); !rotated || err != nil {
+		t.Fatalf("RotateIfNeeded above MaxSize = (%t, %v), want (true, nil)", rotated, err)
+	}
+	if content := readFile(t, filename); content != "" {
+		t.Errorf("file after rotation = %q, want it empty", content)
+	}
+	segments, err := Segments(filename)
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("Segments = (%v, %v), want one segment", segments, err)
+	}
+	if content := readFile(t, segments[0]); content != "0123456789\n" {
+		t.Errorf("segment = %q, want the rotated content", content)
+	}
+	if rotated, err := rotator.RotateIfNeeded(filename, RotateConfig{MaxSize: 10}, now); rotated || err != nil {
+		t.Errorf("RotateIfNeeded of an empty file = (%t, %v), want (false, nil)", rotated, err)
+	}
+}
+
+func TestRotateIfNeededByAge(t *testing.T) {
+	filename := tempLogFile(t, "line\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+	rotator := NewRotator()
+	config := RotateConfig{MaxAge: time.Hour}
+	now := time.Unix(1000, 0)
+	if rotated, _ := rotator.RotateIfNeeded(filename, config, now); rotated {
+		t.Fatal("RotateIfNeeded rotated a file seen for the first time")
+	}
+	if rotated, _ := rotator.RotateIfNeeded(filename, config, now.Add(30*time.Minute)); rotated {
+		t.Fatal("RotateIfNeeded rotated a file before MaxAge")
+	}
+	if rotated, err := rotator.RotateIfNeeded(filename, config, now.Add(time.Hour)); !rotated || err != nil {
+		t.Fatalf("RotateIfNeeded after MaxAge = (%t, %v), want (true, nil)", rotated, err)
+	}
+}
+
+func TestRotateKeepAndCompress(t *testing.T) {
+	filename := tempLogFile(t, "")
+	defer os.RemoveAll(filepath.Dir(filename))
+	rotator := NewRotator()
+	config := RotateConfig{Keep: 2, Compress: true}
+	now := time.Unix(1000, 0)
+	for i := 0; i < 4; i++ {
+		content := strings.Repeat(string('a'+rune(i)), 5)
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := rotator.Rotate(filename, config, now.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, err := Segments(filename)
+	if err != nil || len(segments) != 2 {
+		t.Fatalf("Segments = (%v, %v), want the 2 newest segments", segments, err)
+	}
+	for i, segment := range segments {
+		if !strings.HasSuffix(segment, ".gz") {
+			t.Fatalf("segment %s is not compressed", segment)
+		}
+		file, err := os.Open(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(reader)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.Repeat(string('c'+rune(i)), 5); string(data) != want {
+			t.Errorf("segment %d = %q, want %q", i, data, want)
+		}
+	}
+	if err := rotator.Flush(filename, now); err != nil {
+		t.Fatal(err)
+	}
+	if segments, _ := Segments(filename); len(segments) != 0 {
+		t.Errorf("Segments after Flush = %v, want none", segments)
+	}
+}
@@ -0,0 +1,365 @@
+package logs
+
+import "encoding/json"
+import "errors"
+import "fmt"
+import "net"
+import "net/url"
+import "os"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "time"
+
+const (
+	// SinkFile appends lines to the out and err files of the process. It is the default.
+	SinkFile = "file"
+	// SinkSyslog sends lines as RFC5424 messages to the local syslog, or to a UDP or TCP collector.
+	SinkSyslog = "syslog"
+	// SinkJSON sends lines as newline delimited JSON records to a TCP collector.
+	SinkJSON = "json"
+)
+
+// SyslogSocket is the local syslog socket.
+const SyslogSocket = "/dev/log"
+
+// SinkBufferSize is how many lines a sink queues before it starts dropping them.
+const SinkBufferSize = 1024
+
+// sinkDialTimeout and sinkWriteTimeout bound the time spent on a collector that is down or too slow.
+const sinkDialTimeout = 5 * time.Second
+const sinkWriteTimeout = 5 * time.Second
+
+// sinkRedialInterval is how long a network sink waits before connecting again after a failure.
+// Lines written meanwhile are dropped.
+const sinkRedialInterval = 1 * time.Second
+
+var errSinkDisconnected = errors.New("Sink is not connected.")
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "local0": 16, "local1": 17, "local2": 18,
+	"local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverities maps each stream to a syslog severity. Err lines are errors, APM marker
+// lines are notices and the rest are informational.
+var syslogSeverities = map[string]int{
+	"err": 3,
+	"apm": 5,
+	"out": 6,
+}
+
+// SinkConfig defines where the captured lines of a process are sent.
+type SinkConfig struct {
+	Type     string `json:"type"`     // Type is file, syslog or json.
+	Network  string `json:"network"`  // Network is udp or tcp for syslog, or tcp for json. Local syslog uses unixgram.
+	Address  string `json:"address"`  // Address is host:port, or the socket path for local syslog.
+	Facility string `json:"facility"` // Facility is the syslog facility name. Defaults to user.
+}
+
+// ParseSink will parse a sink given as file, syslog for the local syslog, syslog://host:port
+// or syslog+udp://host:port for UDP syslog, syslog+tcp://host:port for TCP syslog or
+// json://host:port for JSON records over TCP. Syslog sinks take a facility query parameter,
+// such as syslog://logs:514?facility=local0.
+// Returns a tuple with the sink config and an error in case there's any.
+func ParseSink(sink string) (SinkConfig, error) {
+	if sink == SinkFile {
+		return SinkConfig{Type: SinkFile}, nil
+	}
+	if sink == SinkSyslog {
+		return SinkConfig{Type: SinkSyslog, Network: "unixgram", Address: SyslogSocket}, nil
+	}
+	parsed, err := url.Parse(sink)
+	if err != nil {
+		return SinkConfig{}, err
+	}
+	config := SinkConfig{Address: parsed.Host, Facility: parsed.Query().Get("facility")}
+	switch parsed.Scheme {
+	case "syslog", "syslog+udp":
+		config.Type, config.Network = SinkSyslog, "udp"
+	case "syslog+tcp":
+		config.Type, config.Network = SinkSyslog, "tcp"
+	case "json", "json+tcp":
+		config.Type, config.Network = SinkJSON, "tcp"
+	default:
+		return SinkConfig{}, fmt.Errorf("Unknown log sink %s. Use file, syslog, syslog://host:port, syslog+tcp://host:port or json://host:port.", sink)
+	}
+	return config, config.Check()
+}
+
+// Check will validate the sink config.
+// Returns an error in case it is not valid.
+func (config SinkConfig) Check() error {
+	switch config.Type {
+	case SinkFile:
+		return nil
+	case SinkSyslog:
+		if _, ok := syslogFacilities[config.facility()]; !ok {
+			return fmt.Errorf("Unknown syslog facility %s.", config.Facility)
+		}
+		if config.Network != "udp" && config.Network != "tcp" && config.Network != "unixgram" {
+			return fmt.Errorf("Unknown syslog network %s. Use udp, tcp or unixgram.", config.Network)
+		}
+	case SinkJSON:
+		if config.Network != "tcp" {
+			return fmt.Errorf("Unknown json sink network %s. Use tcp.", config.Network)
+		}
+	default:
+		return fmt.Errorf("Unknown log sink type %s. Use file, syslog or json.", config.Type)
+	}
+	if config.Address == "" {
+		return fmt.Errorf("The %s log sink needs an address.", config.Type)
+	}
+	return nil
+}
+
+func (config SinkConfig) facility() string {
+	if config.Facility == "" {
+		return "user"
+	}
+	return config.Facility
+}
+
+// Sink receives the captured lines of a process.
+type Sink interface {
+	WriteLine(line *Line) error
+	Close() error
+}
+
+// OpenSink will create the sink described by config. Files are written in format and network
+// sinks connect on their first line, so a collector that is down does not keep the process
+// from starting. The sink is buffered, see BufferedSink.
+// Returns a tuple with the sink and an error in case there's any.
+func OpenSink(config SinkConfig, outfile string, errfile string, format string) (Sink, error) {
+	if err := config.Check(); err != nil {
+		return nil, err
+	}
+	var sink Sink
+	switch config.Type {
+	case SinkFile:
+		files, err := openFileSink(outfile, errfile, format)
+		if err != nil {
+			return nil, err
+		}
+		sink = files
+	case SinkSyslog:
+		hostname, _ := os.Hostname()
+		facility := syslogFacilities[config.facility()]
+		framed := config.Network == "tcp"
+		sink = &netSink{
+			network: config.Network,
+			address: config.Address,
+			encode: func(line *Line) []byte {
+				return syslogMessage(line, facility, hostname, framed)
+			},
+		}
+	case SinkJSON:
+		sink = &netSink{
+			network: config.Network,
+			address: config.Address,
+			encode: func(line *Line) []byte {
+				data, err := json.Marshal(line.Record())
+				if err != nil {
+					return nil
+				}
+				return append(data, '\n')
+			},
+		}
+	}
+	return NewBufferedSink(sink), nil
+}
+
+// fileSink appends out and apm lines to the out file and err lines to the err file.
+type fileSink struct {
+	out *FileWriter
+	err *FileWriter
+}
+
+func openFileSink(outfile string, errfile string, format string) (*fileSink, error) {
+	out, err := OpenFileWriter(outfile, format)
+	if err != nil {
+		return nil, err
+	}
+	errWriter, err := OpenFileWriter(errfile, format)
+	if err != nil {
+		out.Close()
+		return nil, err
+	}
+	return &fileSink{out: out, err: errWriter}, nil
+}
+
+func (sink *fileSink) WriteLine(line *Line) error {
+	if line.Stream == "err" {
+		return sink.err.WriteLine(line)
+	}
+	return sink.out.WriteLine(line)
+}
+
+func (sink *fileSink) Close() error {
+	err := sink.out.Close()
+	if errClose := sink.err.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// netSink writes encoded lines to a connection that is opened on the first line and opened
+// again after it fails. NOT Thread Safe, BufferedSink writes from a single goroutine.
+type netSink struct {
+	network  string
+	address  string
+	encode   func(line *Line) []byte
+	conn     net.Conn
+	failedAt time.Time
+}
+
+func (sink *netSink) WriteLine(line *Line) error {
+	if sink.conn == nil {
+		if time.Since(sink.failedAt) < sinkRedialInterval {
+			return errSinkDisconnected
+		}
+		conn, err := net.DialTimeout(sink.network, sink.address, sinkDialTimeout)
+		if err != nil {
+			sink.failedAt = time.Now()
+			return err
+		}
+		sink.conn = conn
+	}
+	data := sink.encode(line)
+	if data == nil {
+		return nil
+	}
+	sink.conn.SetWriteDeadline(time.Now().Add(sinkWriteTimeout))
+	if _, err := sink.conn.Write(data); err != nil {
+		sink.conn.Close()
+		sink.conn = nil
+		sink.failedAt = time.Now()
+		return err
+	}
+	return nil
+}
+
+func (sink *netSink) Close() error {
+	if sink.conn == nil {
+		return nil
+	}
+	return sink.conn.Close()
+}
+
+// syslogMessage formats line as a RFC5424 message. TCP messages are framed with their length,
+// as in RFC6587, while datagrams carry a single message each.
+func syslogMessage(line *Line, facility int, hostname string, framed bool) []byte {
+	severity, ok := syslogSeverities[line.Stream]
+	if !ok {
+		severity = syslogSeverities["out"]
+	}
+	message := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		facility*8+severity,
+		line.Time.Format(TimeFormat),
+		syslogField(hostname, 255),
+		syslogField(line.Proc, 48),
+		line.Pid,
+		syslogField(line.Stream, 32),
+		line.Message)
+	if framed {
+		message = fmt.Sprintf("%d %s", len(message), message)
+	}
+	return []byte(message)
+}
+
+// syslogField makes value fit a RFC5424 header field: printable ASCII without spaces, up to
+// max characters, or - when empty.
+func syslogField(value string, max int) string {
+	field := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, value)
+	if len(field) > max {
+		field = field[:max]
+	}
+	if field == "" {
+		return "-"
+	}
+	return field
+}
+
+// BufferedSink queues lines for a sink that is written from its own goroutine. Lines are
+// dropped when the queue is full or the sink fails to write them, so a slow sink never blocks
+// the process writing them, and the sink is told how many were dropped once it catches up.
+type BufferedSink struct {
+	sync.Mutex
+	sink    Sink
+	lines   chan *Line
+	done    chan struct{}
+	closed  bool
+	dropped uint64
+}
+
+// NewBufferedSink will start writing the lines queued on the returned BufferedSink to sink.
+// Returns the BufferedSink instance.
+func NewBufferedSink(sink Sink) *BufferedSink {
+	buffered := &BufferedSink{
+		sink:  sink,
+		lines: make(chan *Line, SinkBufferSize),
+		done:  make(chan struct{}),
+	}
+	go buffered.drain()
+	return buffered
+}
+
+// WriteLine will queue line without waiting for the sink. Lines written after Close, or
+// while the queue is full, are dropped.
+// Returns nil, errors writing to the sink are not reported.
+func (buffered *BufferedSink) WriteLine(line *Line) error {
+	buffered.Lock()
+	defer buffered.Unlock()
+	if buffered.closed {
+		return nil
+	}
+	select {
+	case buffered.lines <- line:
+	default:
+		atomic.AddUint64(&buffered.dropped, 1)
+	}
+	return nil
+}
+
+// Close will write the queued lines and close the sink.
+// Returns an error in case there's any.
+func (buffered *BufferedSink) Close() error {
+	buffered.Lock()
+	if buffered.closed {
+		buffered.Unlock()
+		return nil
+	}
+	buffered.closed = true
+	close(buffered.lines)
+	buffered.Unlock()
+	<-buffered.done
+	return buffered.sink.Close()
+}
+
+func (buffered *BufferedSink) drain() {
+	defer close(buffered.done)
+	for line := range buffered.lines {
+		if dropped := atomic.SwapUint64(&buffered.dropped, 0); dropped > 0 {
+			err := buffered.sink.WriteLine(&Line{
+				Proc:    line.Proc,
+				Pid:     line.Pid,
+				Time:    time.Now(),
+				Stream:  "apm",
+				Message: fmt.Sprintf("dropped %d lines, the log sink could not keep up", dropped),
+			})
+			if err != nil {
+				atomic.AddUint64(&buffered.dropped, dropped)
+			}
+		}
+		// Lines the sink fails to write, such as while a collector is down, count as dropped.
+		if err := buffered.sink.WriteLine(line); err != nil {
+			atomic.AddUint64(&buffered.dropped, 1)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package master
+
+import "errors"
+import "sync"
+import "time"
+
+// ErrUnknownBuild is returned when there is no build job with the given ID.
+var ErrUnknownBuild = errors.New("Unknown build.")
+
+const (
+	BuildQueued    = "queued"    // BuildQueued jobs wait for a free build slot.
+	BuildBuilding  = "building"  // BuildBuilding jobs are running.
+	BuildSucceeded = "succeeded" // BuildSucceeded jobs built and started their process.
+	BuildFailed    = "failed"    // BuildFailed jobs have the error and the build output.
+)
+
+// DefaultBuildConcurrency is how many builds run at once when BuildConcurrency is not set.
+const DefaultBuildConcurrency = 2
+
+// maxBuildJobs is how many jobs are remembered. The oldest finished jobs are forgotten first.
+const maxBuildJobs = 100
+
+// buildDurationBuckets are the upper bounds, in seconds, of the build duration histogram.
+var buildDurationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600}
+
+// BuildJob is a build of a process, either the first one or a rebuild, and what came out of it.
+type BuildJob struct {
+	ID         int       `json:"id"`
+	Name       string    `json:"name"`    // Name is the process name.
+	Kind       string    `json:"kind"`    // Kind is bin for the first build, or rebuild.
+	Status     string    `json:"status"`  // Status is queued, building, succeeded or failed.
+	Version    int       `json:"version"` // Version is the version built, once it succeeds.
+	Output     string    `json:"output"`  // Output is what the build commands wrote, once the job is finished.
+	Error      string    `json:"error"`   // Error tells why the job failed.
+	QueuedAt   time.Time `json:"queued_at"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// Finished will check whether the job succeeded or failed.
+// Returns true in case it did.
+func (job *BuildJob) Finished() bool {
+	return job.Status == BuildSucceeded || job.Status == BuildFailed
+}
+
+// buildDurations is the histogram of how long the finished builds of a process took, with
+// the given status.
+type buildDurations struct {
+	Name    string
+	Status  string
+	Count   int
+	Sum     time.Duration
+	Buckets []int // Buckets holds how many builds took at most each of buildDurationBuckets.
+}
+
+// observe adds a build that took duration to the histogram.
+func (durations *buildDurations) observe(duration time.Duration) {
+	durations.Count++
+	durations.Sum += duration
+	for i, bound := range buildDurationBuckets {
+		if duration.Seconds() <= bound {
+			durations.Buckets[i]++
+		}
+	}
+}
+
+// buildTask is a queued job and the function that runs it. run returns the build output and
+// the version built.
+type buildTask struct {
+	job *BuildJob
+	run func() ([]byte, int, error)
+}
+
+// buildQueue runs build jobs in the order they are submitted, at most concurrency at once.
+type buildQueue struct {
+	sync.Mutex
+	concurrency int
+	running     int
+	nextID      int
+	pending     []*buildTask
+	jobs        map[int]*BuildJob
+	order       []int
+	done        map[int]chan struct{}
+	durations   map[string]*buildDurations // durations are keyed by process name and status, and outlive the jobs.
+}
+
+func newBuildQueue(concurrency int) *buildQueue {
+	if concurrency <= 0 {
+		concurrency = DefaultBuildConcurrency
+	}
+	return &buildQueue{
+		concurrency: concurrency,
+		jobs:        make(map[int]*BuildJob),
+		done:        make(map[int]chan struct{}),
+		durations:   make(map[string]*buildDurations),
+	}
+}
+
+// submit queues a job for the process name and runs it once a build slot is free.
+// Returns the queued job.
+func (queue *buildQueue) submit(name string, kind string, run func() ([]byte, int, error)) BuildJob {
+	queue.Lock()
+	defer queue.Unlock()
+	queue.nextID++
+	job := &BuildJob{
+		ID:       queue.nextID,
+		Name:     name,
+		Kind:     kind,
+		Status:   BuildQueued,
+		QueuedAt: time.Now(),
+	}
+	queue.jobs[job.ID] = job
+	queue.order = append(queue.order, job.ID)
+	queue.done[job.ID] = make(chan struct{})
+	queue.pending = append(queue.pending, &buildTask{job: job, run: run})
+	queue.prune()
+	snapshot := *job
+	queue.dispatch()
+	return snapshot
+}
+
+// get returns a copy of the job with the given ID.
+func (queue *buildQueue) get(id int) (BuildJob, bool) {
+	queue.Lock()
+	defer queue.Unlock()
+	job, ok := queue.jobs[id]
+	if !ok {
+		return BuildJob{}, false
+	}
+	return *job, true
+}
+
+// list returns a copy of the jobs, oldest first.
+func (queue *buildQueue) list() []BuildJob {
+	queue.Lock()
+	defer queue.Unlock()
+	jobs := []BuildJob{}
+	for _, id := range queue.order {
+		jobs = append(jobs, *queue.jobs[id])
+	}
+	return jobs
+}
+
+// histograms returns a copy of the build duration histograms.
+func (queue *buildQueue) histograms() []buildDurations {
+	queue.Lock()
+	defer queue.Unlock()
+	histograms := []buildDurations{}
+	for _, durations := range queue.durations {
+		copied := *durations
+		copied.Buckets = append([]int{}, durations.Buckets...)
+		histograms = append(histograms, copied)
+	}
+	return histograms
+}
+
+// wait waits for the job with the given ID to finish, for at most timeout. A negative
+// timeout waits until it finishes.
+func (queue *buildQueue) wait(id int, timeout time.Duration) (BuildJob, error) {
+	queue.Lock()
+	_, ok := queue.jobs[id]
+	done := queue.done[id]
+	queue.Unlock()
+	if !ok {
+		return BuildJob{}, ErrUnknownBuild
+	}
+	if done != nil && timeout != 0 {
+		var expired <-chan time.Time
+		if timeout > 0 {
+			expired = time.After(timeout)
+		}
+		select {
+		case <-done:
+		case <-expired:
+		}
+	}
+	job, _ := queue.get(id)
+	return job, nil
+}
+
+// NOT Thread Safe. Lock should be acquired before calling it.
+// Starts the oldest pending tasks while there are free build slots.
+func (queue *buildQueue) dispatch() {
+	for queue.running < queue.concurrency && len(queue.pending) > 0 {
+		task := queue.pending[0]
+		queue.pending = queue.pending[1:]
+		queue.running++
+		task.job.Status = BuildBuilding
+		task.job.StartedAt = time.Now()
+		go queue.run(task)
+	}
+}
+
+func (queue *buildQueue) run(task *buildTask) {
+	output, version, err := task.run()
+	queue.Lock()
+	defer queue.Unlock()
+	job := task.job
+	job.Output = string(output)
+	job.Version = version
+	job.FinishedAt = time.Now()
+	job.Status = BuildSucceeded
+	if err != nil {
+		job.Status = BuildFailed
+		job.Error = err.Error()
+	}
+	key := job.Name + "/" + job.Status
+	if _, ok := queue.durations[key]; !ok {
+		queue.durations[key] = &buildDurations{
+			Name:    job.Name,
+			Status:  job.Status,
+			Buckets: make([]int, len(buildDurationBuckets)),
+		}
+	}
+	queue.durations[key].observe(job.FinishedAt.Sub(job.StartedAt))
+	close(queue.done[job.ID])
+	delete(queue.done, job.ID)
+	queue.running--
+	queue.dispatch()
+}
+
+// NOT Thread Safe. Lock should be acquired before calling it.
+// Forgets the oldest finished jobs past maxBuildJobs.
+func (queue *buildQueue) prune() {
+	extra := len(queue.order) - maxBuildJobs
+	order := []int{}
+	for _, id := range queue.order {
+		if extra > 0 && queue.jobs[id].Finished() {
+			delete(queue.jobs, id)
+			extra--
+			continue
+		}
+		order = append(order, id)
+	}
+	queue.order = order
+}
@@ -0,0 +1,476 @@
+package master
+
+import "encoding/json"
+import "errors"
+import "fmt"
+import "net/http"
+import "strconv"
+import "strings"
+import "time"
+
+import "github.com/topfreegames/apm/lib/utils"
+import log "github.com/Sirupsen/logrus"
+
+// httpAPI exposes the RemoteMaster methods as a REST API with JSON bodies. The routes are
+// described by the OpenAPI document served on /openapi.json.
+type httpAPI struct {
+	remoteMaster *RemoteMaster
+}
+
+// errorResponse is the body of every failed request.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// StartHTTPServer will serve the REST API of the remote master on dsn address, with the same
+// TLS and tokens as the RPC TCP listener. Tokens are sent as "Authorization: Bearer <token>".
+// It returns an error in case it could not listen on dsn.
+func (remote_master *RemoteMaster) StartHTTPServer(dsn string) error {
+	l, err := remote_master.listenTCP(dsn)
+	if err != nil {
+		return err
+	}
+	api := &httpAPI{remoteMaster: remote_master}
+	go func() {
+		err := http.Serve(l, api.handler())
+		log.Warnf("HTTP API stopped due to %s", err)
+	}()
+	return nil
+}
+
+func (api *httpAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, api.authorize(handler))
+	}
+	handle("/procs", api.handleProcs)
+	handle("/procs/", api.handleProc)
+	handle("/builds", api.handleBuilds)
+	handle("/builds/", api.handleBuild)
+	handle("/save", api.handleSave)
+	handle("/resurrect", api.handleResurrect)
+	mux.HandleFunc("/openapi.json", api.handleOpenAPI)
+	return mux
+}
+
+// authorize will only let requests with a valid bearer token through to handler, in case
+// tokens are configured. Read only tokens can only make GET requests, and can't read logs.
+func (api *httpAPI) authorize(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			token = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+		}
+		switch api.remoteMaster.remoteConfig.access(token) {
+		case accessDenied:
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			api.fail(w, http.StatusUnauthorized, ErrInvalidToken)
+		case accessReadOnly:
+			if r.Method != "GET" || isLogsRoute(r.URL.Path) {
+				api.fail(w, http.StatusForbidden, ErrPermissionDenied)
+				return
+			}
+			handler(w, r)
+		default:
+			handler(w, r)
+		}
+	}
+}
+
+// isLogsRoute will check whether path is one of the /procs/{name}/logs routes, which may
+// return secrets printed by the process.
+// Returns true in case it is.
+func isLogsRoute(path string) bool {
+	if !strings.HasPrefix(path, "/procs/") {
+		return false
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "/procs/"), "/")
+	return len(parts) >= 2 && parts[1] == "logs"
+}
+
+// handleProcs serves GET /procs and POST /procs.
+func (api *httpAPI) handleProcs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		var response ProcResponse
+		err := api.remoteMaster.MonitStatus("", &response)
+		api.reply(w, http.StatusOK, &response, err)
+	case "POST":
+		// Both GoBin and Command have a name, so the body tells them apart by source_path or cmd.
+		var body struct {
+			GoBin
+			Cmd         string         `json:"cmd"`
+			StopTimeout utils.Duration `json:"stop_timeout"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			api.fail(w, http.StatusBadRequest, err)
+			return
+		}
+		body.GoBin.StopTimeout = time.Duration(body.StopTimeout)
+		if body.Name == "" || (body.SourcePath == "") == (body.Cmd == "") {
+			api.fail(w, http.StatusBadRequest, errors.New("A name and either source_path or cmd are required."))
+			return
+		}
+		wait, err := queryBool(r, "wait", true)
+		if err != nil {
+			api.fail(w, http.StatusBadRequest, err)
+			return
+		}
+		var ack bool
+		if body.Cmd != "" {
+			command := &Command{
+				Cmd:             body.Cmd,
+				Name:            body.Name,
+				KeepAlive:       body.KeepAlive,
+				Args:            body.Args,
+				StopTimeout:     body.GoBin.StopTimeout,
+				RestartPolicy:   body.RestartPolicy,
+				HealthCheck:     body.HealthCheck,
+				ReadinessCheck:  body.ReadinessCheck,
+				Env:             body.Env,
+				EnvFiles:        body.EnvFiles,
+				Cwd:             body.Cwd,
+				Setsid:          body.Setsid,
+				LogRotate:       body.LogRotate,
+				Capture:         body.Capture,
+				LogFormat:       body.LogFormat,
+				LogSinks:        body.LogSinks,
+				MetricsChildren: body.MetricsChildren,
+				MemoryLimit:     body.MemoryLimit,
+			}
+			err = api.remoteMaster.StartCommand(command, &ack)
+		} else if !wait {
+			var job BuildJob
+			err = api.remoteMaster.SubmitGoBin(&body.GoBin, &job)
+			api.reply(w, http.StatusAccepted, &job, err)
+			return
+		} else {
+			err = api.remoteMaster.StartGoBin(&body.GoBin, &ack)
+		}
+		if err != nil {
+			api.reply(w, http.StatusCreated, nil, err)
+			return
+		}
+		api.replyProc(w, http.StatusCreated, body.Name)
+	default:
+		api.notAllowed(w, "GET, POST")
+	}
+}
+
+// handleProc serves the /procs/{name} routes.
+func (api *httpAPI) handleProc(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/procs/"), "/")
+	name := parts[0]
+	if name == "" || len(parts) > 3 {
+		api.fail(w, http.StatusNotFound, fmt.Errorf("Unknown route %s.", r.URL.Path))
+		return
+	}
+	if _, ok := api.remoteMaster.master.GetProc(name); !ok {
+		api.fail(w, http.StatusNotFound, ErrUnknownProcess)
+		return
+	}
+	action := strings.Join(parts[1:], "/")
+	var ack bool
+	switch action {
+	case "":
+		switch r.Method {
+		case "GET":
+			api.replyProc(w, http.StatusOK, name)
+		case "DELETE":
+			err := api.remoteMaster.DeleteProcess(name, &ack)
+			api.reply(w, http.StatusNoContent, nil, err)
+		default:
+			api.notAllowed(w, "GET, DELETE")
+		}
+	case "start", "stop", "restart", "rebuild", "rollback":
+		if r.Method != "POST" {
+			api.notAllowed(w, "POST")
+			return
+		}
+		var timeout time.Duration
+		if value := r.URL.Query().Get("timeout"); value != "" {
+			var err error
+			timeout, err = time.ParseDuration(value)
+			if err != nil {
+				api.fail(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		var err error
+		switch action {
+		case "rebuild":
+			wait, err := queryBool(r, "wait", true)
+			if err != nil {
+				api.fail(w, http.StatusBadRequest, err)
+				return
+			}
+			if !wait {
+				var job BuildJob
+				err = api.remoteMaster.SubmitRebuild(&ProcStopRequest{Name: name, Timeout: timeout}, &job)
+				api.reply(w, http.StatusAccepted, &job, err)
+				return
+			}
+			var response BuildResponse
+			err = api.remoteMaster.RebuildProcess(&ProcStopRequest{Name: name, Timeout: timeout}, &response)
+			api.reply(w, http.StatusOK, &response, err)
+			return
+		case "rollback":
+			req := &RollbackRequest{Name: name, Timeout: timeout}
+			if value := r.URL.Query().Get("version"); value != "" {
+				if req.Version, err = strconv.Atoi(value); err != nil {
+					api.fail(w, http.StatusBadRequest, err)
+					return
+				}
+			}
+			err = api.remoteMaster.RollbackProcess(req, &ack)
+		case "start":
+			err = api.remoteMaster.StartProcess(name, &ack)
+		case "stop":
+			err = api.remoteMaster.StopProcessWithTimeout(&ProcStopRequest{Name: name, Timeout: timeout}, &ack)
+		case "restart":
+			err = api.remoteMaster.RestartProcessWithTimeout(&ProcStopRequest{Name: name, Timeout: timeout}, &ack)
+		}
+		if err != nil {
+			api.reply(w, http.StatusOK, nil, err)
+			return
+		}
+		api.replyProc(w, http.StatusOK, name)
+	case "env":
+		req := &ProcEnvRequest{Name: name}
+		var err error
+		switch r.Method {
+		case "PUT":
+			if err := json.NewDecoder(r.Body).Decode(&req.Vars); err != nil {
+				api.fail(w, http.StatusBadRequest, err)
+				return
+			}
+			err = api.remoteMaster.SetEnv(req, &ack)
+		case "DELETE":
+			if err := json.NewDecoder(r.Body).Decode(&req.Keys); err != nil {
+				api.fail(w, http.StatusBadRequest, err)
+				return
+			}
+			err = api.remoteMaster.UnsetEnv(req, &ack)
+		default:
+			api.notAllowed(w, "PUT, DELETE")
+			return
+		}
+		api.reply(w, http.StatusNoContent, nil, err)
+	case "ready":
+		if r.Method != "GET" {
+			api.notAllowed(w, "GET")
+			return
+		}
+		req := &ReadyRequest{Name: name}
+		if value := r.URL.Query().Get("wait"); value != "" {
+			var err error
+			if req.Timeout, err = time.ParseDuration(value); err != nil {
+				api.fail(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if err := api.remoteMaster.WaitReady(req, &ack); err != nil {
+			api.reply(w, http.StatusOK, nil, err)
+			return
+		}
+		api.replyProc(w, http.StatusOK, name)
+	case "versions":
+		if r.Method != "GET" {
+			api.notAllowed(w, "GET")
+			return
+		}
+		var response VersionsResponse
+		err := api.remoteMaster.ListVersions(name, &response)
+		api.reply(w, http.StatusOK, &response, err)
+	case "logs":
+		if r.Method != "GET" {
+			api.notAllowed(w, "GET")
+			return
+		}
+		req := &LogsRequest{Name: name, Stream: "out", Offset: -1, Lines: 10}
+		query := r.URL.Query()
+		if stream := query.Get("stream"); stream != "" {
+			req.Stream = stream
+		}
+		var err error
+		if value := query.Get("offset"); value != "" {
+			if req.Offset, err = strconv.ParseInt(value, 10, 64); err != nil {
+				api.fail(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if value := query.Get("lines"); value != "" {
+			if req.Lines, err = strconv.Atoi(value); err != nil {
+				api.fail(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		for _, filter := range query["grep"] {
+			pair := strings.SplitN(filter, "=", 2)
+			if len(pair) != 2 {
+				api.fail(w, http.StatusBadRequest, fmt.Errorf("Invalid grep %s. Use field=value.", filter))
+				return
+			}
+			if req.Grep == nil {
+				req.Grep = make(map[string]string)
+			}
+			req.Grep[pair[0]] = pair[1]
+		}
+		var response LogsResponse
+		err = api.remoteMaster.ReadLogs(req, &response)
+		api.reply(w, http.StatusOK, &response, err)
+	case "logs/rotate", "logs/flush":
+		if r.Method != "POST" {
+			api.notAllowed(w, "POST")
+			return
+		}
+		var err error
+		if action == "logs/rotate" {
+			err = api.remoteMaster.RotateLogs(name, &ack)
+		} else {
+			err = api.remoteMaster.FlushLogs(name, &ack)
+		}
+		api.reply(w, http.StatusNoContent, nil, err)
+	default:
+		api.fail(w, http.StatusNotFound, fmt.Errorf("Unknown route %s.", r.URL.Path))
+	}
+}
+
+// handleBuilds serves GET /builds.
+func (api *httpAPI) handleBuilds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		api.notAllowed(w, "GET")
+		return
+	}
+	var response BuildsResponse
+	err := api.remoteMaster.ListBuilds("", &response)
+	api.reply(w, http.StatusOK, &response, err)
+}
+
+// handleBuild serves GET /builds/{id}. The wait query parameter waits up to that long for
+// the job to finish.
+func (api *httpAPI) handleBuild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		api.notAllowed(w, "GET")
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/builds/"))
+	if err != nil {
+		api.fail(w, http.StatusNotFound, fmt.Errorf("Unknown route %s.", r.URL.Path))
+		return
+	}
+	req := &BuildRequest{ID: id}
+	if value := r.URL.Query().Get("wait"); value != "" {
+		if req.Wait, err = time.ParseDuration(value); err != nil {
+			api.fail(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	var job BuildJob
+	err = api.remoteMaster.GetBuild(req, &job)
+	api.reply(w, http.StatusOK, &job, err)
+}
+
+// handleSave serves POST /save.
+func (api *httpAPI) handleSave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		api.notAllowed(w, "POST")
+		return
+	}
+	var ack bool
+	err := api.remoteMaster.Save("", &ack)
+	api.reply(w, http.StatusNoContent, nil, err)
+}
+
+// handleResurrect serves POST /resurrect.
+func (api *httpAPI) handleResurrect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		api.notAllowed(w, "POST")
+		return
+	}
+	var ack bool
+	err := api.remoteMaster.Resurrect("", &ack)
+	api.reply(w, http.StatusNoContent, nil, err)
+}
+
+// handleOpenAPI serves GET /openapi.json.
+func (api *httpAPI) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		api.notAllowed(w, "GET")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(openAPIDocument))
+}
+
+func (api *httpAPI) replyProc(w http.ResponseWriter, status int, name string) {
+	master := api.remoteMaster.master
+	master.Lock()
+	proc, ok := master.Procs[name]
+	if !ok {
+		master.Unlock()
+		api.fail(w, http.StatusNotFound, ErrUnknownProcess)
+		return
+	}
+	procData := newProcDataResponse(proc, master.metrics[name], time.Now())
+	master.Unlock()
+	api.reply(w, status, procData, nil)
+}
+
+// reply will write body as JSON with status, or the error with its matching status code in
+// case err is not nil.
+func (api *httpAPI) reply(w http.ResponseWriter, status int, body interface{}, err error) {
+	if err != nil {
+		api.fail(w, errorStatus(err), err)
+		return
+	}
+	if body == nil {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// errorStatus will find the status code matching err.
+// Returns the status code.
+func errorStatus(err error) int {
+	switch err.(type) {
+	case *ValidationError:
+		return http.StatusBadRequest
+	case *BuildError:
+		return http.StatusUnprocessableEntity
+	}
+	switch err {
+	case ErrUnknownProcess, ErrUnknownVersion, ErrUnknownBuild:
+		return http.StatusNotFound
+	case ErrProcessExists, ErrNotBuilt, ErrBuildInProgress, ErrNotRunning:
+		return http.StatusConflict
+	case ErrNotReady:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// queryBool will parse the query parameter name of r as a bool.
+// Returns a tuple with the value, or def when it is not set, and an error in case there's any.
+func queryBool(r *http.Request, name string, def bool) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+func (api *httpAPI) fail(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&errorResponse{Error: err.Error()})
+}
+
+func (api *httpAPI) notAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	api.fail(w, http.StatusMethodNotAllowed, fmt.Errorf("Method not allowed. Use %s.", allowed))
+}
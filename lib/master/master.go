@@ -26,6 +26,7 @@ import "sync"
 
 import "time"
 
+import "github.com/topfreegames/apm/lib/logs"
 import "github.com/topfreegames/apm/lib/preparable"
 import "github.com/topfreegames/apm/lib/process"
 import "github.com/topfreegames/apm/lib/utils"
@@ -33,6 +34,67 @@ import "github.com/topfreegames/apm/lib/watcher"
 
 import log "github.com/Sirupsen/logrus"
 
+// ErrUnknownProcess is returned when there is no process with the given name.
+var ErrUnknownProcess = errors.New("Unknown process.")
+
+// ErrProcessExists is returned when starting a process with a name that is already taken.
+var ErrProcessExists = errors.New("Trying to start a process that already exist.")
+
+// ErrNotBuilt is returned when building again a process that was not built from source.
+var ErrNotBuilt = errors.New("Process was not built from source.")
+
+// ErrBuildInProgress is returned when building a process that is already being built.
+var ErrBuildInProgress = errors.New("Process is already being built.")
+
+// ErrUnknownVersion is returned when rolling back to a version that is not kept.
+var ErrUnknownVersion = errors.New("Unknown version.")
+
+// ErrNotReady is returned when a process is still starting once the wait for it is over.
+var ErrNotReady = errors.New("Process is not ready yet.")
+
+// ErrNotRunning is returned when waiting for a process that is not running.
+var ErrNotRunning = errors.New("Process is not running.")
+
+// ErrNotStopped is returned when a process is still alive after it was killed.
+var ErrNotStopped = errors.New("Process did not exit after SIGKILL.")
+
+// ValidationError is returned when a request has an invalid field, such as a bad health check,
+// log sink, memory limit or stream.
+type ValidationError struct {
+	Err error // Err tells what is invalid.
+}
+
+func (err *ValidationError) Error() string {
+	return err.Err.Error()
+}
+
+// BuildError is returned when the build of a process fails.
+type BuildError struct {
+	Err    string // Err is the build error.
+	Output string // Output is what the build printed.
+}
+
+func (err *BuildError) Error() string {
+	return fmt.Sprintf("ERROR: %s OUTPUT: %s", err.Err, err.Output)
+}
+
+// killTimeout is how long a process has to exit after SIGKILL before APM stops waiting for it,
+// such as when it is stuck in uninterruptible sleep.
+const killTimeout = 5 * time.Second
+
+// stopPollInterval is how often a process that is not watched is checked while it is stopped.
+const stopPollInterval = 100 * time.Millisecond
+
+// logRotateInterval is how often RotateLogsLoop checks the log files.
+const logRotateInterval = 10 * time.Second
+
+// healthCheckTick is how often the health checks are looked at. Probes run at their own
+// interval, rounded up to it.
+const healthCheckTick = 1 * time.Second
+
+// readyPollInterval is how often WaitReady looks at the process status.
+const readyPollInterval = 100 * time.Millisecond
+
 // Master is the main module that keeps everything in place and execute
 // the necessary actions to keep the process running as they should be.
 type Master struct {
@@ -43,8 +105,17 @@ type Master struct {
 	OutFile   string           // OutFile is the APM output log file path.
 	ErrFile   string           // ErrFile is the APM err log file path.
 	Watcher   *watcher.Watcher // Watcher is a watcher instance.
+	Remote    RemoteConfig     // Remote holds the TLS and tokens of the TCP and HTTP listeners.
 
-	Procs map[string]process.ProcContainer // Procs is a map containing all procs started on APM.
+	BuildConcurrency int // BuildConcurrency is how many builds run at once. Zero means DefaultBuildConcurrency.
+
+	Procs       map[string]process.ProcContainer  // Procs is a map containing all procs started on APM.
+	Preparables map[string]*preparable.Preparable // Preparables are the preparables procs were built from, so they can be built again.
+
+	logRotator *logs.Rotator           // logRotator rotates the out and err files of the procs.
+	building   map[string]bool         // building holds the procs being built.
+	builds     *buildQueue             // builds runs the build jobs.
+	metrics    map[string]*ProcMetrics // metrics are the last samples of the running procs.
 }
 
 // DecodableMaster is a struct that the config toml file will decode to.
@@ -57,8 +128,12 @@ type DecodableMaster struct {
 	ErrFile string
 
 	Watcher *watcher.Watcher
+	Remote  RemoteConfig
 
-	Procs map[string]*process.Proc
+	BuildConcurrency int
+
+	Procs       map[string]*process.Proc
+	Preparables map[string]*preparable.Preparable
 }
 
 // InitMaster will start a master instance with configFile.
@@ -67,6 +142,7 @@ func InitMaster(configFile string) *Master {
 	watcher := watcher.InitWatcher()
 	decodableMaster := &DecodableMaster{}
 	decodableMaster.Procs = make(map[string]*process.Proc)
+	decodableMaster.Preparables = make(map[string]*preparable.Preparable)
 
 	err := utils.SafeReadTomlFile(configFile, decodableMaster)
 	if err != nil {
@@ -84,7 +160,10 @@ func InitMaster(configFile string) *Master {
 		OutFile: decodableMaster.OutFile,
 		ErrFile: decodableMaster.ErrFile,
 		Watcher: decodableMaster.Watcher,
+		Remote: decodableMaster.Remote,
+		BuildConcurrency: decodableMaster.BuildConcurrency,
 		Procs: procs,
+		Preparables: decodableMaster.Preparables,
 	}
 
 	if master.SysFolder == "" {
@@ -92,72 +171,156 @@ func InitMaster(configFile string) *Master {
 		master.SysFolder = path.Dir(configFile) + "/"
 	}
 	master.Watcher = watcher
+	master.logRotator = logs.NewRotator()
+	master.building = make(map[string]bool)
+	master.builds = newBuildQueue(master.BuildConcurrency)
+	master.metrics = make(map[string]*ProcMetrics)
 	master.Revive()
 	log.Infof("All procs revived...")
 	go master.WatchProcs()
 	go master.SaveProcsLoop()
+	go master.RotateLogsLoop()
 	go master.UpdateStatus()
+	go master.HealthCheckLoop()
+	go master.MetricsLoop()
 	return master
 }
 
-// WatchProcs will keep the procs running forever.
+// WatchProcs will keep the procs running forever. Dead procs are restarted following
+// their restart policy and, in case they keep crashing, they are marked as errored and
+// left alone until they are started again.
 func (master *Master) WatchProcs() {
-	for proc := range master.Watcher.RestartProc() {
+	for procStatus := range master.Watcher.ExitedProcs() {
+		proc := procStatus.Proc()
+		master.Lock()
+		if !master.Watcher.Claim(procStatus) {
+			// It was stopped meanwhile, and stop already took care of its exit.
+			master.Unlock()
+			continue
+		}
+		if procStatus.Err() == nil {
+			proc.GetStatus().SetExitState(procStatus.State(), procStatus.ExitedAt())
+		}
+		lastExit := proc.GetStatus().LastExit()
 		if !proc.ShouldKeepAlive() {
-			master.Lock()
 			master.updateStatus(proc)
 			master.Unlock()
+			proc.LogEvent(fmt.Sprintf("process exited (%s)", lastExit))
 			log.Infof("Proc %s does not have keep alive set. Will not be restarted.", proc.Identifier())
 			continue
 		}
-		log.Infof("Restarting proc %s.", proc.Identifier())
-		if proc.IsAlive() {
-			log.Warnf("Proc %s was supposed to be dead, but it is alive.", proc.Identifier())
+		if !master.scheduleRestart(proc, lastExit) {
+			proc.NotifyStopped()
+			proc.SetStatus("errored")
+			master.Unlock()
+			proc.LogEvent(fmt.Sprintf("process exited (%s), crash looping, not restarted", lastExit))
+			log.Warnf("Proc %s is crash looping. Will not be restarted until it is started again.", proc.Identifier())
+			continue
 		}
-		master.Lock()
-		proc.AddRestart()
-		err := master.restart(proc)
 		master.Unlock()
-		if err != nil {
-			log.Warnf("Could not restart process %s due to %s.", proc.Identifier(), err)
-		}
 	}
 }
 
+// NOT thread safe method. Lock should be acquire before calling it.
+// scheduleRestart will restart proc after the backoff of its restart policy, giving reason
+// on its restarted marker line.
+// Returns false in case the proc is crash looping and should not be restarted.
+func (master *Master) scheduleRestart(proc process.ProcContainer, reason string) bool {
+	delay, ok := proc.GetStatus().NextRestart(proc.GetRestartPolicy(), time.Now())
+	if !ok {
+		return false
+	}
+	proc.SetStatus("restarting")
+	log.Infof("Restarting proc %s in %s.", proc.Identifier(), delay)
+	time.AfterFunc(delay, func() {
+		master.restartProc(proc, reason)
+	})
+	return true
+}
+
+// restartProc will restart a proc that died or is unhealthy, unless it was stopped, started
+// or deleted while waiting for its backoff.
+func (master *Master) restartProc(proc process.ProcContainer, reason string) {
+	master.Lock()
+	defer master.Unlock()
+	if proc.GetStatus().Status != "restarting" {
+		log.Infof("Proc %s status changed to %s. Restart canceled.", proc.Identifier(), proc.GetStatus().Status)
+		return
+	}
+	log.Infof("Restarting proc %s.", proc.Identifier())
+	if proc.IsAlive() && proc.GetStatus().Health != "unhealthy" {
+		log.Warnf("Proc %s was supposed to be dead, but it is alive.", proc.Identifier())
+	}
+	proc.AddRestart()
+	proc.GetStatus().RestartReason = reason
+	err := master.restart(proc, 0)
+	if err != nil {
+		log.Warnf("Could not restart process %s due to %s.", proc.Identifier(), err)
+		return
+	}
+	proc.LogEvent(fmt.Sprintf("process restarted (%s)", reason))
+}
+
 // Prepare will compile the source code into a binary and return a preparable
 // ready to be executed.
 func (master *Master) Prepare(sourcePath string, name string, language string, keepAlive bool, args []string) (preparable.ProcPreparable, []byte, error) {
-	procPreparable := &preparable.Preparable{
+	return master.PrepareBin(&preparable.Preparable{
 		Name:       name,
 		SourcePath: sourcePath,
-		SysFolder:  master.SysFolder,
 		Language:   language,
 		KeepAlive:  keepAlive,
 		Args:       args,
-	}
+	})
+}
+
+// PrepareBin will compile the source code of procPreparable into a binary and return
+// a preparable ready to be executed.
+func (master *Master) PrepareBin(procPreparable *preparable.Preparable) (preparable.ProcPreparable, []byte, error) {
+	procPreparable.SysFolder = master.SysFolder
 	output, err := procPreparable.PrepareBin()
 	return procPreparable, output, err
 }
 
+// PrepareCommand will check that the command of procPreparable can be executed and return
+// a preparable ready to be executed, without compiling anything.
+func (master *Master) PrepareCommand(procPreparable *preparable.Preparable) (preparable.ProcPreparable, error) {
+	procPreparable.SysFolder = master.SysFolder
+	err := procPreparable.PrepareCommand()
+	return procPreparable, err
+}
+
 // RunPreparable will run procPreparable and add it to the watch list in case everything goes well.
 func (master *Master) RunPreparable(procPreparable preparable.ProcPreparable) error {
 	master.Lock()
 	defer master.Unlock()
 	if _, ok := master.Procs[procPreparable.Identifier()]; ok {
 		log.Warnf("Proc %s already exist.", procPreparable.Identifier())
-		return errors.New("Trying to start a process that already exist.")
+		return ErrProcessExists
 	}
 	proc, err := procPreparable.Start()
 	if err != nil {
 		return err
 	}
 	master.Procs[proc.Identifier()] = proc
+	if built, ok := procPreparable.(*preparable.Preparable); ok && built.SourcePath != "" {
+		master.Preparables[proc.Identifier()] = built
+	}
 	master.saveProcsWrapper()
 	master.Watcher.AddProcWatcher(proc)
-	proc.SetStatus("running")
+	master.setRunning(proc)
+	proc.LogEvent(fmt.Sprintf("process started (pid %d)", proc.GetPid()))
 	return nil
 }
 
+// GetProc will return the proc with the given name.
+// Returns a tuple with the proc and false in case there is no proc with that name.
+func (master *Master) GetProc(name string) (process.ProcContainer, bool) {
+	master.Lock()
+	defer master.Unlock()
+	proc, ok := master.Procs[name]
+	return proc, ok
+}
+
 // ListProcs will return a list of all procs.
 func (master *Master) ListProcs() []process.ProcContainer {
 	procsList := []process.ProcContainer{}
@@ -169,31 +332,315 @@ func (master *Master) ListProcs() []process.ProcContainer {
 
 // RestartProcess will restart a process.
 func (master *Master) RestartProcess(name string) error {
-	err := master.StopProcess(name)
+	return master.RestartProcessWithTimeout(name, 0)
+}
+
+// RestartProcessWithTimeout will restart a process. See StopProcessWithTimeout for the
+// meaning of timeout.
+func (master *Master) RestartProcessWithTimeout(name string, timeout time.Duration) error {
+	err := master.StopProcessWithTimeout(name, timeout)
 	if err != nil {
 		return err
 	}
 	return master.StartProcess(name)
 }
 
-// StartProcess will a start a process.
+// BuildProcess will queue the build of procPreparable, which is run once it is built. See
+// WaitBuild to know how it went.
+// Returns a tuple with the queued job and an error in case there's any.
+func (master *Master) BuildProcess(procPreparable *preparable.Preparable) (BuildJob, error) {
+	master.Lock()
+	defer master.Unlock()
+	name := procPreparable.Identifier()
+	if _, ok := master.Procs[name]; ok {
+		return BuildJob{}, ErrProcessExists
+	}
+	if master.building[name] {
+		return BuildJob{}, ErrBuildInProgress
+	}
+	master.building[name] = true
+	procPreparable.SysFolder = master.SysFolder
+	return master.builds.submit(name, "bin", func() ([]byte, int, error) {
+		defer master.doneBuilding(name)
+		log.Infof("Building proc %s", name)
+		output, err := procPreparable.PrepareBin()
+		if err != nil {
+			log.Warnf("Could not build proc %s due to %s.", name, err)
+			return output, 0, err
+		}
+		return output, procPreparable.Version, master.RunPreparable(procPreparable)
+	}), nil
+}
+
+// SubmitRebuild will queue a new build of a process, the same way it was first built. The
+// binary is only replaced in case the build succeeds, and the process is then restarted unless
+// it was stopped. See StopProcessWithTimeout for the meaning of timeout and WaitBuild to know how it went.
+// Returns a tuple with the queued job and an error in case there's any.
+func (master *Master) SubmitRebuild(name string, timeout time.Duration) (BuildJob, error) {
+	master.Lock()
+	defer master.Unlock()
+	proc, ok := master.Procs[name]
+	if !ok {
+		return BuildJob{}, ErrUnknownProcess
+	}
+	built, ok := master.Preparables[name]
+	if !ok {
+		return BuildJob{}, ErrNotBuilt
+	}
+	if master.building[name] {
+		return BuildJob{}, ErrBuildInProgress
+	}
+	master.building[name] = true
+	id := built.NextVersion()
+	return master.builds.submit(name, "rebuild", func() ([]byte, int, error) {
+		defer master.doneBuilding(name)
+		// Builds can take a while, so they run without holding the lock.
+		log.Infof("Rebuilding proc %s", name)
+		version, output, err := built.BuildVersion(id)
+		if err != nil {
+			log.Warnf("Could not rebuild proc %s due to %s.", name, err)
+			return output, 0, err
+		}
+		return output, version.ID, master.installBuilt(proc, built, version, timeout)
+	}), nil
+}
+
+// RebuildProcess will build a new version of a process and wait for it. See SubmitRebuild.
+// Returns a tuple with the build output and an error in case there's any, a BuildError in
+// case the build failed.
+func (master *Master) RebuildProcess(name string, timeout time.Duration) ([]byte, error) {
+	job, err := master.SubmitRebuild(name, timeout)
+	if err != nil {
+		return nil, err
+	}
+	job, err = master.WaitBuild(job.ID, -1)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status == BuildFailed {
+		return []byte(job.Output), &BuildError{Err: job.Error, Output: job.Output}
+	}
+	return []byte(job.Output), nil
+}
+
+// GetBuild will return the build job with the given ID.
+// Returns a tuple with the job and false in case there is no job with that ID.
+func (master *Master) GetBuild(id int) (BuildJob, bool) {
+	return master.builds.get(id)
+}
+
+// ListBuilds will return the build jobs, oldest first. Only the last jobs are remembered,
+// and none of them survive an APM restart.
+func (master *Master) ListBuilds() []BuildJob {
+	return master.builds.list()
+}
+
+// WaitBuild will wait for the build job with the given ID to finish, for at most timeout. A
+// zero timeout returns right away and a negative one waits until the job finishes.
+// Returns a tuple with the job and an error in case there's any.
+func (master *Master) WaitBuild(id int, timeout time.Duration) (BuildJob, error) {
+	return master.builds.wait(id, timeout)
+}
+
+// installBuilt runs proc on version, built from built, and restarts it unless it was stopped.
+func (master *Master) installBuilt(proc process.ProcContainer, built *preparable.Preparable, version preparable.Version, timeout time.Duration) error {
+	master.Lock()
+	defer master.Unlock()
+	if master.Procs[proc.Identifier()] != proc {
+		return ErrUnknownProcess
+	}
+	if err := built.Install(version); err != nil {
+		return err
+	}
+	master.saveProcsWrapper()
+	proc.LogEvent(fmt.Sprintf("process rebuilt (version %d)", version.ID))
+	return master.restartInstalled(proc, timeout)
+}
+
+func (master *Master) doneBuilding(name string) {
+	master.Lock()
+	defer master.Unlock()
+	delete(master.building, name)
+}
+
+// RollbackProcess will run a process on one of its previous versions, without building
+// anything. A zero id means the version built before the current one. The process is restarted
+// unless it was stopped. See StopProcessWithTimeout for the meaning of timeout.
+// Returns an error in case there's any.
+func (master *Master) RollbackProcess(name string, id int, timeout time.Duration) error {
+	master.Lock()
+	defer master.Unlock()
+	proc, ok := master.Procs[name]
+	if !ok {
+		return ErrUnknownProcess
+	}
+	built, ok := master.Preparables[name]
+	if !ok {
+		return ErrNotBuilt
+	}
+	var version preparable.Version
+	if id == 0 {
+		version, ok = built.PreviousVersion()
+	} else {
+		version, ok = built.GetVersion(id)
+	}
+	if !ok {
+		return ErrUnknownVersion
+	}
+	if err := built.Install(version); err != nil {
+		return err
+	}
+	master.saveProcsWrapper()
+	log.Infof("Proc %s rolled back to version %d.", name, version.ID)
+	proc.LogEvent(fmt.Sprintf("process rolled back (version %d)", version.ID))
+	return master.restartInstalled(proc, timeout)
+}
+
+// ListVersions will list the built versions of a process.
+// Returns a tuple with the versions, the ID of the one the process runs and an error in case there's any.
+func (master *Master) ListVersions(name string) ([]preparable.Version, int, error) {
+	master.Lock()
+	defer master.Unlock()
+	if _, ok := master.Procs[name]; !ok {
+		return nil, 0, ErrUnknownProcess
+	}
+	built, ok := master.Preparables[name]
+	if !ok {
+		return nil, 0, ErrNotBuilt
+	}
+	return append([]preparable.Version{}, built.Versions...), built.Version, nil
+}
+
+// NOT thread safe method. Lock should be acquire before calling it.
+// Restarts proc on the binary that was just installed, unless it was stopped.
+func (master *Master) restartInstalled(proc process.ProcContainer, timeout time.Duration) error {
+	if proc.GetStatus().Status == "stopped" {
+		return nil
+	}
+	proc.GetStatus().ResetBackoff()
+	if err := master.restart(proc, timeout); err != nil {
+		return err
+	}
+	proc.LogEvent(fmt.Sprintf("process started (pid %d)", proc.GetPid()))
+	return nil
+}
+
+// StartProcess will a start a process. Starting a process by hand also resets its
+// restart backoff, so errored processes can be restarted.
 func (master *Master) StartProcess(name string) error {
 	master.Lock()
 	defer master.Unlock()
 	if proc, ok := master.Procs[name]; ok {
-		return master.start(proc)
+		proc.GetStatus().ResetBackoff()
+		if proc.IsAlive() {
+			return nil
+		}
+		err := master.start(proc)
+		if err != nil {
+			return err
+		}
+		proc.LogEvent(fmt.Sprintf("process started (pid %d)", proc.GetPid()))
+		return nil
 	}
-	return errors.New("Unknown process.")
+	return ErrUnknownProcess
 }
 
-// StopProcess will stop a process with the given name.
+// StopProcess will stop a process with the given name. The process is killed in case it
+// does not exit within its own StopTimeout.
 func (master *Master) StopProcess(name string) error {
+	return master.StopProcessWithTimeout(name, 0)
+}
+
+// StopProcessWithTimeout will stop a process with the given name. The process is killed in
+// case it does not exit within timeout. A zero timeout means the process own StopTimeout.
+func (master *Master) StopProcessWithTimeout(name string, timeout time.Duration) error {
 	master.Lock()
 	defer master.Unlock()
 	if proc, ok := master.Procs[name]; ok {
-		return master.stop(proc)
+		return master.stop(proc, timeout)
 	}
-	return errors.New("Unknown process.")
+	return ErrUnknownProcess
+}
+
+// SetEnv will set environment variables on the process with the given name. They are
+// saved right away and take effect the next time the process starts.
+func (master *Master) SetEnv(name string, vars map[string]string) error {
+	master.Lock()
+	defer master.Unlock()
+	if proc, ok := master.Procs[name]; ok {
+		proc.SetEnv(vars)
+		return master.saveProcsWrapper()
+	}
+	return ErrUnknownProcess
+}
+
+// UnsetEnv will remove environment variables from the process with the given name. They are
+// saved right away and take effect the next time the process starts.
+func (master *Master) UnsetEnv(name string, keys []string) error {
+	master.Lock()
+	defer master.Unlock()
+	if proc, ok := master.Procs[name]; ok {
+		proc.UnsetEnv(keys)
+		return master.saveProcsWrapper()
+	}
+	return ErrUnknownProcess
+}
+
+// RotateLogs will rotate the out and err files of the process with the given name right
+// away, keeping the number of rotated files set on its LogRotate. The process keeps running.
+func (master *Master) RotateLogs(name string) error {
+	proc, ok := master.GetProc(name)
+	if !ok {
+		return ErrUnknownProcess
+	}
+	now := time.Now()
+	for _, file := range proc.GetLogFiles() {
+		if err := master.logRotator.Rotate(file, proc.GetLogRotate(), now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadLogs will read the out or err file of the process with the given name, depending on
+// stream. A negative offset reads the last lines lines, otherwise the lines written after offset.
+// Only the lines matching filters are returned, see logs.MatchLine.
+// Returns a tuple with the lines, the offset to read the next lines from and an error in case there's any.
+func (master *Master) ReadLogs(name string, stream string, offset int64, lines int, filters map[string]string) ([]string, int64, error) {
+	proc, ok := master.GetProc(name)
+	if !ok {
+		return nil, 0, ErrUnknownProcess
+	}
+	files := proc.GetLogFiles()
+	var file string
+	switch stream {
+	case "out":
+		file = files[0]
+	case "err":
+		file = files[1]
+	default:
+		return nil, 0, &ValidationError{fmt.Errorf("Unknown stream %s. Use out or err.", stream)}
+	}
+	if offset < 0 {
+		return logs.Tail(file, lines, filters)
+	}
+	return logs.ReadFrom(file, offset, filters)
+}
+
+// FlushLogs will empty the out and err files of the process with the given name and
+// delete their rotated files. The process keeps running.
+func (master *Master) FlushLogs(name string) error {
+	proc, ok := master.GetProc(name)
+	if !ok {
+		return ErrUnknownProcess
+	}
+	now := time.Now()
+	for _, file := range proc.GetLogFiles() {
+		if err := master.logRotator.Flush(file, now); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // DeleteProcess will delete a process and all its files and childs forever.
@@ -202,11 +649,12 @@ func (master *Master) DeleteProcess(name string) error {
 	defer master.Unlock()
 	log.Infof("Trying to delete proc %s", name)
 	if proc, ok := master.Procs[name]; ok {
-		err := master.stop(proc)
+		err := master.stop(proc, 0)
 		if err != nil {
 			return err
 		}
 		delete(master.Procs, name)
+		delete(master.Preparables, name)
 		err = master.delete(proc)
 		if err != nil {
 			return err
@@ -216,8 +664,11 @@ func (master *Master) DeleteProcess(name string) error {
 	return nil
 }
 
-// Revive will revive all procs listed on ListProcs. This should ONLY be called
-// during Master startup.
+// Revive will revive all procs listed on ListProcs. Procs that are still running, such as
+// the ones left behind by a previous APM instance, are adopted and watched instead of
+// started again. Procs whose pid now belongs to another program are marked as dead.
+// Procs that are already watched are left alone, so that Resurrect on a running Master
+// does not restart them.
 func (master *Master) Revive() error {
 	master.Lock()
 	defer master.Unlock()
@@ -225,6 +676,39 @@ func (master *Master) Revive() error {
 	log.Info("Reviving all processes")
 	for id := range procs {
 		proc := procs[id]
+		if proc.IsAlive() {
+			if master.Watcher.IsWatching(proc.Identifier()) {
+				continue
+			}
+			log.Infof("Proc %s is still running with pid %d. Adopting it.", proc.Identifier(), proc.GetPid())
+			if err := proc.RecordIdentity(); err != nil {
+				log.Warnf("Could not record the identity of proc %s due to %s.", proc.Identifier(), err)
+			}
+			master.Watcher.AddProcWatcher(proc)
+			if proc.CapturesOutput() {
+				// The pipes it writes to were closed along with the previous APM instance.
+				log.Infof("Proc %s output was captured by the previous APM instance. Restarting it.", proc.Identifier())
+				if err := master.restart(proc, 0); err != nil {
+					return fmt.Errorf("Failed to restart proc %s due to %s", proc.Identifier(), err)
+				}
+				proc.LogEvent(fmt.Sprintf("process restarted by APM (pid %d)", proc.GetPid()))
+				continue
+			}
+			if proc.GetReadinessCheck().Type == process.ReadinessNotify {
+				// It only notifies once, so it stays ready in case it already was.
+				if proc.GetStatus().Status != "ready" {
+					proc.SetStatus("running")
+				}
+				continue
+			}
+			master.setRunning(proc)
+			continue
+		}
+		if proc.GetPid() > 0 {
+			log.Warnf("Proc %s is not running with pid %d anymore. Marking it as dead.", proc.Identifier(), proc.GetPid())
+			proc.NotifyStopped()
+			proc.SetStatus("dead")
+		}
 		if !proc.ShouldKeepAlive() {
 			log.Infof("Proc %s does not have KeepAlive set. Will not revive it.", proc.Identifier())
 			continue
@@ -234,6 +718,7 @@ func (master *Master) Revive() error {
 		if err != nil {
 			return fmt.Errorf("Failed to revive proc %s due to %s", proc.Identifier(), err)
 		}
+		proc.LogEvent(fmt.Sprintf("process started (pid %d)", proc.GetPid()))
 	}
 	return nil
 }
@@ -246,33 +731,166 @@ func (master *Master) start(proc process.ProcContainer) error {
 			return err
 		}
 		master.Watcher.AddProcWatcher(proc)
-		proc.SetStatus("running")
+		master.setRunning(proc)
 	}
 	return nil
 }
 
+// NOT thread safe method. Lock should be acquire before calling it.
+// setRunning sets the status of a proc that just started: running or, in case it has a
+// readiness check, starting until it is found ready.
+func (master *Master) setRunning(proc process.ProcContainer) {
+	if !proc.GetReadinessCheck().Enabled() {
+		proc.SetStatus("running")
+		return
+	}
+	proc.SetStatus("starting")
+	go master.waitReady(proc, proc.GetStatus().StartedAt)
+}
+
+// waitReady will check the proc started at startedAt every interval of its readiness check,
+// until it is ready or it is stopped, restarted or deleted.
+func (master *Master) waitReady(proc process.ProcContainer, startedAt time.Time) {
+	check := proc.GetReadinessCheck()
+	for {
+		time.Sleep(check.GetInterval())
+		err := proc.CheckReady()
+		master.Lock()
+		status := proc.GetStatus()
+		if master.Procs[proc.Identifier()] != proc || status.Status != "starting" || !status.StartedAt.Equal(startedAt) {
+			master.Unlock()
+			return
+		}
+		if err == nil {
+			now := time.Now()
+			status.SetReady(now)
+			master.Unlock()
+			log.Infof("Proc %s is ready after %s.", proc.Identifier(), now.Sub(startedAt).Truncate(time.Millisecond))
+			proc.LogEvent("process ready")
+			return
+		}
+		master.Unlock()
+	}
+}
+
+// WaitReady will wait for the process with the given name to be ready, or running in case it
+// has no readiness check, for at most timeout.
+// Returns ErrNotReady in case it is still starting after timeout, or ErrNotRunning in case it
+// stopped or died meanwhile.
+func (master *Master) WaitReady(name string, timeout time.Duration) error {
+	expired := time.Now().Add(timeout)
+	for {
+		master.Lock()
+		proc, ok := master.Procs[name]
+		var status string
+		if ok {
+			status = proc.GetStatus().Status
+		}
+		master.Unlock()
+		if !ok {
+			return ErrUnknownProcess
+		}
+		switch status {
+		case "running", "ready":
+			return nil
+		case "starting":
+		default:
+			return ErrNotRunning
+		}
+		if time.Now().After(expired) {
+			return ErrNotReady
+		}
+		time.Sleep(readyPollInterval)
+	}
+}
+
 func (master *Master) delete(proc process.ProcContainer) error {
 	return proc.Delete()
 }
 
 // NOT thread safe method. Lock should be acquire before calling it.
-func (master *Master) stop(proc process.ProcContainer) error {
-	if proc.IsAlive() {
-		waitStop := master.Watcher.StopWatcher(proc.Identifier())
-		err := proc.GracefullyStop()
+// The process is asked to stop and, if it is still alive after timeout (or its own
+// StopTimeout when timeout is 0), it is killed with SIGKILL. The lock is kept while waiting
+// for the process to exit, which its watcher tells without taking it.
+// Returns ErrNotStopped in case the process is still alive killTimeout after SIGKILL.
+func (master *Master) stop(proc process.ProcContainer, timeout time.Duration) error {
+	if !proc.IsAlive() && !proc.GroupAlive() {
+		// Also cancels a pending restart and clears the errored status.
+		proc.SetStatus("stopped")
+		return nil
+	}
+	exitStatus := master.Watcher.StopWatcherWithStatus(proc.Identifier())
+	err := proc.GracefullyStop()
+	if err != nil {
+		return err
+	}
+	if timeout <= 0 {
+		timeout = proc.GetStopTimeout()
+	}
+	exited := exitedChan(proc, exitStatus)
+	status := "stopped"
+	procStatus, stopped := waitExit(exited, timeout)
+	if !stopped {
+		log.Warnf("Proc %s did not stop within %s. Sending SIGKILL.", proc.Identifier(), timeout)
+		err = proc.ForceStop()
 		if err != nil {
-			return err
-		}
-		if waitStop != nil {
-			<-waitStop
-			proc.NotifyStopped()
-			proc.SetStatus("stopped")
+			log.Warnf("Could not kill proc %s due to %s.", proc.Identifier(), err)
 		}
-		log.Infof("Proc %s successfully stopped.", proc.Identifier())
+		procStatus, stopped = waitExit(exited, killTimeout)
+		status = "killed"
+	}
+	if !stopped {
+		log.Warnf("Proc %s did not exit within %s after SIGKILL.", proc.Identifier(), killTimeout)
+		return ErrNotStopped
+	}
+	if procStatus != nil && procStatus.Err() == nil {
+		proc.GetStatus().SetExitState(procStatus.State(), procStatus.ExitedAt())
 	}
+	proc.NotifyStopped()
+	proc.SetStatus(status)
+	if status == "killed" {
+		proc.LogEvent(fmt.Sprintf("process killed after not stopping within %s", timeout))
+	} else {
+		proc.LogEvent("process stopped")
+	}
+	log.Infof("Proc %s successfully stopped.", proc.Identifier())
 	return nil
 }
 
+// exitedChan returns a channel receiving the status of proc once it and every process of its
+// group exit. The status is told by exitStatus or, for procs that are not watched, is nil once
+// checking it every stopPollInterval shows it is gone.
+func exitedChan(proc process.ProcContainer, exitStatus chan *watcher.ProcStatus) <-chan *watcher.ProcStatus {
+	exited := make(chan *watcher.ProcStatus, 1)
+	go func() {
+		var procStatus *watcher.ProcStatus
+		if exitStatus != nil {
+			procStatus = <-exitStatus
+		} else {
+			for proc.IsAlive() {
+				time.Sleep(stopPollInterval)
+			}
+		}
+		// Forked workers may outlive the proc, they get the same signals until they exit too.
+		for proc.GroupAlive() {
+			time.Sleep(stopPollInterval)
+		}
+		exited <- procStatus
+	}()
+	return exited
+}
+
+// waitExit waits for exited to receive the status of the proc, for at most timeout.
+// Returns a tuple with the status and true in case it was received.
+func waitExit(exited <-chan *watcher.ProcStatus, timeout time.Duration) (*watcher.ProcStatus, bool) {
+	select {
+	case procStatus := <-exited:
+		return procStatus, true
+	case <-time.After(timeout):
+		return nil, false
+	}
+}
+
 // UpdateStatus will update a process status every 30s.
 func (master *Master) UpdateStatus() {
 	for {
@@ -289,16 +907,116 @@ func (master *Master) UpdateStatus() {
 
 func (master *Master) updateStatus(proc process.ProcContainer) {
 	if proc.IsAlive() {
+		switch proc.GetStatus().Status {
+		case "restarting", "starting", "ready":
+			// An unhealthy proc keeps running until its restart, and readiness is
+			// tracked by waitReady.
+			return
+		}
 		proc.SetStatus("running")
 	} else {
 		proc.NotifyStopped()
-		proc.SetStatus("stopped")
+		switch proc.GetStatus().Status {
+		case "errored", "restarting", "killed", "dead":
+			// Keep the status that tells why the proc is not running.
+		default:
+			proc.SetStatus("stopped")
+		}
 	}
 }
 
+// healthResult is the result of a probe of proc, started at checkedAt while it was running
+// since startedAt.
+type healthResult struct {
+	proc      process.ProcContainer
+	startedAt time.Time
+	checkedAt time.Time
+	err       error
+}
+
+// HealthCheckLoop will loop forever probing the procs that have a health check, once they are
+// due. Procs failing too many probes in a row are unhealthy and are restarted following their
+// restart policy, as if they died.
+func (master *Master) HealthCheckLoop() {
+	probing := make(map[process.ProcContainer]bool)
+	results := make(chan *healthResult)
+	ticker := time.NewTicker(healthCheckTick)
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			master.Lock()
+			for _, proc := range master.ListProcs() {
+				if probing[proc] || !proc.GetStatus().HealthCheckDue(proc.GetHealthCheck(), now) {
+					continue
+				}
+				probing[proc] = true
+				result := &healthResult{proc: proc, startedAt: proc.GetStatus().StartedAt, checkedAt: now}
+				go func() {
+					result.err = result.proc.CheckHealth()
+					results <- result
+				}()
+			}
+			master.Unlock()
+		case result := <-results:
+			delete(probing, result.proc)
+			master.Lock()
+			master.recordHealth(result)
+			master.Unlock()
+		}
+	}
+}
+
+// NOT thread safe method. Lock should be acquire before calling it.
+// Results of procs that were restarted, stopped or deleted while being probed are dropped.
+func (master *Master) recordHealth(result *healthResult) {
+	proc := result.proc
+	status := proc.GetStatus()
+	if master.Procs[proc.Identifier()] != proc || !status.IsUp() || !status.StartedAt.Equal(result.startedAt) {
+		return
+	}
+	previous := status.Health
+	if !status.RecordHealthCheck(proc.GetHealthCheck(), result.err, result.checkedAt) {
+		if previous == "" && status.Health == "healthy" {
+			log.Infof("Proc %s is healthy.", proc.Identifier())
+		} else if result.err != nil {
+			log.Warnf("Proc %s failed its health check %d time(s) due to %s.", proc.Identifier(), status.HealthFailures, result.err)
+		}
+		return
+	}
+	reason := fmt.Sprintf("unhealthy: %s", result.err)
+	log.Warnf("Proc %s is unhealthy due to %s.", proc.Identifier(), result.err)
+	proc.LogEvent(fmt.Sprintf("process unhealthy (%s)", result.err))
+	if !master.scheduleRestart(proc, reason) {
+		log.Warnf("Proc %s is crash looping. Stopping it until it is started again.", proc.Identifier())
+		go master.stopUnhealthy(proc, result.startedAt)
+	}
+}
+
+// stopUnhealthy will stop a crash looping proc that failed its health check and mark it as
+// errored, unless it was restarted, stopped or deleted meanwhile. It runs apart from the
+// health check loop, so the results of other procs are not held back while it stops.
+func (master *Master) stopUnhealthy(proc process.ProcContainer, startedAt time.Time) {
+	master.Lock()
+	defer master.Unlock()
+	status := proc.GetStatus()
+	if master.Procs[proc.Identifier()] != proc || !status.IsUp() || !status.StartedAt.Equal(startedAt) {
+		log.Infof("Proc %s status changed to %s. Stop canceled.", proc.Identifier(), status.Status)
+		return
+	}
+	err := master.stop(proc, 0)
+	if err != nil {
+		log.Warnf("Could not stop process %s due to %s.", proc.Identifier(), err)
+		proc.LogEvent(fmt.Sprintf("process unhealthy, crash looping, could not be stopped (%s)", err))
+		return
+	}
+	proc.SetStatus("errored")
+	proc.LogEvent("process unhealthy, crash looping, stopped")
+}
+
 // NOT thread safe method. Lock should be acquire before calling it.
-func (master *Master) restart(proc process.ProcContainer) error {
-	err := master.stop(proc)
+func (master *Master) restart(proc process.ProcContainer, timeout time.Duration) error {
+	err := master.stop(proc, timeout)
 	if err != nil {
 		return err
 	}
@@ -316,14 +1034,39 @@ func (master *Master) SaveProcsLoop() {
 	}
 }
 
+// RotateLogsLoop will loop forever to rotate the out and err files of the procs that grew
+// past their LogRotate limits.
+func (master *Master) RotateLogsLoop() {
+	for {
+		time.Sleep(logRotateInterval)
+		master.Lock()
+		procs := master.ListProcs()
+		master.Unlock()
+		now := time.Now()
+		for _, proc := range procs {
+			for _, file := range proc.GetLogFiles() {
+				rotated, err := master.logRotator.RotateIfNeeded(file, proc.GetLogRotate(), now)
+				if err != nil {
+					log.Warnf("Could not rotate log file %s due to %s.", file, err)
+				} else if rotated {
+					log.Infof("Rotated log file %s.", file)
+				}
+			}
+		}
+	}
+}
+
 // Stop will stop APM and all of its running procs.
 func (master *Master) Stop() error {
+	master.Lock()
+	defer master.Unlock()
 	log.Info("Stopping APM...")
 	procs := master.ListProcs()
 	for id := range procs {
 		proc := procs[id]
-		log.Info("Stopping proc %s", proc.Identifier())
-		master.stop(proc)
+		log.Infof("Stopping proc %s", proc.Identifier())
+		master.stop(proc, 0)
+		proc.CloseLogSinks()
 	}
 	log.Info("Saving and returning list of procs.")
 	return master.saveProcsWrapper()
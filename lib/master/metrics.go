@@ -0,0 +1,177 @@
+package master
+
+import "encoding/json"
+import "fmt"
+import "time"
+
+import "github.com/topfreegames/apm/lib/process"
+import "github.com/topfreegames/apm/lib/procfs"
+import "github.com/topfreegames/apm/lib/utils"
+import log "github.com/Sirupsen/logrus"
+
+// metricsInterval is how often the running procs are sampled.
+const metricsInterval = 5 * time.Second
+
+// ProcMetrics is the resource usage of a proc, sampled from /proc.
+type ProcMetrics struct {
+	procfs.Usage
+	CPUPercent float64   `json:"cpu_percent"` // CPUPercent is the CPU used since the previous sample, where 100 is one whole core.
+	Processes  int       `json:"processes"`   // Processes is how many processes were sampled: the proc and, with MetricsChildren, its descendants.
+	SampledAt  time.Time `json:"sampled_at"`
+	pid        int
+	limitRSS   uint64 // limitRSS is the resident memory checked against the memory limit of the proc.
+}
+
+// MarshalJSON will encode the metrics with the CPU time as a string such as 1m30s.
+// Returns a tuple with the JSON object and an error in case there's any.
+func (metrics ProcMetrics) MarshalJSON() ([]byte, error) {
+	type plain ProcMetrics
+	return json.Marshal(&struct {
+		plain
+		CPUTime utils.Duration `json:"cpu_time"`
+	}{plain(metrics), utils.Duration(metrics.CPUTime)})
+}
+
+// metricsTarget is a running proc to sample.
+type metricsTarget struct {
+	pid       int
+	children  bool
+	startedAt time.Time
+	limit     process.MemoryLimit
+}
+
+// MetricsLoop will loop forever sampling the CPU, memory, file descriptors, threads and IO of the
+// running procs, see GetMetrics. Procs that stay above their memory limit are restarted. It
+// returns right away in case /proc can't be read.
+func (master *Master) MetricsLoop() {
+	if !procfs.Available() {
+		log.Warnf("The proc filesystem is not available. Process metrics are disabled.")
+		return
+	}
+	for {
+		master.Lock()
+		targets := make(map[string]metricsTarget)
+		for _, proc := range master.ListProcs() {
+			if proc.IsAlive() {
+				targets[proc.Identifier()] = metricsTarget{
+					pid:       proc.GetPid(),
+					children:  proc.GetMetricsChildren(),
+					startedAt: proc.GetStatus().StartedAt,
+					limit:     proc.GetMemoryLimit(),
+				}
+			}
+		}
+		master.Unlock()
+
+		// Reading /proc can take a while with many processes, so it is done without holding the lock.
+		samples := make(map[string]*ProcMetrics)
+		for name, target := range targets {
+			if sample, err := sampleMetrics(target); err == nil {
+				samples[name] = sample
+			}
+		}
+
+		master.Lock()
+		for name, sample := range samples {
+			previous, ok := master.metrics[name]
+			elapsed := sample.SampledAt.Sub(targets[name].startedAt)
+			cpuTime := sample.CPUTime
+			if ok && previous.pid == sample.pid {
+				elapsed = sample.SampledAt.Sub(previous.SampledAt)
+				cpuTime -= previous.CPUTime
+			}
+			// Descendants that exited take their CPU time with them.
+			if elapsed > 0 && cpuTime > 0 {
+				sample.CPUPercent = float64(cpuTime) / float64(elapsed) * 100
+			}
+			master.checkMemory(name, targets[name].limit, sample)
+		}
+		// Procs that stopped or were deleted are forgotten.
+		master.metrics = samples
+		master.Unlock()
+		time.Sleep(metricsInterval)
+	}
+}
+
+// GetMetrics will return the last metrics sampled for the proc with the given name.
+// Returns nil in case the proc is not running or was not sampled yet.
+func (master *Master) GetMetrics(name string) *ProcMetrics {
+	master.Lock()
+	defer master.Unlock()
+	metrics, ok := master.metrics[name]
+	if !ok {
+		return nil
+	}
+	copied := *metrics
+	return &copied
+}
+
+// NOT thread safe method. Lock should be acquire before calling it.
+// checkMemory records sample against limit, and restarts the proc called name once it was above
+// the limit for limit.Samples samples in a row. Samples of a previous run of the proc are ignored.
+func (master *Master) checkMemory(name string, limit process.MemoryLimit, sample *ProcMetrics) {
+	proc, ok := master.Procs[name]
+	if !ok || !limit.Enabled() || proc.GetPid() != sample.pid || !proc.GetStatus().IsUp() {
+		return
+	}
+	if !proc.GetStatus().RecordMemory(limit, sample.limitRSS) {
+		return
+	}
+	usage := fmt.Sprintf("%s above %s", utils.FormatSize(sample.limitRSS), utils.FormatSize(limit.MaxMemory))
+	log.Warnf("Proc %s exceeded its memory limit with %s. Restarting it.", name, usage)
+	proc.LogEvent(fmt.Sprintf("%s (%s)", process.MemoryLimitReason, usage))
+	proc.SetStatus("restarting")
+	go master.restartForMemory(proc)
+}
+
+// restartForMemory will gracefully restart a proc that exceeded its memory limit, unless it was
+// stopped, started or deleted meanwhile. It is counted apart from the crash restarts, so it does
+// not make the proc crash loop.
+func (master *Master) restartForMemory(proc process.ProcContainer) {
+	master.Lock()
+	defer master.Unlock()
+	if proc.GetStatus().Status != "restarting" {
+		log.Infof("Proc %s status changed to %s. Restart canceled.", proc.Identifier(), proc.GetStatus().Status)
+		return
+	}
+	proc.GetStatus().AddMemoryRestart()
+	err := master.restart(proc, 0)
+	if err != nil {
+		log.Warnf("Could not restart process %s due to %s.", proc.Identifier(), err)
+		return
+	}
+	proc.LogEvent(fmt.Sprintf("process restarted (%s)", process.MemoryLimitReason))
+}
+
+// sampleMetrics reads the usage of target and, in case it asks for them, of its descendants.
+func sampleMetrics(target metricsTarget) (*ProcMetrics, error) {
+	usage, err := procfs.ReadUsage(target.pid)
+	if err != nil {
+		return nil, err
+	}
+	metrics := &ProcMetrics{
+		Usage:     usage,
+		Processes: 1,
+		pid:       target.pid,
+		limitRSS:  usage.RSS,
+	}
+	if target.children || target.limit.Children {
+		descendants, _ := procfs.Descendants(target.pid)
+		for _, child := range descendants {
+			// Children may exit while they are read.
+			childUsage, err := procfs.ReadUsage(child)
+			if err != nil {
+				continue
+			}
+			if target.limit.Children {
+				metrics.limitRSS += childUsage.RSS
+			}
+			if target.children {
+				metrics.Add(childUsage)
+				metrics.Processes++
+			}
+		}
+	}
+	metrics.SampledAt = time.Now()
+	return metrics, nil
+}
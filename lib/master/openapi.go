@@ -0,0 +1,553 @@
+package master
+
+// openAPIDocument describes the REST API served by StartHTTPServer. Durations are Go duration
+// strings, see utils.Duration.
+const openAPIDocument = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "APM - Aguia Process Manager",
+    "description": "Manage the processes of an APM server. Durations are Go duration strings such as 30s or 1m30s. Request bodies also accept them as integers in nanoseconds. When the server has tokens, requests without a valid bearer token get 401 and read only tokens get 403 on anything but GET requests and on the logs.",
+    "version": "1.0.0"
+  },
+  "security": [{"bearerAuth": []}, {}],
+  "paths": {
+    "/procs": {
+      "get": {
+        "summary": "List all processes and their status.",
+        "operationId": "listProcs",
+        "responses": {
+          "200": {
+            "description": "All processes.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ProcList"}}}
+          }
+        }
+      },
+      "post": {
+        "summary": "Build and start a Go project, or start a prebuilt command.",
+        "description": "Set source_path to build a Go project, or cmd to run an already built binary or script.",
+        "operationId": "createProc",
+        "parameters": [{"$ref": "#/components/parameters/Wait"}],
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/NewProc"}}}
+        },
+        "responses": {
+          "201": {"$ref": "#/components/responses/Proc"},
+          "202": {"$ref": "#/components/responses/BuildJob"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "422": {"description": "The build failed.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/procs/{name}": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "get": {
+        "summary": "Get a process status.",
+        "operationId": "getProc",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Proc"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Stop a process and delete all its files.",
+        "operationId": "deleteProc",
+        "responses": {
+          "204": {"description": "Process deleted."},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/procs/{name}/start": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "post": {
+        "summary": "Start a process. This also clears its errored status.",
+        "operationId": "startProc",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Proc"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/procs/{name}/stop": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}, {"$ref": "#/components/parameters/Timeout"}],
+      "post": {
+        "summary": "Stop a process, killing it in case it does not exit in time.",
+        "operationId": "stopProc",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Proc"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/procs/{name}/restart": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}, {"$ref": "#/components/parameters/Timeout"}],
+      "post": {
+        "summary": "Stop and start a process again.",
+        "operationId": "restartProc",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Proc"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/procs/{name}/rebuild": {
+      "parameters": [
+        {"$ref": "#/components/parameters/Name"},
+        {"$ref": "#/components/parameters/Timeout"},
+        {"$ref": "#/components/parameters/Wait"}
+      ],
+      "post": {
+        "summary": "Build a process again from its source and restart it on the new binary, unless it is stopped. A failed build leaves it running on its current binary.",
+        "operationId": "rebuildProc",
+        "responses": {
+          "200": {"description": "Build output.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BuildOutput"}}}},
+          "202": {"$ref": "#/components/responses/BuildJob"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "422": {"description": "The build failed.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/procs/{name}/ready": {
+      "parameters": [
+        {"$ref": "#/components/parameters/Name"},
+        {"name": "wait", "in": "query", "description": "Wait up to this long for the process to be ready, as a Go duration such as 30s. Defaults to checking right away.", "schema": {"type": "string"}}
+      ],
+      "get": {
+        "summary": "Check that a process is ready, or running in case it has no readiness check.",
+        "operationId": "waitProcReady",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Proc"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"description": "The process is not running.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "503": {"description": "The process is still starting.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/procs/{name}/versions": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "get": {
+        "summary": "List the built versions of a process.",
+        "operationId": "listProcVersions",
+        "responses": {
+          "200": {"description": "Versions, oldest first.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Versions"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/procs/{name}/rollback": {
+      "parameters": [
+        {"$ref": "#/components/parameters/Name"},
+        {"$ref": "#/components/parameters/Timeout"},
+        {"name": "version", "in": "query", "description": "Version to run. Defaults to the one built before the current one.", "schema": {"type": "integer"}}
+      ],
+      "post": {
+        "summary": "Run a process on a previous version without building anything, restarting it unless it is stopped.",
+        "operationId": "rollbackProc",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Proc"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/procs/{name}/env": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "put": {
+        "summary": "Set environment variables. They take effect on the next restart.",
+        "operationId": "setProcEnv",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"type": "object", "additionalProperties": {"type": "string"}}}}
+        },
+        "responses": {
+          "204": {"description": "Variables set."},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Unset environment variables. They take effect on the next restart.",
+        "operationId": "unsetProcEnv",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"type": "array", "items": {"type": "string"}}}}
+        },
+        "responses": {
+          "204": {"description": "Variables unset."},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/procs/{name}/logs": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "get": {
+        "summary": "Read the out or err file of a process.",
+        "description": "Without offset, returns the last lines. Follow the logs by calling again with the returned offset.",
+        "operationId": "readProcLogs",
+        "parameters": [
+          {"name": "stream", "in": "query", "schema": {"type": "string", "enum": ["out", "err"], "default": "out"}},
+          {"name": "offset", "in": "query", "schema": {"type": "integer", "format": "int64"}},
+          {"name": "lines", "in": "query", "schema": {"type": "integer", "default": 10}},
+          {
+            "name": "grep",
+            "in": "query",
+            "description": "Only return lines whose field has this value, as field=value. Nested fields are separated by dots. Can be repeated.",
+            "schema": {"type": "array", "items": {"type": "string"}},
+            "explode": true
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Complete lines, without their new line.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Logs"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/procs/{name}/logs/rotate": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "post": {
+        "summary": "Rotate the out and err files now. The process keeps running.",
+        "operationId": "rotateProcLogs",
+        "responses": {
+          "204": {"description": "Logs rotated."},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/procs/{name}/logs/flush": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "post": {
+        "summary": "Empty the out and err files and delete the rotated ones. The process keeps running.",
+        "operationId": "flushProcLogs",
+        "responses": {
+          "204": {"description": "Logs flushed."},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/builds": {
+      "get": {
+        "summary": "List the last build jobs, oldest first.",
+        "operationId": "listBuilds",
+        "responses": {
+          "200": {
+            "description": "Build jobs.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BuildList"}}}
+          }
+        }
+      }
+    },
+    "/builds/{id}": {
+      "parameters": [
+        {"name": "id", "in": "path", "required": true, "schema": {"type": "integer"}},
+        {"name": "wait", "in": "query", "description": "Wait up to this long for the job to finish, as a Go duration such as 30s.", "schema": {"type": "string"}}
+      ],
+      "get": {
+        "summary": "Get a build job, with its output once it is finished.",
+        "operationId": "getBuild",
+        "responses": {
+          "200": {"$ref": "#/components/responses/BuildJob"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/save": {
+      "post": {
+        "summary": "Save the list of processes to the config file.",
+        "operationId": "save",
+        "responses": {
+          "204": {"description": "Processes saved."},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/resurrect": {
+      "post": {
+        "summary": "Start all previously saved keep alive processes.",
+        "operationId": "resurrect",
+        "responses": {
+          "204": {"description": "Processes resurrected."},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearerAuth": {"type": "http", "scheme": "bearer", "description": "An admin or read only token of the server."}
+    },
+    "parameters": {
+      "Name": {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}},
+      "Timeout": {
+        "name": "timeout",
+        "in": "query",
+        "description": "Overrides the process stop timeout, as a Go duration such as 30s.",
+        "schema": {"type": "string"}
+      },
+      "Wait": {
+        "name": "wait",
+        "in": "query",
+        "description": "Set to false to only queue the build and reply with its job. Defaults to true.",
+        "schema": {"type": "boolean"}
+      }
+    },
+    "responses": {
+      "Proc": {
+        "description": "The process status.",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Proc"}}}
+      },
+      "BuildJob": {
+        "description": "The build job.",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BuildJob"}}}
+      },
+      "Error": {
+        "description": "The request failed.",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      }
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "properties": {"error": {"type": "string"}}
+      },
+      "RestartPolicy": {
+        "type": "object",
+        "properties": {
+          "min_backoff": {"type": "string", "example": "1s", "description": "Defaults to 1s."},
+          "max_backoff": {"type": "string", "example": "1m0s", "description": "Defaults to 1m."},
+          "max_restarts": {"type": "integer", "description": "Zero means the default of 5. Negative allows unlimited restarts."},
+          "window": {"type": "string", "example": "1m0s", "description": "Defaults to 1m."}
+        }
+      },
+      "MemoryLimit": {
+        "type": "object",
+        "description": "Gracefully restarts the process once its resident memory was above max_memory for samples samples in a row. Memory is sampled every 5s.",
+        "properties": {
+          "max_memory": {"type": "integer", "format": "int64", "description": "In bytes. Zero disables the limit."},
+          "children": {"type": "boolean", "description": "Add the resident memory of the descendants of the process."},
+          "samples": {"type": "integer", "description": "Defaults to 3."}
+        }
+      },
+      "HealthCheck": {
+        "type": "object",
+        "description": "Liveness probe. A process failing failure_threshold probes in a row is restarted.",
+        "required": ["type"],
+        "properties": {
+          "type": {"type": "string", "enum": ["http", "tcp", "exec"]},
+          "url": {"type": "string", "description": "Requested with GET by http probes."},
+          "status": {"type": "integer", "description": "Status expected by http probes. Defaults to any 2xx or 3xx status."},
+          "address": {"type": "string", "description": "host:port connected to by tcp probes."},
+          "command": {"type": "string", "description": "Run with sh by exec probes, from the process cwd. Healthy when it exits with 0."},
+          "interval": {"type": "string", "example": "10s", "description": "Defaults to 10s."},
+          "timeout": {"type": "string", "example": "5s", "description": "Defaults to 5s."},
+          "failure_threshold": {"type": "integer", "description": "Defaults to 3."},
+          "initial_delay": {"type": "string", "example": "30s"}
+        }
+      },
+      "ReadinessCheck": {
+        "type": "object",
+        "description": "Tells when a process that just started is ready. Its status is starting until then, and ready afterwards.",
+        "required": ["type"],
+        "properties": {
+          "type": {"type": "string", "enum": ["tcp", "http", "notify"], "description": "notify waits for READY=1 on the socket given to the process in NOTIFY_SOCKET, as with sd_notify."},
+          "url": {"type": "string", "description": "Requested with GET by http checks."},
+          "status": {"type": "integer", "description": "Status expected by http checks. Defaults to 200."},
+          "address": {"type": "string", "description": "host:port connected to by tcp checks."},
+          "interval": {"type": "string", "example": "500ms", "description": "Time between two checks. Defaults to 500ms."}
+        }
+      },
+      "Logs": {
+        "type": "object",
+        "properties": {
+          "lines": {"type": "array", "items": {"type": "string"}},
+          "offset": {"type": "integer", "format": "int64"}
+        }
+      },
+      "LogRotate": {
+        "type": "object",
+        "description": "Zero values disable the matching rule.",
+        "properties": {
+          "max_size": {"type": "integer", "format": "int64", "description": "Size in bytes."},
+          "max_age": {"type": "string", "example": "24h0m0s"},
+          "keep": {"type": "integer", "description": "Rotated files kept. Zero keeps them all."},
+          "compress": {"type": "boolean"}
+        }
+      },
+      "Versions": {
+        "type": "object",
+        "properties": {
+          "current": {"type": "integer", "description": "Version the process runs."},
+          "versions": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "id": {"type": "integer"},
+                "built_at": {"type": "string", "format": "date-time"},
+                "revision": {"type": "string", "description": "Git commit of the source, with a -dirty suffix for uncommitted changes."},
+                "checksum": {"type": "string", "description": "SHA-256 of the binary."},
+                "path": {"type": "string"}
+              }
+            }
+          }
+        }
+      },
+      "BuildJob": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "name": {"type": "string"},
+          "kind": {"type": "string", "enum": ["bin", "rebuild"]},
+          "status": {"type": "string", "enum": ["queued", "building", "succeeded", "failed"]},
+          "version": {"type": "integer", "description": "Version built, once the job succeeds."},
+          "output": {"type": "string", "description": "Build output, once the job is finished."},
+          "error": {"type": "string"},
+          "queued_at": {"type": "string", "format": "date-time"},
+          "started_at": {"type": "string", "format": "date-time"},
+          "finished_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "BuildList": {
+        "type": "object",
+        "properties": {
+          "jobs": {"type": "array", "items": {"$ref": "#/components/schemas/BuildJob"}}
+        }
+      },
+      "BuildOutput": {
+        "type": "object",
+        "properties": {
+          "output": {"type": "string"}
+        }
+      },
+      "Build": {
+        "type": "object",
+        "description": "How source_path is built. Saved with the process.",
+        "properties": {
+          "env": {"type": "object", "additionalProperties": {"type": "string"}, "description": "Ex: {\"CGO_ENABLED\": \"0\"}"},
+          "tags": {"type": "array", "items": {"type": "string"}},
+          "ldflags": {"type": "string", "description": "Ex: -X main.version=1.2.0"},
+          "args": {"type": "array", "items": {"type": "string"}, "description": "Extra go build args."},
+          "command": {"type": "string", "description": "Run with sh from source_path before go build. Ex: make build"},
+          "output": {"type": "string", "description": "Binary written by command, relative to source_path. Replaces go build."},
+          "keep": {"type": "integer", "description": "Built versions kept. Defaults to 5."}
+        }
+      },
+      "LogSink": {
+        "type": "object",
+        "required": ["type"],
+        "properties": {
+          "type": {"type": "string", "enum": ["file", "syslog", "json"]},
+          "network": {"type": "string", "description": "udp, tcp or unixgram for syslog, tcp for json."},
+          "address": {"type": "string", "description": "host:port, or /dev/log for the local syslog."},
+          "facility": {"type": "string", "description": "Syslog facility. Defaults to user."}
+        }
+      },
+      "NewProc": {
+        "type": "object",
+        "required": ["name"],
+        "properties": {
+          "name": {"type": "string"},
+          "source_path": {"type": "string", "description": "Go package to build. Ex: github.com/topfreegames/apm"},
+          "cmd": {"type": "string", "description": "Executable to run, when not building a Go project."},
+          "args": {"type": "array", "items": {"type": "string"}},
+          "keep_alive": {"type": "boolean"},
+          "stop_timeout": {"type": "string", "example": "10s", "description": "Defaults to 10s."},
+          "restart_policy": {"$ref": "#/components/schemas/RestartPolicy"},
+          "health_check": {"$ref": "#/components/schemas/HealthCheck"},
+          "readiness_check": {"$ref": "#/components/schemas/ReadinessCheck"},
+          "env": {"type": "object", "additionalProperties": {"type": "string"}},
+          "env_files": {"type": "array", "items": {"type": "string"}},
+          "cwd": {"type": "string"},
+          "setsid": {"type": "boolean"},
+          "log_rotate": {"$ref": "#/components/schemas/LogRotate"},
+          "capture": {"type": "boolean", "description": "Read the output through pipes, prefixing each line with an RFC3339 timestamp and its stream, and add APM marker lines such as restarts."},
+          "log_format": {"type": "string", "enum": ["text", "json"], "description": "json stores each line as a record with the proc, pid, stream, ts and message fields, and implies capture."},
+          "build": {"$ref": "#/components/schemas/Build"},
+          "log_sinks": {"type": "array", "items": {"$ref": "#/components/schemas/LogSink"}, "description": "Where the output goes. Defaults to the out and err files. Sinks imply capture."},
+          "metrics_children": {"type": "boolean", "description": "Add the usage of the descendants of the process to its metrics."},
+          "memory_limit": {"$ref": "#/components/schemas/MemoryLimit"}
+        }
+      },
+      "ProcStatus": {
+        "type": "object",
+        "properties": {
+          "status": {"type": "string", "description": "Ex: running, starting, ready, stopped, restarting, errored, killed or dead."},
+          "restarts": {"type": "integer", "description": "Restarts after the process died or was unhealthy."},
+          "memory_restarts": {"type": "integer", "description": "Restarts for exceeding the memory limit, not counted in restarts."},
+          "memory_exceeded": {"type": "integer", "description": "Memory samples in a row above the memory limit."},
+          "restart_reason": {"type": "string", "description": "Why APM last restarted the process. Ex: exit 1, unhealthy: ... or memory limit exceeded."},
+          "recent_restarts": {"type": "array", "items": {"type": "string", "format": "date-time"}},
+          "started_at": {"type": "string", "format": "date-time"},
+          "exited_at": {"type": "string", "format": "date-time"},
+          "exit_code": {"type": "integer"},
+          "signal": {"type": "integer"},
+          "core_dumped": {"type": "boolean"},
+          "ready_at": {"type": "string", "format": "date-time"},
+          "health": {"type": "string", "enum": ["", "healthy", "unhealthy"], "description": "Empty until the health check runs after each start."},
+          "health_failures": {"type": "integer", "description": "Health checks failed in a row."},
+          "health_error": {"type": "string"},
+          "health_checked_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "ProcMetrics": {
+        "type": "object",
+        "description": "Resource usage sampled from /proc every 5s. Absent while the process is not running.",
+        "properties": {
+          "cpu_time": {"type": "string", "example": "1m2.5s", "description": "User and system CPU time."},
+          "cpu_percent": {"type": "number", "description": "CPU used since the previous sample, where 100 is one whole core."},
+          "rss": {"type": "integer", "format": "int64", "description": "Resident memory, in bytes."},
+          "vsz": {"type": "integer", "format": "int64", "description": "Virtual memory size, in bytes."},
+          "fds": {"type": "integer"},
+          "threads": {"type": "integer"},
+          "read_bytes": {"type": "integer", "format": "int64", "description": "Bytes read from storage."},
+          "write_bytes": {"type": "integer", "format": "int64", "description": "Bytes written to storage."},
+          "processes": {"type": "integer", "description": "Processes sampled: the process and, with metrics_children, its descendants."},
+          "sampled_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Proc": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "pid": {"type": "integer"},
+          "status": {"$ref": "#/components/schemas/ProcStatus"},
+          "keep_alive": {"type": "boolean"},
+          "uptime": {"type": "string", "example": "3h2m1s"},
+          "children": {"type": "array", "items": {"type": "integer"}},
+          "metrics": {"$ref": "#/components/schemas/ProcMetrics"}
+        }
+      },
+      "ProcList": {
+        "type": "object",
+        "properties": {
+          "procs": {"type": "array", "items": {"$ref": "#/components/schemas/Proc"}}
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,28 @@
+package master
+
+import "errors"
+import "net"
+import "syscall"
+
+var errPeerCredentialsUnsupported = errors.New("Peer credentials are not supported on this platform.")
+
+// peerCredentials will read the pid, uid and gid of the process on the other side of conn with SO_PEERCRED.
+// Returns a tuple with the pid, the uid, the gid and an error in case there's any.
+func peerCredentials(conn *net.UnixConn) (int, int, int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if credErr != nil {
+		return 0, 0, 0, credErr
+	}
+	return int(cred.Pid), int(cred.Uid), int(cred.Gid), nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package master
+
+import "errors"
+import "net"
+
+var errPeerCredentialsUnsupported = errors.New("Peer credentials are not supported on this platform.")
+
+// peerCredentials is not supported outside linux, so the socket relies on its file permissions.
+// Returns errPeerCredentialsUnsupported.
+func peerCredentials(conn *net.UnixConn) (int, int, int, error) {
+	return 0, 0, 0, errPeerCredentialsUnsupported
+}
@@ -0,0 +1,295 @@
+package master
+
+import "bufio"
+import "fmt"
+import "io"
+import "net/http"
+import "os"
+import "runtime"
+import "sort"
+import "strconv"
+import "strings"
+import "time"
+
+import "github.com/topfreegames/apm/lib/process"
+import "github.com/topfreegames/apm/lib/procfs"
+import log "github.com/Sirupsen/logrus"
+
+// labelEscaper escapes label values as the exposition format asks for.
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// prometheusContentType is the content type of the Prometheus text exposition format.
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// StartMetricsServer will serve Prometheus metrics on GET /metrics of the TCP address dsn. It
+// uses the TLS and tokens of the TCP listener, and read only tokens are enough to scrape it.
+// Returns an error in case it can't listen on dsn.
+func (remote_master *RemoteMaster) StartMetricsServer(dsn string) error {
+	l, err := remote_master.listenTCP(dsn)
+	if err != nil {
+		return err
+	}
+	api := &httpAPI{remoteMaster: remote_master}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", api.authorize(api.handleMetrics))
+	go func() {
+		err := http.Serve(l, mux)
+		log.Warnf("Metrics server stopped due to %s", err)
+	}()
+	return nil
+}
+
+// handleMetrics serves GET /metrics.
+func (api *httpAPI) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		api.notAllowed(w, "GET")
+		return
+	}
+	w.Header().Set("Content-Type", prometheusContentType)
+	api.remoteMaster.master.WritePrometheus(w)
+}
+
+// procSnapshot is what is exported of a proc, copied while holding the lock.
+type procSnapshot struct {
+	name        string
+	alive       bool
+	status      process.ProcStatus
+	healthCheck bool
+	metrics     *ProcMetrics
+}
+
+// WritePrometheus will write the metrics of the procs, of the builds and of APM itself to out,
+// in the Prometheus text exposition format.
+func (master *Master) WritePrometheus(out io.Writer) error {
+	now := time.Now()
+	master.Lock()
+	procs := []procSnapshot{}
+	for _, proc := range master.ListProcs() {
+		snapshot := procSnapshot{
+			name:        proc.Identifier(),
+			alive:       proc.IsAlive(),
+			status:      *proc.GetStatus(),
+			healthCheck: proc.GetHealthCheck().Enabled(),
+		}
+		if metrics, ok := master.metrics[snapshot.name]; ok && snapshot.alive && metrics.pid == proc.GetPid() {
+			copied := *metrics
+			snapshot.metrics = &copied
+		}
+		procs = append(procs, snapshot)
+	}
+	master.Unlock()
+	sort.Slice(procs, func(i, j int) bool {
+		return procs[i].name < procs[j].name
+	})
+
+	writer := newPrometheusWriter(out)
+	writer.family("apm_process_up", "gauge", "Whether the process is running (1) or not (0).")
+	for _, proc := range procs {
+		writer.sample("apm_process_up", writer.boolean(proc.alive), "name", proc.name)
+	}
+	writer.family("apm_process_info", "gauge", "The status of the process, always 1.")
+	for _, proc := range procs {
+		writer.sample("apm_process_info", 1, "name", proc.name, "status", proc.status.Status)
+	}
+	writer.family("apm_process_restarts_total", "counter", "How many times APM restarted the process after it died or was unhealthy.")
+	for _, proc := range procs {
+		writer.sample("apm_process_restarts_total", float64(proc.status.Restarts), "name", proc.name)
+	}
+	writer.family("apm_process_memory_restarts_total", "counter", "How many times APM restarted the process for exceeding its memory limit.")
+	for _, proc := range procs {
+		writer.sample("apm_process_memory_restarts_total", float64(proc.status.MemoryRestarts), "name", proc.name)
+	}
+	writer.family("apm_process_last_exit_code", "gauge", "The last exit code of the process, or -1 in case it was killed by a signal.")
+	for _, proc := range procs {
+		if !proc.status.ExitedAt.IsZero() {
+			writer.sample("apm_process_last_exit_code", float64(proc.status.ExitCode), "name", proc.name)
+		}
+	}
+	writer.family("apm_process_uptime_seconds", "gauge", "How long the process has been running.")
+	for _, proc := range procs {
+		if proc.alive {
+			writer.sample("apm_process_uptime_seconds", proc.status.Uptime(now).Seconds(), "name", proc.name)
+		}
+	}
+	writer.family("apm_process_healthy", "gauge", "Whether the last health check of the process passed (1) or not (0).")
+	for _, proc := range procs {
+		if proc.healthCheck && proc.status.Health != "" {
+			writer.sample("apm_process_healthy", writer.boolean(proc.status.Health == "healthy"), "name", proc.name)
+		}
+	}
+	writer.family("apm_process_health_failures", "gauge", "How many health checks of the process failed in a row.")
+	for _, proc := range procs {
+		if proc.healthCheck {
+			writer.sample("apm_process_health_failures", float64(proc.status.HealthFailures), "name", proc.name)
+		}
+	}
+	master.writeUsage(writer, procs)
+	master.writeBuilds(writer)
+	writeRuntime(writer)
+	return writer.flush()
+}
+
+// writeUsage writes the last sampled usage of the running procs.
+func (master *Master) writeUsage(writer *prometheusWriter, procs []procSnapshot) {
+	usages := []struct {
+		name  string
+		kind  string
+		help  string
+		value func(metrics *ProcMetrics) float64
+	}{
+		{"apm_process_cpu_seconds_total", "counter", "User and system CPU time used by the process.", func(metrics *ProcMetrics) float64 {
+			return metrics.CPUTime.Seconds()
+		}},
+		{"apm_process_cpu_percent", "gauge", "CPU used by the process between the last two samples, where 100 is one whole core.", func(metrics *ProcMetrics) float64 {
+			return metrics.CPUPercent
+		}},
+		{"apm_process_resident_memory_bytes", "gauge", "Resident memory of the process.", func(metrics *ProcMetrics) float64 {
+			return float64(metrics.RSS)
+		}},
+		{"apm_process_virtual_memory_bytes", "gauge", "Virtual memory size of the process.", func(metrics *ProcMetrics) float64 {
+			return float64(metrics.VSZ)
+		}},
+		{"apm_process_open_fds", "gauge", "Open file descriptors of the process.", func(metrics *ProcMetrics) float64 {
+			return float64(metrics.FDs)
+		}},
+		{"apm_process_threads", "gauge", "Threads of the process.", func(metrics *ProcMetrics) float64 {
+			return float64(metrics.Threads)
+		}},
+		{"apm_process_read_bytes_total", "counter", "Bytes the process read from storage.", func(metrics *ProcMetrics) float64 {
+			return float64(metrics.ReadBytes)
+		}},
+		{"apm_process_written_bytes_total", "counter", "Bytes the process wrote to storage.", func(metrics *ProcMetrics) float64 {
+			return float64(metrics.WriteBytes)
+		}},
+	}
+	for _, usage := range usages {
+		writer.family(usage.name, usage.kind, usage.help)
+		for _, proc := range procs {
+			if proc.metrics != nil {
+				writer.sample(usage.name, usage.value(proc.metrics), "name", proc.name)
+			}
+		}
+	}
+}
+
+// writeBuilds writes the histogram of the build durations of each proc.
+func (master *Master) writeBuilds(writer *prometheusWriter) {
+	histograms := master.builds.histograms()
+	sort.Slice(histograms, func(i, j int) bool {
+		if histograms[i].Name != histograms[j].Name {
+			return histograms[i].Name < histograms[j].Name
+		}
+		return histograms[i].Status < histograms[j].Status
+	})
+	writer.family("apm_build_duration_seconds", "histogram", "How long the builds of the process took, by status.")
+	for _, histogram := range histograms {
+		for i, bound := range buildDurationBuckets {
+			writer.sample("apm_build_duration_seconds_bucket", float64(histogram.Buckets[i]),
+				"name", histogram.Name, "status", histogram.Status, "le", writer.number(bound))
+		}
+		writer.sample("apm_build_duration_seconds_bucket", float64(histogram.Count),
+			"name", histogram.Name, "status", histogram.Status, "le", "+Inf")
+		writer.sample("apm_build_duration_seconds_sum", histogram.Sum.Seconds(), "name", histogram.Name, "status", histogram.Status)
+		writer.sample("apm_build_duration_seconds_count", float64(histogram.Count), "name", histogram.Name, "status", histogram.Status)
+	}
+}
+
+// writeRuntime writes the metrics of APM itself, named as the Prometheus Go client names them.
+func writeRuntime(writer *prometheusWriter) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	threads, _ := runtime.ThreadCreateProfile(nil)
+	writer.family("go_info", "gauge", "Information about the Go environment.")
+	writer.sample("go_info", 1, "version", runtime.Version())
+	writer.family("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	writer.sample("go_goroutines", float64(runtime.NumGoroutine()))
+	writer.family("go_threads", "gauge", "Number of OS threads created.")
+	writer.sample("go_threads", float64(threads))
+	writer.family("go_gc_duration_seconds", "summary", "Pause durations of the garbage collection cycles.")
+	writer.sample("go_gc_duration_seconds_sum", time.Duration(stats.PauseTotalNs).Seconds())
+	writer.sample("go_gc_duration_seconds_count", float64(stats.NumGC))
+	memStats := []struct {
+		name  string
+		kind  string
+		help  string
+		value uint64
+	}{
+		{"go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.", stats.Alloc},
+		{"go_memstats_alloc_bytes_total", "counter", "Total number of bytes allocated, even if freed.", stats.TotalAlloc},
+		{"go_memstats_sys_bytes", "gauge", "Number of bytes obtained from the system.", stats.Sys},
+		{"go_memstats_mallocs_total", "counter", "Total number of mallocs.", stats.Mallocs},
+		{"go_memstats_frees_total", "counter", "Total number of frees.", stats.Frees},
+		{"go_memstats_heap_alloc_bytes", "gauge", "Number of heap bytes allocated and still in use.", stats.HeapAlloc},
+		{"go_memstats_heap_sys_bytes", "gauge", "Number of heap bytes obtained from the system.", stats.HeapSys},
+		{"go_memstats_heap_idle_bytes", "gauge", "Number of heap bytes waiting to be used.", stats.HeapIdle},
+		{"go_memstats_heap_inuse_bytes", "gauge", "Number of heap bytes that are in use.", stats.HeapInuse},
+		{"go_memstats_heap_released_bytes", "gauge", "Number of heap bytes released to the OS.", stats.HeapReleased},
+		{"go_memstats_heap_objects", "gauge", "Number of allocated objects.", stats.HeapObjects},
+		{"go_memstats_stack_inuse_bytes", "gauge", "Number of bytes in use by the stack allocator.", stats.StackInuse},
+		{"go_memstats_next_gc_bytes", "gauge", "Number of heap bytes when the next garbage collection will take place.", stats.NextGC},
+	}
+	for _, stat := range memStats {
+		writer.family(stat.name, stat.kind, stat.help)
+		writer.sample(stat.name, float64(stat.value))
+	}
+	writer.family("go_memstats_last_gc_time_seconds", "gauge", "Number of seconds since 1970 of the last garbage collection.")
+	writer.sample("go_memstats_last_gc_time_seconds", float64(stats.LastGC)/1e9)
+
+	if !procfs.Available() {
+		return
+	}
+	usage, err := procfs.ReadUsage(os.Getpid())
+	if err != nil {
+		return
+	}
+	writer.family("process_cpu_seconds_total", "counter", "Total user and system CPU time spent in seconds.")
+	writer.sample("process_cpu_seconds_total", usage.CPUTime.Seconds())
+	writer.family("process_resident_memory_bytes", "gauge", "Resident memory size in bytes.")
+	writer.sample("process_resident_memory_bytes", float64(usage.RSS))
+	writer.family("process_virtual_memory_bytes", "gauge", "Virtual memory size in bytes.")
+	writer.sample("process_virtual_memory_bytes", float64(usage.VSZ))
+	writer.family("process_open_fds", "gauge", "Number of open file descriptors.")
+	writer.sample("process_open_fds", float64(usage.FDs))
+}
+
+// prometheusWriter writes metric families in the Prometheus text exposition format.
+type prometheusWriter struct {
+	out *bufio.Writer
+}
+
+func newPrometheusWriter(out io.Writer) *prometheusWriter {
+	return &prometheusWriter{out: bufio.NewWriter(out)}
+}
+
+// family writes the HELP and TYPE lines of the metric called name.
+func (writer *prometheusWriter) family(name string, kind string, help string) {
+	fmt.Fprintf(writer.out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one sample of the metric called name. labels are label name and value pairs.
+func (writer *prometheusWriter) sample(name string, value float64, labels ...string) {
+	writer.out.WriteString(name)
+	if len(labels) > 0 {
+		pairs := []string{}
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+"=\""+labelEscaper.Replace(labels[i+1])+"\"")
+		}
+		writer.out.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	writer.out.WriteString(" " + writer.number(value) + "\n")
+}
+
+func (writer *prometheusWriter) number(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (writer *prometheusWriter) boolean(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func (writer *prometheusWriter) flush() error {
+	return writer.out.Flush()
+}
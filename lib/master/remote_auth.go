@@ -0,0 +1,265 @@
+package master
+
+import "bufio"
+import "crypto/subtle"
+import "crypto/tls"
+import "crypto/x509"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "net"
+import "strings"
+import "time"
+
+// ErrPermissionDenied is returned to read only clients calling methods that change the server.
+var ErrPermissionDenied = errors.New("Permission denied. An admin token is required.")
+
+// ErrInvalidToken is returned to clients whose token is unknown to the server.
+var ErrInvalidToken = errors.New("Invalid token.")
+
+// authTimeout is how long a TCP client has to complete the TLS and token handshakes.
+const authTimeout = 10 * time.Second
+
+// authPrefix starts the line a TCP client sends with its token before any RPC call.
+const authPrefix = "APM-AUTH "
+
+// RemoteConfig is the TCP and HTTP security configuration of the remote master. It can be
+// set on the Remote section of config.toml and overridden by the serve flags.
+type RemoteConfig struct {
+	TLSCert        string   // TLSCert is the server certificate file. TLS is enabled when it is set.
+	TLSKey         string   // TLSKey is the server private key file.
+	TLSClientCA    string   // TLSClientCA enables mutual TLS. Clients must present a certificate signed by it.
+	AdminTokens    []string // AdminTokens can call every method.
+	ReadOnlyTokens []string // ReadOnlyTokens can only query the processes status.
+}
+
+// ClientConfig is the TCP security configuration of a remote client.
+type ClientConfig struct {
+	Token   string // Token is sent to the server before any call.
+	TLS     bool   // TLS will encrypt the connection. It is implied by the other TLS options.
+	TLSCA   string // TLSCA is the CA file used to verify the server certificate. Defaults to the system CAs.
+	TLSCert string // TLSCert is the client certificate file, for servers that require mutual TLS.
+	TLSKey  string // TLSKey is the client private key file.
+}
+
+// accessLevel is what a remote client is allowed to do.
+type accessLevel int
+
+const (
+	accessDenied accessLevel = iota
+	accessReadOnly
+	accessAdmin
+)
+
+// readOnlyMethods are the RPC methods read only tokens can call. Logs are left out, since
+// processes may print secrets.
+var readOnlyMethods = map[string]bool{
+	"RemoteMaster.MonitStatus":  true,
+	"RemoteMaster.ListVersions": true,
+	"RemoteMaster.GetBuild":     true,
+	"RemoteMaster.ListBuilds":   true,
+	"RemoteMaster.WaitReady":    true,
+}
+
+// override will replace the fields of config with the ones set on other.
+// Returns the resulting config.
+func (config RemoteConfig) override(other *RemoteConfig) RemoteConfig {
+	if other == nil {
+		return config
+	}
+	if other.TLSCert != "" {
+		config.TLSCert = other.TLSCert
+	}
+	if other.TLSKey != "" {
+		config.TLSKey = other.TLSKey
+	}
+	if other.TLSClientCA != "" {
+		config.TLSClientCA = other.TLSClientCA
+	}
+	if len(other.AdminTokens) > 0 {
+		config.AdminTokens = other.AdminTokens
+	}
+	if len(other.ReadOnlyTokens) > 0 {
+		config.ReadOnlyTokens = other.ReadOnlyTokens
+	}
+	return config
+}
+
+// hasTokens will check whether clients need a token.
+// Returns true in case they do.
+func (config *RemoteConfig) hasTokens() bool {
+	return len(config.AdminTokens) > 0 || len(config.ReadOnlyTokens) > 0
+}
+
+// access will find what a client with token is allowed to do. Everybody is an admin in
+// case no tokens are configured.
+// Returns the access level of token.
+func (config *RemoteConfig) access(token string) accessLevel {
+	if !config.hasTokens() {
+		return accessAdmin
+	}
+	if matchToken(token, config.AdminTokens) {
+		return accessAdmin
+	}
+	if matchToken(token, config.ReadOnlyTokens) {
+		return accessReadOnly
+	}
+	return accessDenied
+}
+
+// matchToken compares token in constant time so it can't be guessed by timing the server.
+func matchToken(token string, tokens []string) bool {
+	match := false
+	for _, candidate := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+			match = true
+		}
+	}
+	return token != "" && match
+}
+
+// tlsConfig will load the server certificate and, for mutual TLS, the client CA.
+// Returns a tuple with the TLS config, nil in case TLS is disabled, and an error in case there's any.
+func (config *RemoteConfig) tlsConfig() (*tls.Config, error) {
+	if config.TLSCert == "" && config.TLSKey == "" {
+		if config.TLSClientCA != "" {
+			return nil, errors.New("Mutual TLS requires a server certificate and key.")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.TLSClientCA != "" {
+		pool, err := loadCertPool(config.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// tlsConfig will load the CA and client certificate of the client.
+// Returns a tuple with the TLS config, nil in case TLS is disabled, and an error in case there's any.
+func (config *ClientConfig) tlsConfig() (*tls.Config, error) {
+	if !config.TLS && config.TLSCA == "" && config.TLSCert == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.TLSCA != "" {
+		pool, err := loadCertPool(config.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.TLSCert != "" || config.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func loadCertPool(filepath string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in %s.", filepath)
+	}
+	return pool, nil
+}
+
+// bufferedConn keeps the bytes read ahead by the handshake reader available to RPC.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+// serverHandshake will read the token line of a TCP client and tell it whether it was accepted.
+// Without tokens, clients that call right away, such as net/rpc clients and older apm binaries,
+// skip the handshake.
+// Returns a tuple with the connection to serve RPC on, the client access level and an error in case there's any.
+func (config *RemoteConfig) serverHandshake(conn net.Conn) (net.Conn, accessLevel, error) {
+	conn.SetDeadline(time.Now().Add(authTimeout))
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, accessDenied, err
+		}
+	}
+	reader := bufio.NewReader(conn)
+	if !config.hasTokens() {
+		// Clients may wait before their first call, so they are not timed out meanwhile.
+		conn.SetDeadline(time.Time{})
+		prefix, err := reader.Peek(len(authPrefix))
+		if err != nil || string(prefix) != authPrefix {
+			return &bufferedConn{Conn: conn, reader: reader}, accessAdmin, nil
+		}
+		conn.SetDeadline(time.Now().Add(authTimeout))
+	}
+	prefix, err := reader.Peek(len(authPrefix))
+	if err != nil {
+		return nil, accessDenied, err
+	}
+	if string(prefix) != authPrefix {
+		conn.Write([]byte("ERR Missing authentication. Upgrade the client.\n"))
+		return nil, accessDenied, errors.New("Missing authentication.")
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, accessDenied, err
+	}
+	level := config.access(strings.TrimSpace(strings.TrimPrefix(line, authPrefix)))
+	if level == accessDenied {
+		conn.Write([]byte("ERR " + ErrInvalidToken.Error() + "\n"))
+		return nil, accessDenied, ErrInvalidToken
+	}
+	if _, err := conn.Write([]byte("OK\n")); err != nil {
+		return nil, accessDenied, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, reader: reader}, level, nil
+}
+
+// clientHandshake will send the token to the server and wait for it to be accepted.
+// Returns an error in case there's any.
+func (config *ClientConfig) clientHandshake(conn net.Conn, timeout time.Duration) error {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if _, err := conn.Write([]byte(authPrefix + config.Token + "\n")); err != nil {
+		return err
+	}
+	// The server writes nothing else before the reply to the first call, so nothing
+	// is lost by reading byte by byte.
+	reply := []byte{}
+	b := make([]byte, 1)
+	for len(reply) == 0 || reply[len(reply)-1] != '\n' {
+		if _, err := conn.Read(b); err != nil {
+			return err
+		}
+		reply = append(reply, b[0])
+	}
+	conn.SetDeadline(time.Time{})
+	line := strings.TrimSpace(string(reply))
+	if line != "OK" {
+		return errors.New(strings.TrimPrefix(line, "ERR "))
+	}
+	return nil
+}
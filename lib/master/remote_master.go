@@ -1,16 +1,25 @@
 package master
 
+import "crypto/tls"
+import "encoding/json"
 import "net"
 import "net/rpc"
+import "os/exec"
 import "log"
 import "time"
 import "fmt"
 
+import "github.com/topfreegames/apm/lib/logs"
+import "github.com/topfreegames/apm/lib/preparable"
 import "github.com/topfreegames/apm/lib/process"
+import "github.com/topfreegames/apm/lib/procfs"
+import "github.com/topfreegames/apm/lib/utils"
 
 // RemoteMaster is a struct that holds the master instance.
 type RemoteMaster struct {
-	master *Master // Master instance
+	master       *Master           // Master instance
+	unixSocket   *net.UnixListener // unixSocket is the control socket listener inside SysFolder.
+	remoteConfig RemoteConfig      // remoteConfig secures the TCP and HTTP listeners.
 }
 
 // RemoteClient is a struct that holds the remote client instance.
@@ -20,22 +29,138 @@ type RemoteClient struct {
 
 // GoBin is a struct that represents the necessary arguments for a go binary to be built.
 type GoBin struct {
-	SourcePath string   // SourcePath is the package path. (Ex: github.com/topfreegames/apm)
-	Name       string   // Name is the process name that will be given to the process.
-	KeepAlive  bool     // KeepAlive will determine whether APM should keep the proc live or not.
-	Args       []string // Args is an array containing all the extra args that will be passed to the binary after compilation.
+	SourcePath      string                 `json:"source_path"`      // SourcePath is the package path, or the absolute path of a module or build directory. (Ex: github.com/topfreegames/apm)
+	Name            string                 `json:"name"`             // Name is the process name that will be given to the process.
+	KeepAlive       bool                   `json:"keep_alive"`       // KeepAlive will determine whether APM should keep the proc live or not.
+	Args            []string               `json:"args"`             // Args is an array containing all the extra args that will be passed to the binary after compilation.
+	StopTimeout     time.Duration          `json:"stop_timeout"`     // StopTimeout is how long the process has to exit after SIGTERM before being killed. Zero means the default.
+	RestartPolicy   process.RestartPolicy  `json:"restart_policy"`   // RestartPolicy defines the backoff between restarts and when the process is considered crash looping.
+	HealthCheck     process.HealthCheck    `json:"health_check"`     // HealthCheck is a liveness probe. The process is restarted when it fails.
+	ReadinessCheck  process.ReadinessCheck `json:"readiness_check"`  // ReadinessCheck tells when the process is ready, after starting.
+	Env             map[string]string      `json:"env"`              // Env holds extra environment variables for the process.
+	EnvFiles        []string               `json:"env_files"`        // EnvFiles are KEY=VALUE files read each time the process starts. Env takes precedence over them.
+	Cwd             string                 `json:"cwd"`              // Cwd is the process working directory. Defaults to the APM working directory.
+	Setsid          bool                   `json:"setsid"`           // Setsid will start the process in its own session instead of only its own process group.
+	LogRotate       logs.RotateConfig      `json:"log_rotate"`       // LogRotate defines when the out and err files are rotated.
+	Capture         bool                   `json:"capture"`          // Capture will timestamp and tag each output line, and add APM marker lines such as restarts.
+	LogFormat       string                 `json:"log_format"`       // LogFormat is text or json. JSON records imply Capture.
+	LogSinks        []logs.SinkConfig      `json:"log_sinks"`        // LogSinks are where the output goes. Defaults to the out and err files. Sinks imply Capture.
+	MetricsChildren bool                   `json:"metrics_children"` // MetricsChildren adds the usage of the descendants of the process to its metrics.
+	MemoryLimit     process.MemoryLimit    `json:"memory_limit"`     // MemoryLimit restarts the process gracefully once it uses too much memory.
+	Build           preparable.BuildConfig `json:"build"`            // Build sets the build env, tags, ldflags and args, or a custom build command.
 }
 
+// Command is a struct that represents the necessary arguments to run an already built binary or script.
+type Command struct {
+	Cmd             string                 `json:"cmd"`              // Cmd is the executable path, or its name in case it is on the PATH.
+	Name            string                 `json:"name"`             // Name is the process name that will be given to the process.
+	KeepAlive       bool                   `json:"keep_alive"`       // KeepAlive will determine whether APM should keep the proc live or not.
+	Args            []string               `json:"args"`             // Args is an array containing all the args that will be passed to Cmd.
+	StopTimeout     time.Duration          `json:"stop_timeout"`     // StopTimeout is how long the process has to exit after SIGTERM before being killed. Zero means the default.
+	RestartPolicy   process.RestartPolicy  `json:"restart_policy"`   // RestartPolicy defines the backoff between restarts and when the process is considered crash looping.
+	HealthCheck     process.HealthCheck    `json:"health_check"`     // HealthCheck is a liveness probe. The process is restarted when it fails.
+	ReadinessCheck  process.ReadinessCheck `json:"readiness_check"`  // ReadinessCheck tells when the process is ready, after starting.
+	Env             map[string]string      `json:"env"`              // Env holds extra environment variables for the process.
+	EnvFiles        []string               `json:"env_files"`        // EnvFiles are KEY=VALUE files read each time the process starts. Env takes precedence over them.
+	Cwd             string                 `json:"cwd"`              // Cwd is the process working directory. Defaults to the APM working directory.
+	Setsid          bool                   `json:"setsid"`           // Setsid will start the process in its own session instead of only its own process group.
+	LogRotate       logs.RotateConfig      `json:"log_rotate"`       // LogRotate defines when the out and err files are rotated.
+	Capture         bool                   `json:"capture"`          // Capture will timestamp and tag each output line, and add APM marker lines such as restarts.
+	LogFormat       string                 `json:"log_format"`       // LogFormat is text or json. JSON records imply Capture.
+	LogSinks        []logs.SinkConfig      `json:"log_sinks"`        // LogSinks are where the output goes. Defaults to the out and err files. Sinks imply Capture.
+	MetricsChildren bool                   `json:"metrics_children"` // MetricsChildren adds the usage of the descendants of the process to its metrics.
+	MemoryLimit     process.MemoryLimit    `json:"memory_limit"`     // MemoryLimit restarts the process gracefully once it uses too much memory.
+}
+
+// ProcEnvRequest is a struct that represents the arguments to change a process environment.
+type ProcEnvRequest struct {
+	Name string            `json:"name"` // Name is the process name.
+	Vars map[string]string `json:"vars"` // Vars are the variables to set.
+	Keys []string          `json:"keys"` // Keys are the variables to unset.
+}
+
+// ProcStopRequest is a struct that represents the arguments to stop or restart a process.
+type ProcStopRequest struct {
+	Name    string        `json:"name"`    // Name is the process name.
+	Timeout time.Duration `json:"timeout"` // Timeout overrides the process StopTimeout for this call when greater than zero.
+}
+
+// ReadyRequest is a struct that represents the arguments to wait for a process to be ready.
+type ReadyRequest struct {
+	Name    string        `json:"name"`    // Name is the process name.
+	Timeout time.Duration `json:"timeout"` // Timeout is how long to wait for the process to be ready.
+}
+
+// BuildResponse is a struct that represents the output of a build.
+type BuildResponse struct {
+	Output string `json:"output"` // Output is what the build commands wrote.
+}
+
+// BuildRequest is a struct that represents the arguments to get a build job.
+type BuildRequest struct {
+	ID   int           `json:"id"`   // ID is the job ID.
+	Wait time.Duration `json:"wait"` // Wait is how long to wait for the job to finish. Zero returns right away.
+}
+
+// BuildsResponse is a struct that represents the build jobs.
+type BuildsResponse struct {
+	Jobs []BuildJob `json:"jobs"` // Jobs are the last build jobs, oldest first.
+}
+
+// RollbackRequest is a struct that represents the arguments to run a process on a previous version.
+type RollbackRequest struct {
+	Name    string        `json:"name"`    // Name is the process name.
+	Version int           `json:"version"` // Version is the version ID. Zero means the version built before the current one.
+	Timeout time.Duration `json:"timeout"` // Timeout overrides the process StopTimeout for the restart when greater than zero.
+}
+
+// VersionsResponse is a struct that represents the built versions of a process.
+type VersionsResponse struct {
+	Current  int                  `json:"current"`  // Current is the ID of the version the process runs.
+	Versions []preparable.Version `json:"versions"` // Versions are the versions kept, oldest first.
+}
+
+// LogsRequest is a struct that represents the arguments to read the logs of a process.
+type LogsRequest struct {
+	Name   string            `json:"name"`   // Name is the process name.
+	Stream string            `json:"stream"` // Stream is either out or err.
+	Offset int64             `json:"offset"` // Offset is where the previous call stopped. A negative offset reads the last Lines lines.
+	Lines  int               `json:"lines"`  // Lines is how many lines to read when Offset is negative.
+	Grep   map[string]string `json:"grep"`   // Grep only keeps the lines whose fields have these values. See logs.ParseRecord.
+}
+
+// LogsResponse is a struct that represents a chunk of the logs of a process.
+type LogsResponse struct {
+	Lines  []string `json:"lines"`  // Lines are the complete lines read, without their new line.
+	Offset int64    `json:"offset"` // Offset is where the next call should start to follow the logs.
+}
+
+// ProcDataResponse is a struct that represents the status of a process.
 type ProcDataResponse struct {
-	Name string
-	Pid int
-	Status *process.ProcStatus
-	KeepAlive bool
+	Name      string              `json:"name"`
+	Pid       int                 `json:"pid"`
+	Status    *process.ProcStatus `json:"status"`
+	KeepAlive bool                `json:"keep_alive"`
+	Uptime    time.Duration       `json:"uptime"`
+	Children  []int               `json:"children"`
+	Metrics   *ProcMetrics        `json:"metrics"` // Metrics are the last resource usage sampled, or nil in case the process is not running.
+}
+
+// MarshalJSON will encode the process data with the uptime as a string such as 1m30s.
+// Returns a tuple with the JSON object and an error in case there's any.
+func (procData ProcDataResponse) MarshalJSON() ([]byte, error) {
+	type plain ProcDataResponse
+	return json.Marshal(&struct {
+		plain
+		Uptime utils.Duration `json:"uptime"`
+	}{plain(procData), utils.Duration(procData.Uptime)})
 }
 
+// ProcResponse is a struct that represents the status of all processes.
 type ProcResponse struct {
-	Procs []*ProcDataResponse
+	Procs []*ProcDataResponse `json:"procs"`
 }
+
 // Save will save the current running and stopped processes onto a file.
 // Returns an error in case there's any.
 func (remote_master *RemoteMaster) Save(req string, ack *bool) error {
@@ -53,17 +178,114 @@ func (remote_master *RemoteMaster) Resurrect(req string, ack *bool) error {
 }
 
 // StartGoBin will build a binary based on the arguments passed on goBin, then it will start the process
-// and keep it alive if KeepAlive is set to true.
+// and keep it alive if KeepAlive is set to true. It waits for the build, see SubmitGoBin to only queue it.
 // It returns an error and binds true to ack pointer.
 func (remote_master *RemoteMaster) StartGoBin(goBin *GoBin, ack *bool) error {
-	preparable, output, err := remote_master.master.Prepare(goBin.SourcePath, goBin.Name, "go", goBin.KeepAlive, goBin.Args)
 	*ack = true
+	var job BuildJob
+	if err := remote_master.SubmitGoBin(goBin, &job); err != nil {
+		return err
+	}
+	job, err := remote_master.master.WaitBuild(job.ID, -1)
 	if err != nil {
-		return fmt.Errorf("ERROR: %s OUTPUT: %s", err, string(output))
+		return err
+	}
+	if job.Status == BuildFailed {
+		return &BuildError{Err: job.Error, Output: job.Output}
+	}
+	return nil
+}
+
+// SubmitGoBin will queue the build of the binary described by goBin, which is started once built.
+// It returns an error in case there's any and binds the queued job to job.
+func (remote_master *RemoteMaster) SubmitGoBin(goBin *GoBin, job *BuildJob) error {
+	if err := checkProcConfig(goBin.LogFormat, goBin.LogSinks, goBin.HealthCheck, goBin.ReadinessCheck, goBin.MemoryLimit); err != nil {
+		return err
+	}
+	queued, err := remote_master.master.BuildProcess(&preparable.Preparable{
+		Name:            goBin.Name,
+		SourcePath:      goBin.SourcePath,
+		Language:        "go",
+		KeepAlive:       goBin.KeepAlive,
+		Args:            goBin.Args,
+		StopTimeout:     goBin.StopTimeout,
+		RestartPolicy:   goBin.RestartPolicy,
+		HealthCheck:     goBin.HealthCheck,
+		ReadinessCheck:  goBin.ReadinessCheck,
+		Env:             goBin.Env,
+		EnvFiles:        goBin.EnvFiles,
+		Cwd:             goBin.Cwd,
+		Setsid:          goBin.Setsid,
+		LogRotate:       goBin.LogRotate,
+		Capture:         goBin.Capture,
+		LogFormat:       goBin.LogFormat,
+		LogSinks:        goBin.LogSinks,
+		MetricsChildren: goBin.MetricsChildren,
+		MemoryLimit:     goBin.MemoryLimit,
+		Build:           goBin.Build,
+	})
+	*job = queued
+	return err
+}
+
+// StartCommand will start the binary or script described by command, without building anything,
+// and keep it alive if KeepAlive is set to true.
+// It returns an error and binds true to ack pointer.
+func (remote_master *RemoteMaster) StartCommand(command *Command, ack *bool) error {
+	if err := checkProcConfig(command.LogFormat, command.LogSinks, command.HealthCheck, command.ReadinessCheck, command.MemoryLimit); err != nil {
+		*ack = true
+		return err
+	}
+	preparable, err := remote_master.master.PrepareCommand(&preparable.Preparable{
+		Name:            command.Name,
+		Cmd:             command.Cmd,
+		KeepAlive:       command.KeepAlive,
+		Args:            command.Args,
+		StopTimeout:     command.StopTimeout,
+		RestartPolicy:   command.RestartPolicy,
+		HealthCheck:     command.HealthCheck,
+		ReadinessCheck:  command.ReadinessCheck,
+		Env:             command.Env,
+		EnvFiles:        command.EnvFiles,
+		Cwd:             command.Cwd,
+		Setsid:          command.Setsid,
+		LogRotate:       command.LogRotate,
+		Capture:         command.Capture,
+		LogFormat:       command.LogFormat,
+		LogSinks:        command.LogSinks,
+		MetricsChildren: command.MetricsChildren,
+		MemoryLimit:     command.MemoryLimit,
+	})
+	*ack = true
+	if _, ok := err.(*exec.Error); ok {
+		// The command was not found or can't be run.
+		return &ValidationError{err}
+	}
+	if err != nil {
+		return err
 	}
 	return remote_master.master.RunPreparable(preparable)
 }
 
+// checkProcConfig returns a ValidationError in case the log format, any of the log sinks,
+// the health check, the readiness check or the memory limit of a process is not valid.
+func checkProcConfig(format string, sinks []logs.SinkConfig, health process.HealthCheck, readiness process.ReadinessCheck, memory process.MemoryLimit) error {
+	if format != "" && format != logs.FormatText && format != logs.FormatJSON {
+		return &ValidationError{fmt.Errorf("Unknown log format %s. Use text or json.", format)}
+	}
+	for _, sink := range sinks {
+		if err := sink.Check(); err != nil {
+			return &ValidationError{err}
+		}
+	}
+	for _, check := range []func() error{health.Check, readiness.Check, memory.Check} {
+		if err := check(); err != nil {
+			return &ValidationError{err}
+		}
+	}
+	return nil
+}
+
 // RestartProcess will restart a process that was previously built using GoBin.
 // It returns an error in case there's any.
 func (remote_master *RemoteMaster) RestartProcess(procName string, ack *bool) error {
@@ -71,6 +293,78 @@ func (remote_master *RemoteMaster) RestartProcess(procName string, ack *bool) er
 	return remote_master.master.RestartProcess(procName)
 }
 
+// RestartProcessWithTimeout will restart process req.Name, killing it in case it does not stop
+// within req.Timeout, or its own StopTimeout if req.Timeout is zero.
+// It returns an error in case there's any.
+func (remote_master *RemoteMaster) RestartProcessWithTimeout(req *ProcStopRequest, ack *bool) error {
+	*ack = true
+	return remote_master.master.RestartProcessWithTimeout(req.Name, req.Timeout)
+}
+
+// RebuildProcess will build a process that was previously built using GoBin again and swap
+// its binary in case the build succeeds. The process is then restarted, unless it was stopped.
+// It returns an error, with the build output in case the build fails, and binds the build output to response.
+func (remote_master *RemoteMaster) RebuildProcess(req *ProcStopRequest, response *BuildResponse) error {
+	output, err := remote_master.master.RebuildProcess(req.Name, req.Timeout)
+	response.Output = string(output)
+	return err
+}
+
+// SubmitRebuild will queue a new build of a process that was previously built using GoBin. See
+// RebuildProcess.
+// It returns an error in case there's any and binds the queued job to job.
+func (remote_master *RemoteMaster) SubmitRebuild(req *ProcStopRequest, job *BuildJob) error {
+	queued, err := remote_master.master.SubmitRebuild(req.Name, req.Timeout)
+	*job = queued
+	return err
+}
+
+// GetBuild will bind the build job req.ID to job, after waiting up to req.Wait for it to finish.
+// It returns an error in case there's any.
+func (remote_master *RemoteMaster) GetBuild(req *BuildRequest, job *BuildJob) error {
+	found, err := remote_master.master.WaitBuild(req.ID, req.Wait)
+	*job = found
+	return err
+}
+
+// ListBuilds will bind the build jobs, oldest first, to response.
+// It returns an error in case there's any.
+func (remote_master *RemoteMaster) ListBuilds(req string, response *BuildsResponse) error {
+	req = ""
+	response.Jobs = remote_master.master.ListBuilds()
+	return nil
+}
+
+// RollbackProcess will run a process that was previously built using GoBin on one of its
+// previous versions, without building anything. The process is restarted, unless it was stopped.
+// It returns an error in case there's any.
+func (remote_master *RemoteMaster) RollbackProcess(req *RollbackRequest, ack *bool) error {
+	*ack = true
+	return remote_master.master.RollbackProcess(req.Name, req.Version, req.Timeout)
+}
+
+// ListVersions will list the built versions of a process that was previously built using GoBin.
+// It returns an error in case there's any.
+func (remote_master *RemoteMaster) ListVersions(procName string, response *VersionsResponse) error {
+	versions, current, err := remote_master.master.ListVersions(procName)
+	if err != nil {
+		return err
+	}
+	*response = VersionsResponse{
+		Current:  current,
+		Versions: versions,
+	}
+	return nil
+}
+
+// WaitReady will wait up to req.Timeout for process req.Name to be ready, or running in case it
+// has no readiness check.
+// It returns an error in case it is not.
+func (remote_master *RemoteMaster) WaitReady(req *ReadyRequest, ack *bool) error {
+	*ack = true
+	return remote_master.master.WaitReady(req.Name, req.Timeout)
+}
+
 // StartProcess will start a process that was previously built using GoBin.
 // It returns an error in case there's any.
 func (remote_master *RemoteMaster) StartProcess(procName string, ack *bool) error {
@@ -85,28 +379,70 @@ func (remote_master *RemoteMaster) StopProcess(procName string, ack *bool) error
 	return remote_master.master.StopProcess(procName)
 }
 
+// StopProcessWithTimeout will stop a process that is currently running. The process is killed in
+// case it does not exit within req.Timeout, or its own StopTimeout if req.Timeout is zero.
+// It returns an error in case there's any.
+func (remote_master *RemoteMaster) StopProcessWithTimeout(req *ProcStopRequest, ack *bool) error {
+	*ack = true
+	return remote_master.master.StopProcessWithTimeout(req.Name, req.Timeout)
+}
+
 // MonitStatus will query for the status of each process and bind it to procs pointer list.
 // It returns an error in case there's any.
 func (remote_master *RemoteMaster) MonitStatus(req string, response *ProcResponse) error {
 	req = ""
-	procs := remote_master.master.ListProcs()
+	master := remote_master.master
 	procsResponse := []*ProcDataResponse{}
-	for id := range procs {
-		proc := procs[id]
-		procData := &ProcDataResponse {
-			Name: proc.Identifier(),
-			Pid: proc.GetPid(),
-			Status: proc.GetStatus(),
-			KeepAlive: proc.ShouldKeepAlive(),
-		}
-		procsResponse = append(procsResponse, procData)
+	now := time.Now()
+	master.Lock()
+	for _, proc := range master.ListProcs() {
+		procsResponse = append(procsResponse, newProcDataResponse(proc, master.metrics[proc.Identifier()], now))
 	}
-	*response = ProcResponse {
+	master.Unlock()
+	*response = ProcResponse{
 		Procs: procsResponse,
 	}
 	return nil
 }
 
+// NOT thread safe method. Lock should be acquire before calling it.
+// newProcDataResponse copies the status and metrics of proc, so the response can be encoded
+// after the lock is released.
+func newProcDataResponse(proc process.ProcContainer, metrics *ProcMetrics, now time.Time) *ProcDataResponse {
+	status := *proc.GetStatus()
+	status.RecentRestarts = append([]time.Time(nil), status.RecentRestarts...)
+	procData := &ProcDataResponse{
+		Name:      proc.Identifier(),
+		Pid:       proc.GetPid(),
+		Status:    &status,
+		KeepAlive: proc.ShouldKeepAlive(),
+	}
+	if proc.IsAlive() {
+		// The last sample may be of the run before a restart.
+		if metrics != nil && metrics.pid == proc.GetPid() {
+			copied := *metrics
+			procData.Metrics = &copied
+		}
+		procData.Uptime = proc.GetStatus().Uptime(now)
+		procData.Children, _ = procfs.Descendants(proc.GetPid())
+	}
+	return procData
+}
+
+// SetEnv will set req.Vars on the environment of process req.Name. It takes effect on the next restart.
+// It returns an error in case there's any.
+func (remote_master *RemoteMaster) SetEnv(req *ProcEnvRequest, ack *bool) error {
+	*ack = true
+	return remote_master.master.SetEnv(req.Name, req.Vars)
+}
+
+// UnsetEnv will remove req.Keys from the environment of process req.Name. It takes effect on the next restart.
+// It returns an error in case there's any.
+func (remote_master *RemoteMaster) UnsetEnv(req *ProcEnvRequest, ack *bool) error {
+	*ack = true
+	return remote_master.master.UnsetEnv(req.Name, req.Keys)
+}
+
 // DeleteProcess will delete a process with name procName.
 // It returns an error in case there's any.
 func (remote_master *RemoteMaster) DeleteProcess(procName string, ack *bool) error {
@@ -114,36 +450,164 @@ func (remote_master *RemoteMaster) DeleteProcess(procName string, ack *bool) err
 	return remote_master.master.DeleteProcess(procName)
 }
 
+// RotateLogs will rotate the out and err files of process procName without restarting it.
+// It returns an error in case there's any.
+func (remote_master *RemoteMaster) RotateLogs(procName string, ack *bool) error {
+	*ack = true
+	return remote_master.master.RotateLogs(procName)
+}
+
+// ReadLogs will read the lines of the out or err file of process req.Name. Clients follow
+// the logs by calling it again with the returned offset.
+// It returns an error in case there's any.
+func (remote_master *RemoteMaster) ReadLogs(req *LogsRequest, response *LogsResponse) error {
+	lines, offset, err := remote_master.master.ReadLogs(req.Name, req.Stream, req.Offset, req.Lines, req.Grep)
+	if err != nil {
+		return err
+	}
+	*response = LogsResponse{
+		Lines:  lines,
+		Offset: offset,
+	}
+	return nil
+}
+
+// FlushLogs will empty the out and err files of process procName and delete their rotated files.
+// It returns an error in case there's any.
+func (remote_master *RemoteMaster) FlushLogs(procName string, ack *bool) error {
+	*ack = true
+	return remote_master.master.FlushLogs(procName)
+}
+
 // Stop will stop APM remote server.
 // It returns an error in case there's any.
 func (remote_master *RemoteMaster) Stop() error {
+	if remote_master.unixSocket != nil {
+		// Closing the listener also removes the socket file.
+		remote_master.unixSocket.Close()
+	}
 	return remote_master.master.Stop()
 }
 
-// StartRemoteMasterServer starts a remote APM server listening on dsn address and binding to
-// configFile.
+// StartRemoteMasterServer starts a remote APM server listening on the unix socket SocketFile
+// inside SysFolder and binding to configFile. It only listens on the dsn TCP address in case
+// dsn is not empty, with the TLS and tokens of the Remote section of configFile.
 // It returns a RemoteMaster instance.
 func StartRemoteMasterServer(dsn string, configFile string) *RemoteMaster {
+	return StartRemoteMasterServerWithConfig(dsn, configFile, nil)
+}
+
+// StartRemoteMasterServerWithConfig starts a remote APM server as StartRemoteMasterServer does.
+// TCP connections use the TLS and tokens of the Remote section of configFile, overridden by the
+// fields set on remoteConfig, which may be nil.
+// It returns a RemoteMaster instance.
+func StartRemoteMasterServerWithConfig(dsn string, configFile string, remoteConfig *RemoteConfig) *RemoteMaster {
 	remoteMaster := &RemoteMaster{
 		master: InitMaster(configFile),
 	}
+	remoteMaster.remoteConfig = remoteMaster.master.Remote.override(remoteConfig)
 	rpc.Register(remoteMaster)
-	l, e := net.Listen("tcp", dsn)
+	socketPath := remoteMaster.master.getSocketPath()
+	unixSocket, e := listenUnix(socketPath)
 	if e != nil {
 		log.Fatal("listen error: ", e)
 	}
-	go rpc.Accept(l)
+	remoteMaster.unixSocket = unixSocket
+	go acceptUnix(unixSocket, socketPath)
+	if dsn != "" {
+		l, e := remoteMaster.listenTCP(dsn)
+		if e != nil {
+			log.Fatal("listen error: ", e)
+		}
+		go remoteMaster.acceptTCP(l)
+	}
 	return remoteMaster
 }
 
+// listenTCP will listen on dsn, with TLS in case it is configured.
+// Returns a tuple with the listener and an error in case there's any.
+func (remote_master *RemoteMaster) listenTCP(dsn string) (net.Listener, error) {
+	tlsConfig, err := remote_master.remoteConfig.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		if remote_master.remoteConfig.hasTokens() {
+			log.Printf("TLS is disabled, tokens will be sent in clear text to %s", dsn)
+		}
+		return l, nil
+	}
+	return tls.NewListener(l, tlsConfig), nil
+}
+
+// acceptTCP will serve RPC requests on every connection accepted by l that sends a valid token.
+// Read only tokens can only call readOnlyMethods.
+func (remote_master *RemoteMaster) acceptTCP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("Stopped accepting connections on %s due to %s", l.Addr(), err)
+			return
+		}
+		go func() {
+			rpcConn, level, err := remote_master.remoteConfig.serverHandshake(conn)
+			if err != nil {
+				log.Printf("Rejected connection from %s due to %s", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			if level == accessReadOnly {
+				rpc.ServeCodec(&readOnlyCodec{ServerCodec: newGobServerCodec(rpcConn)})
+				return
+			}
+			rpc.ServeConn(rpcConn)
+		}()
+	}
+}
+
 // StartRemoteClient will start a remote client that can talk to a remote server that
-// is already running on dsn address.
+// is already running on dsn TCP address, without TLS nor token.
 // It returns an error in case there's any or it could not connect within the timeout.
 func StartRemoteClient(dsn string, timeout time.Duration) (*RemoteClient, error) {
-	conn, err := net.DialTimeout("tcp", dsn, timeout)
+	return DialRemoteClient("tcp", dsn, timeout, nil)
+}
+
+// DialRemoteClient will start a remote client that can talk to a remote server that is
+// already running on address. The network is either "unix" or "tcp". TCP connections are
+// secured by config, which may be nil. Unix sockets are secured by their file permissions.
+// It returns an error in case there's any or it could not connect within the timeout.
+func DialRemoteClient(network string, address string, timeout time.Duration, config *ClientConfig) (*RemoteClient, error) {
+	if network != "tcp" {
+		conn, err := net.DialTimeout(network, address, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return &RemoteClient{conn: rpc.NewClient(conn)}, nil
+	}
+	if config == nil {
+		config = &ClientConfig{}
+	}
+	tlsConfig, err := config.tlsConfig()
 	if err != nil {
 		return nil, err
 	}
+	var conn net.Conn
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, network, address, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout(network, address, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := config.clientHandshake(conn, timeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
 	return &RemoteClient{conn: rpc.NewClient(conn)}, nil
 }
 
@@ -164,16 +628,28 @@ func (client *RemoteClient) Resurrect() error {
 // StartGoBin is a wrapper that calls the remote StartsGoBin.
 // It returns an error in case there's any.
 func (client *RemoteClient) StartGoBin(sourcePath string, name string, keepAlive bool, args []string) error {
-	goBin := &GoBin{
+	return client.StartGoBinWithOptions(&GoBin{
 		SourcePath: sourcePath,
 		Name:       name,
 		KeepAlive:  keepAlive,
 		Args:       args,
-	}
+	})
+}
+
+// StartGoBinWithOptions is a wrapper that calls the remote StartsGoBin with every option of goBin.
+// It returns an error in case there's any.
+func (client *RemoteClient) StartGoBinWithOptions(goBin *GoBin) error {
 	var started bool
 	return client.conn.Call("RemoteMaster.StartGoBin", goBin, &started)
 }
 
+// StartCommand is a wrapper that calls the remote StartCommand.
+// It returns an error in case there's any.
+func (client *RemoteClient) StartCommand(command *Command) error {
+	var started bool
+	return client.conn.Call("RemoteMaster.StartCommand", command, &started)
+}
+
 // RestartProcess is a wrapper that calls the remote RestartProcess.
 // It returns an error in case there's any.
 func (client *RemoteClient) RestartProcess(procName string) error {
@@ -181,6 +657,96 @@ func (client *RemoteClient) RestartProcess(procName string) error {
 	return client.conn.Call("RemoteMaster.RestartProcess", procName, &started)
 }
 
+// RestartProcessWithTimeout is a wrapper that calls the remote RestartProcessWithTimeout.
+// It returns an error in case there's any.
+func (client *RemoteClient) RestartProcessWithTimeout(procName string, timeout time.Duration) error {
+	var started bool
+	req := &ProcStopRequest{
+		Name:    procName,
+		Timeout: timeout,
+	}
+	return client.conn.Call("RemoteMaster.RestartProcessWithTimeout", req, &started)
+}
+
+// RebuildProcess is a wrapper that calls the remote RebuildProcess.
+// It returns a tuple with the build output and an error in case there's any.
+func (client *RemoteClient) RebuildProcess(procName string, timeout time.Duration) (string, error) {
+	var response BuildResponse
+	req := &ProcStopRequest{
+		Name:    procName,
+		Timeout: timeout,
+	}
+	err := client.conn.Call("RemoteMaster.RebuildProcess", req, &response)
+	return response.Output, err
+}
+
+// SubmitGoBin is a wrapper that calls the remote SubmitGoBin.
+// It returns a tuple with the queued job and an error in case there's any.
+func (client *RemoteClient) SubmitGoBin(goBin *GoBin) (BuildJob, error) {
+	var job BuildJob
+	err := client.conn.Call("RemoteMaster.SubmitGoBin", goBin, &job)
+	return job, err
+}
+
+// SubmitRebuild is a wrapper that calls the remote SubmitRebuild.
+// It returns a tuple with the queued job and an error in case there's any.
+func (client *RemoteClient) SubmitRebuild(procName string, timeout time.Duration) (BuildJob, error) {
+	var job BuildJob
+	req := &ProcStopRequest{
+		Name:    procName,
+		Timeout: timeout,
+	}
+	err := client.conn.Call("RemoteMaster.SubmitRebuild", req, &job)
+	return job, err
+}
+
+// GetBuild is a wrapper that calls the remote GetBuild.
+// It returns a tuple with the job and an error in case there's any.
+func (client *RemoteClient) GetBuild(id int, wait time.Duration) (BuildJob, error) {
+	var job BuildJob
+	err := client.conn.Call("RemoteMaster.GetBuild", &BuildRequest{ID: id, Wait: wait}, &job)
+	return job, err
+}
+
+// ListBuilds is a wrapper that calls the remote ListBuilds.
+// It returns a tuple with the build jobs and an error in case there's any.
+func (client *RemoteClient) ListBuilds() ([]BuildJob, error) {
+	var response BuildsResponse
+	err := client.conn.Call("RemoteMaster.ListBuilds", "", &response)
+	return response.Jobs, err
+}
+
+// RollbackProcess is a wrapper that calls the remote RollbackProcess.
+// It returns an error in case there's any.
+func (client *RemoteClient) RollbackProcess(procName string, version int, timeout time.Duration) error {
+	var started bool
+	req := &RollbackRequest{
+		Name:    procName,
+		Version: version,
+		Timeout: timeout,
+	}
+	return client.conn.Call("RemoteMaster.RollbackProcess", req, &started)
+}
+
+// ListVersions is a wrapper that calls the remote ListVersions.
+// It returns a tuple with the versions and an error in case there's any.
+func (client *RemoteClient) ListVersions(procName string) (VersionsResponse, error) {
+	var response VersionsResponse
+	err := client.conn.Call("RemoteMaster.ListVersions", procName, &response)
+	return response, err
+}
+
+// WaitReady is a wrapper that calls the remote WaitReady.
+// It returns an error in case the process is not ready within timeout.
+func (client *RemoteClient) WaitReady(procName string, timeout time.Duration) error {
+	var ready bool
+	req := &ReadyRequest{
+		Name:    procName,
+		Timeout: timeout,
+	}
+	return client.conn.Call("RemoteMaster.WaitReady", req, &ready)
+}
+
 // StartProcess is a wrapper that calls the remote StartProcess.
 // It returns an error in case there's any.
 func (client *RemoteClient) StartProcess(procName string) error {
@@ -195,6 +761,17 @@ func (client *RemoteClient) StopProcess(procName string) error {
 	return client.conn.Call("RemoteMaster.StopProcess", procName, &stopped)
 }
 
+// StopProcessWithTimeout is a wrapper that calls the remote StopProcessWithTimeout.
+// It returns an error in case there's any.
+func (client *RemoteClient) StopProcessWithTimeout(procName string, timeout time.Duration) error {
+	var stopped bool
+	req := &ProcStopRequest{
+		Name:    procName,
+		Timeout: timeout,
+	}
+	return client.conn.Call("RemoteMaster.StopProcessWithTimeout", req, &stopped)
+}
+
 // DeleteProcess is a wrapper that calls the remote DeleteProcess.
 // It returns an error in case there's any.
 func (client *RemoteClient) DeleteProcess(procName string) error {
@@ -202,10 +779,57 @@ func (client *RemoteClient) DeleteProcess(procName string) error {
 	return client.conn.Call("RemoteMaster.DeleteProcess", procName, &deleted)
 }
 
+// SetEnv is a wrapper that calls the remote SetEnv.
+// It returns an error in case there's any.
+func (client *RemoteClient) SetEnv(procName string, vars map[string]string) error {
+	var set bool
+	req := &ProcEnvRequest{
+		Name: procName,
+		Vars: vars,
+	}
+	return client.conn.Call("RemoteMaster.SetEnv", req, &set)
+}
+
+// UnsetEnv is a wrapper that calls the remote UnsetEnv.
+// It returns an error in case there's any.
+func (client *RemoteClient) UnsetEnv(procName string, keys []string) error {
+	var unset bool
+	req := &ProcEnvRequest{
+		Name: procName,
+		Keys: keys,
+	}
+	return client.conn.Call("RemoteMaster.UnsetEnv", req, &unset)
+}
+
+// RotateLogs is a wrapper that calls the remote RotateLogs.
+// It returns an error in case there's any.
+func (client *RemoteClient) RotateLogs(procName string) error {
+	var rotated bool
+	return client.conn.Call("RemoteMaster.RotateLogs", procName, &rotated)
+}
+
+// FlushLogs is a wrapper that calls the remote FlushLogs.
+// It returns an error in case there's any.
+func (client *RemoteClient) FlushLogs(procName string) error {
+	var flushed bool
+	return client.conn.Call("RemoteMaster.FlushLogs", procName, &flushed)
+}
+
+// ReadLogs is a wrapper that calls the remote ReadLogs.
+// It returns a tuple with the lines, the offset to read the next lines from and an error in case there's any.
+func (client *RemoteClient) ReadLogs(req *LogsRequest) ([]string, int64, error) {
+	var response LogsResponse
+	err := client.conn.Call("RemoteMaster.ReadLogs", req, &response)
+	return response.Lines, response.Offset, err
+}
+
 // MonitStatus is a wrapper that calls the remote MonitStatus.
 // It returns a tuple with a list of process and an error in case there's any.
 func (client *RemoteClient) MonitStatus() (ProcResponse, error) {
 	var response *ProcResponse
 	err := client.conn.Call("RemoteMaster.MonitStatus", "", &response)
-	return *response, err
+	if err != nil {
+		return ProcResponse{}, err
+	}
+	return *response, nil
 }
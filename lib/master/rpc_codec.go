@@ -0,0 +1,86 @@
+package master
+
+import "bufio"
+import "encoding/gob"
+import "io"
+import "net/rpc"
+import "sync"
+
+// gobServerCodec is the gob codec net/rpc uses by default, which is not exported.
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func newGobServerCodec(conn io.ReadWriteCloser) *gobServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+	}
+}
+
+func (codec *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return codec.dec.Decode(r)
+}
+
+func (codec *gobServerCodec) ReadRequestBody(body interface{}) error {
+	return codec.dec.Decode(body)
+}
+
+func (codec *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := codec.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := codec.enc.Encode(body); err != nil {
+		return err
+	}
+	return codec.encBuf.Flush()
+}
+
+func (codec *gobServerCodec) Close() error {
+	return codec.rwc.Close()
+}
+
+// readOnlyCodec answers the calls to methods missing from readOnlyMethods with
+// ErrPermissionDenied, without ever handing them to the RPC server.
+type readOnlyCodec struct {
+	rpc.ServerCodec
+	// The RPC server writes replies from other goroutines while denied calls are answered
+	// from ReadRequestHeader.
+	sending sync.Mutex
+}
+
+// ReadRequestHeader will read the next allowed call, denying the others on the way.
+func (codec *readOnlyCodec) ReadRequestHeader(r *rpc.Request) error {
+	for {
+		if err := codec.ServerCodec.ReadRequestHeader(r); err != nil {
+			return err
+		}
+		if readOnlyMethods[r.ServiceMethod] {
+			return nil
+		}
+		// Discard the arguments of the denied call.
+		if err := codec.ServerCodec.ReadRequestBody(nil); err != nil {
+			return err
+		}
+		response := &rpc.Response{
+			ServiceMethod: r.ServiceMethod,
+			Seq:           r.Seq,
+			Error:         ErrPermissionDenied.Error(),
+		}
+		if err := codec.WriteResponse(response, struct{}{}); err != nil {
+			return err
+		}
+	}
+}
+
+func (codec *readOnlyCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	codec.sending.Lock()
+	defer codec.sending.Unlock()
+	return codec.ServerCodec.WriteResponse(r, body)
+}
@@ -0,0 +1,97 @@
+package master
+
+import "fmt"
+import "net"
+import "net/rpc"
+import "os"
+import "path"
+import "syscall"
+import "log"
+
+import "github.com/topfreegames/apm/lib/procfs"
+
+// SocketFile is the name of the unix socket the remote master listens on, inside SysFolder.
+const SocketFile = "apm.sock"
+
+// socketMode lets the APM user and its group use the socket. Everybody else is denied
+// by the file system.
+const socketMode = 0660
+
+// listenUnix will listen on a unix socket at socketPath, replacing any stale socket left
+// behind by a previous instance.
+// Returns a tuple with the listener and an error in case there's any.
+func listenUnix(socketPath string) (*net.UnixListener, error) {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, socketMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// acceptUnix will serve RPC requests on every connection accepted by l whose peer is
+// allowed to use the socket at socketPath.
+func acceptUnix(l *net.UnixListener, socketPath string) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			log.Printf("Stopped accepting connections on %s due to %s", socketPath, err)
+			return
+		}
+		if err := checkPeer(conn, socketPath); err != nil {
+			log.Printf("Rejected connection on %s due to %s", socketPath, err)
+			conn.Close()
+			continue
+		}
+		go rpc.ServeConn(conn)
+	}
+}
+
+// checkPeer will make sure the process on the other side of conn runs as root, as the APM
+// user or, when the socket mode lets its group in, as a member of the socket group, either
+// as its primary group or as one of its supplementary groups.
+// Returns an error in case the peer is not allowed.
+func checkPeer(conn *net.UnixConn, socketPath string) error {
+	pid, uid, gid, err := peerCredentials(conn)
+	if err == errPeerCredentialsUnsupported {
+		// Only the socket file permissions protect it on this platform.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if uid == 0 || uid == os.Geteuid() {
+		return nil
+	}
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || info.Mode().Perm()&0060 != 0060 {
+		return fmt.Errorf("uid %d is not allowed", uid)
+	}
+	if int(stat.Gid) == gid {
+		return nil
+	}
+	groups, err := procfs.ReadGroups(pid)
+	if err != nil {
+		return fmt.Errorf("uid %d is not allowed, its groups can't be read due to %s", uid, err)
+	}
+	for _, group := range groups {
+		if group == int(stat.Gid) {
+			return nil
+		}
+	}
+	return fmt.Errorf("uid %d is not allowed", uid)
+}
+
+func (master *Master) getSocketPath() string {
+	return path.Join(master.SysFolder, SocketFile)
+}
@@ -0,0 +1,128 @@
+package preparable
+
+import "errors"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "strings"
+
+import "github.com/topfreegames/apm/lib/utils"
+
+// BuildConfig defines how the binary of a Go project is built. It is saved along with the
+// process, so the same build can be run again.
+type BuildConfig struct {
+	Env     map[string]string `json:"env"`     // Env holds extra environment variables for the build. (Ex: CGO_ENABLED=0)
+	Tags    []string          `json:"tags"`    // Tags are the build tags passed to go build -tags.
+	LDFlags string            `json:"ldflags"` // LDFlags are passed to go build -ldflags. (Ex: -X main.version=1.2.0)
+	Args    []string          `json:"args"`    // Args are extra go build args. (Ex: -trimpath)
+	Command string            `json:"command"` // Command is run with sh from the source directory before go build. (Ex: make build)
+	Output  string            `json:"output"`  // Output is the binary written by Command, relative to the source directory. It replaces go build.
+	Keep    int               `json:"keep"`    // Keep is how many built versions are kept. Zero means DefaultKeepVersions.
+}
+
+// build runs the build of the preparable, writing the binary to binPath.
+// Returns the output of the build commands.
+func (preparable *Preparable) build(binPath string) ([]byte, error) {
+	config := preparable.Build
+	if config.Output != "" && config.Command == "" {
+		return nil, errors.New("A build output needs a build command.")
+	}
+	if config.Command == "" {
+		return preparable.goBuildCommand(binPath).CombinedOutput()
+	}
+	if !preparable.isSourceDir() {
+		return nil, errors.New("A build command needs the source path to be a directory.")
+	}
+	cmd := exec.Command("sh", "-c", config.Command)
+	cmd.Dir = preparable.SourcePath
+	cmd.Env = config.environ(nil)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return output, err
+	}
+	if config.Output != "" {
+		outputPath := config.Output
+		if !filepath.IsAbs(outputPath) {
+			outputPath = filepath.Join(preparable.SourcePath, outputPath)
+		}
+		return output, utils.CopyFile(outputPath, binPath, 0755)
+	}
+	goOutput, err := preparable.goBuildCommand(binPath).CombinedOutput()
+	return append(output, goOutput...), err
+}
+
+// goBuildCommand returns the go build command that writes the binary of SourcePath to binPath.
+// Modules are built from their root, so go.mod and the vendor folder are honored.
+func (preparable *Preparable) goBuildCommand(binPath string) *exec.Cmd {
+	dir := ""
+	pkg := preparable.SourcePath + "/."
+	args := []string{"build", "-o", binPath}
+	env := map[string]string{}
+	if preparable.isSourceDir() {
+		moduleRoot := findModuleRoot(preparable.SourcePath)
+		if moduleRoot == "" {
+			dir, pkg = preparable.SourcePath, "."
+			env["GO111MODULE"] = "off"
+		} else {
+			rel, _ := filepath.Rel(moduleRoot, preparable.SourcePath)
+			dir, pkg = moduleRoot, "./"+filepath.ToSlash(rel)
+			env["GO111MODULE"] = "on"
+			if _, err := os.Stat(filepath.Join(moduleRoot, "vendor", "modules.txt")); err == nil {
+				args = append(args, "-mod=vendor")
+			}
+		}
+	}
+	args = append(args, preparable.Build.flags()...)
+	cmd := exec.Command("go", append(args, pkg)...)
+	cmd.Dir = dir
+	cmd.Env = preparable.Build.environ(env)
+	return cmd
+}
+
+// isSourceDir returns true in case SourcePath is the absolute path of a directory instead of an import path.
+func (preparable *Preparable) isSourceDir() bool {
+	if !filepath.IsAbs(preparable.SourcePath) {
+		return false
+	}
+	info, err := os.Stat(preparable.SourcePath)
+	return err == nil && info.IsDir()
+}
+
+// flags returns the go build flags set by config.
+func (config BuildConfig) flags() []string {
+	flags := []string{}
+	if len(config.Tags) > 0 {
+		flags = append(flags, "-tags", strings.Join(config.Tags, ","))
+	}
+	if config.LDFlags != "" {
+		flags = append(flags, "-ldflags", config.LDFlags)
+	}
+	return append(flags, config.Args...)
+}
+
+// environ returns the APM environment overridden by vars and then by the build Env.
+func (config BuildConfig) environ(vars map[string]string) []string {
+	merged := make(map[string]string)
+	for key, value := range vars {
+		merged[key] = value
+	}
+	for key, value := range config.Env {
+		merged[key] = value
+	}
+	return utils.MergeEnv(os.Environ(), merged)
+}
+
+// findModuleRoot returns the closest folder to dir, dir included, that has a go.mod file, or an
+// empty string in case there's none.
+func findModuleRoot(dir string) string {
+	for {
+		if info, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil && !info.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
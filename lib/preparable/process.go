@@ -1,12 +1,18 @@
 package preparable
 
+import "errors"
+import "os"
 import "os/exec"
+import "path/filepath"
 import "strings"
+import "time"
 
+import "github.com/topfreegames/apm/lib/logs"
 import "github.com/topfreegames/apm/lib/process"
 
 type ProcPreparable interface {
 	PrepareBin() ([]byte, error)
+	PrepareCommand() error
 	Start() (process.ProcContainer, error)
 	getPath() string
 	Identifier() string
@@ -15,36 +21,77 @@ type ProcPreparable interface {
 	getOutPath() string
 	getErrPath() string
 }
+
 // ProcPreparable is a preparable with all the necessary informations to run
-// a process. To actually run a process, call the Start() method.
+// a process. To actually run a process, call the Start() method. Each build is kept as a
+// Version, and Version is the one the process runs.
 type Preparable struct {
-	Name       string
-	SourcePath string
-	Cmd        string
-	SysFolder  string
-	Language   string
-	KeepAlive  bool
-	Args       []string
+	Name            string
+	SourcePath      string
+	Cmd             string
+	SysFolder       string
+	Language        string
+	KeepAlive       bool
+	Args            []string
+	StopTimeout     time.Duration
+	RestartPolicy   process.RestartPolicy
+	HealthCheck     process.HealthCheck
+	ReadinessCheck  process.ReadinessCheck
+	Env             map[string]string
+	EnvFiles        []string
+	Cwd             string
+	Setsid          bool
+	LogRotate       logs.RotateConfig
+	Capture         bool
+	LogFormat       string
+	LogSinks        []logs.SinkConfig
+	MetricsChildren bool
+	MemoryLimit     process.MemoryLimit
+	Build           BuildConfig
+	Versions        []Version
+	Version         int
 }
 
 // PrepareBin will compile the Golang project from SourcePath and populate Cmd with the proper
-// command for the process to be executed.
+// command for the process to be executed. SourcePath is either an import path, built from the APM
+// working directory, or the absolute path of a directory: a module root, a package inside a module
+// or a directory without go.mod, which is built as is with GOPATH. See BuildConfig to customize the build.
 // Returns the compile command output.
 func (preparable *Preparable) PrepareBin() ([]byte, error) {
 	// Remove the last character '/' if present
 	if preparable.SourcePath[len(preparable.SourcePath)-1] == '/' {
 		preparable.SourcePath = strings.TrimSuffix(preparable.SourcePath, "/")
 	}
-	cmd := ""
-	cmdArgs := []string{}
-	binPath := preparable.getBinPath()
-	if preparable.Language == "go" {
-		cmd = "go"
-		cmdArgs = []string{"build", "-o", binPath, preparable.SourcePath + "/."}
+	if preparable.Language != "go" {
+		return nil, errors.New("Unknown language " + preparable.Language + ".")
+	}
+	binPath, err := filepath.Abs(preparable.getBinPath())
+	if err != nil {
+		return nil, err
+	}
+	version, output, err := preparable.BuildVersion(preparable.NextVersion())
+	if err != nil {
+		return output, err
 	}
 
-	preparable.Cmd = preparable.getBinPath()
-	return exec.Command(cmd, cmdArgs...).Output()
+	preparable.Cmd = binPath
+	return output, preparable.Install(version)
+}
+
+// PrepareCommand will resolve Cmd to an absolute executable path and create the process folder
+// that keeps its pid, out and err files. Unlike PrepareBin, nothing is compiled, so Cmd can be any
+// prebuilt binary or script.
+// Returns an error in case there's any.
+func (preparable *Preparable) PrepareCommand() error {
+	cmd, err := exec.LookPath(preparable.Cmd)
+	if err != nil {
+		return err
+	}
+	preparable.Cmd, err = filepath.Abs(cmd)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(preparable.getPath(), 0777)
 }
 
 // Start will execute the process based on the information presented on the preparable.
@@ -53,15 +100,29 @@ func (preparable *Preparable) PrepareBin() ([]byte, error) {
 // Returns a tuple with the process and an error in case there's any.
 func (preparable *Preparable) Start() (process.ProcContainer, error) {
 	proc := &process.Proc{
-		Name:      preparable.Name,
-		Cmd:       preparable.Cmd,
-		Args:      preparable.Args,
-		Path:      preparable.getPath(),
-		Pidfile:   preparable.getPidPath(),
-		Outfile:   preparable.getOutPath(),
-		Errfile:   preparable.getErrPath(),
-		KeepAlive: preparable.KeepAlive,
-		Status:    &process.ProcStatus{},
+		Name:            preparable.Name,
+		Cmd:             preparable.Cmd,
+		Args:            preparable.Args,
+		Path:            preparable.getPath(),
+		Pidfile:         preparable.getPidPath(),
+		Outfile:         preparable.getOutPath(),
+		Errfile:         preparable.getErrPath(),
+		KeepAlive:       preparable.KeepAlive,
+		StopTimeout:     preparable.StopTimeout,
+		RestartPolicy:   preparable.RestartPolicy,
+		HealthCheck:     preparable.HealthCheck,
+		ReadinessCheck:  preparable.ReadinessCheck,
+		Env:             preparable.Env,
+		EnvFiles:        preparable.EnvFiles,
+		Cwd:             preparable.Cwd,
+		Setsid:          preparable.Setsid,
+		LogRotate:       preparable.LogRotate,
+		Capture:         preparable.Capture,
+		LogFormat:       preparable.LogFormat,
+		LogSinks:        preparable.LogSinks,
+		MetricsChildren: preparable.MetricsChildren,
+		MemoryLimit:     preparable.MemoryLimit,
+		Status:          &process.ProcStatus{},
 	}
 
 	err := proc.Start()
@@ -0,0 +1,179 @@
+package preparable
+
+import "crypto/sha256"
+import "encoding/hex"
+import "fmt"
+import "io"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "time"
+
+import "github.com/topfreegames/apm/lib/utils"
+
+// DefaultKeepVersions is how many built versions are kept when Build.Keep is not set.
+const DefaultKeepVersions = 5
+
+// Version is a binary built from the source of a process.
+type Version struct {
+	ID       int       `json:"id"`       // ID is the build number, starting at 1.
+	BuiltAt  time.Time `json:"built_at"` // BuiltAt is when the build started.
+	Revision string    `json:"revision"` // Revision is the git commit of the source, with a -dirty suffix for uncommitted changes. Empty when unknown.
+	Checksum string    `json:"checksum"` // Checksum is the SHA-256 of the binary.
+	Path     string    `json:"path"`     // Path is where the binary is kept.
+}
+
+// NextVersion will find the ID of the next build.
+// Returns the ID.
+func (preparable *Preparable) NextVersion() int {
+	next := 1
+	for _, version := range preparable.Versions {
+		if version.ID >= next {
+			next = version.ID + 1
+		}
+	}
+	return next
+}
+
+// BuildVersion will build the version id of the binary to its own file, leaving the binary the
+// process runs alone. Call Install to run it.
+// Returns a tuple with the version, the compile command output and an error in case there's any.
+func (preparable *Preparable) BuildVersion(id int) (Version, []byte, error) {
+	path, err := filepath.Abs(preparable.getVersionPath(id))
+	if err != nil {
+		return Version{}, nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return Version{}, nil, err
+	}
+	os.Remove(path)
+	builtAt := time.Now()
+	output, err := preparable.build(path)
+	if err != nil {
+		os.Remove(path)
+		return Version{}, output, err
+	}
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		os.Remove(path)
+		return Version{}, output, err
+	}
+	return Version{
+		ID:       id,
+		BuiltAt:  builtAt,
+		Revision: preparable.revision(),
+		Checksum: checksum,
+		Path:     path,
+	}, output, nil
+}
+
+// Install will make version the binary the process runs, atomically replacing the current one, so
+// a running process is not affected until it restarts. The oldest versions past Build.Keep are
+// deleted, except for the installed one.
+// Returns an error in case there's any.
+func (preparable *Preparable) Install(version Version) error {
+	checksum, err := fileChecksum(version.Path)
+	if err != nil {
+		return err
+	}
+	if checksum != version.Checksum {
+		return fmt.Errorf("Version %d does not match its checksum.", version.ID)
+	}
+	binPath, err := filepath.Abs(preparable.getBinPath())
+	if err != nil {
+		return err
+	}
+	stagingPath := binPath + ".staging"
+	if err := utils.CopyFile(version.Path, stagingPath, 0755); err != nil {
+		os.Remove(stagingPath)
+		return err
+	}
+	if err := os.Rename(stagingPath, binPath); err != nil {
+		os.Remove(stagingPath)
+		return err
+	}
+	if _, ok := preparable.GetVersion(version.ID); !ok {
+		preparable.Versions = append(preparable.Versions, version)
+	}
+	preparable.Version = version.ID
+	preparable.pruneVersions()
+	return nil
+}
+
+// GetVersion will find the version with the given ID.
+// Returns a tuple with the version and false in case there is no such version.
+func (preparable *Preparable) GetVersion(id int) (Version, bool) {
+	for _, version := range preparable.Versions {
+		if version.ID == id {
+			return version, true
+		}
+	}
+	return Version{}, false
+}
+
+// PreviousVersion will find the newest version built before the one the process runs.
+// Returns a tuple with the version and false in case there is none.
+func (preparable *Preparable) PreviousVersion() (Version, bool) {
+	previous := Version{}
+	for _, version := range preparable.Versions {
+		if version.ID < preparable.Version && version.ID > previous.ID {
+			previous = version
+		}
+	}
+	return previous, previous.ID > 0
+}
+
+// pruneVersions deletes the oldest versions past Build.Keep, keeping the installed one.
+func (preparable *Preparable) pruneVersions() {
+	keep := preparable.Build.Keep
+	if keep <= 0 {
+		keep = DefaultKeepVersions
+	}
+	kept := []Version{}
+	for i, version := range preparable.Versions {
+		newer := len(preparable.Versions) - i - 1
+		if newer < keep || version.ID == preparable.Version {
+			kept = append(kept, version)
+			continue
+		}
+		os.Remove(version.Path)
+	}
+	preparable.Versions = kept
+}
+
+// revision returns the git commit of SourcePath, or an empty string in case it is unknown.
+func (preparable *Preparable) revision() string {
+	if !preparable.isSourceDir() {
+		return ""
+	}
+	head, err := exec.Command("git", "-C", preparable.SourcePath, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	revision := strings.TrimSpace(string(head))
+	changes, err := exec.Command("git", "-C", preparable.SourcePath, "status", "--porcelain").Output()
+	if err == nil && len(strings.TrimSpace(string(changes))) > 0 {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+func (preparable *Preparable) getVersionPath(id int) string {
+	return preparable.getPath() + "/versions/" + preparable.Name + "." + strconv.Itoa(id)
+}
+
+// fileChecksum returns the hex SHA-256 of the file at path.
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,199 @@
+package process
+
+import "bytes"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "net"
+import "net/http"
+import "os/exec"
+import "strings"
+import "syscall"
+import "time"
+
+import "github.com/topfreegames/apm/lib/utils"
+
+const (
+	// HealthCheckHTTP probes are healthy when a GET to URL answers with the expected status.
+	HealthCheckHTTP = "http"
+	// HealthCheckTCP probes are healthy when a connection to Address is accepted.
+	HealthCheckTCP = "tcp"
+	// HealthCheckExec probes are healthy when Command exits with 0.
+	HealthCheckExec = "exec"
+)
+
+const (
+	// DefaultHealthInterval is how often a process is probed.
+	DefaultHealthInterval = 10 * time.Second
+	// DefaultHealthTimeout is how long a probe may take before it counts as failed.
+	DefaultHealthTimeout = 5 * time.Second
+	// DefaultHealthFailureThreshold is how many probes in a row must fail before the process is restarted.
+	DefaultHealthFailureThreshold = 3
+)
+
+// maxHealthOutput is how much of the output of a failed exec probe is kept as its error.
+const maxHealthOutput = 200
+
+// HealthCheck defines a liveness probe run while a process is running. A process whose probe
+// fails FailureThreshold times in a row is unhealthy and gets restarted. An empty Type disables
+// it, and zero values mean the defaults above.
+type HealthCheck struct {
+	Type             string        `json:"type"`              // Type is http, tcp or exec.
+	URL              string        `json:"url"`               // URL is requested by http probes.
+	Status           int           `json:"status"`            // Status is the status expected by http probes. Zero accepts any 2xx or 3xx status.
+	Address          string        `json:"address"`           // Address is host:port, connected to by tcp probes.
+	Command          string        `json:"command"`           // Command is run with sh by exec probes, from the process cwd and with its environment.
+	Interval         time.Duration `json:"interval"`          // Interval is the time between two probes.
+	Timeout          time.Duration `json:"timeout"`           // Timeout is how long a probe may take.
+	FailureThreshold int           `json:"failure_threshold"` // FailureThreshold is how many probes in a row must fail before the process is restarted.
+	InitialDelay     time.Duration `json:"initial_delay"`     // InitialDelay is how long to wait after the process starts before the first probe.
+}
+
+// Enabled will check whether the health check has a probe.
+// Returns true in case it does.
+func (check HealthCheck) Enabled() bool {
+	return check.Type != ""
+}
+
+// MarshalJSON will encode the health check with its durations as strings such as 1m30s.
+// Returns a tuple with the JSON object and an error in case there's any.
+func (check HealthCheck) MarshalJSON() ([]byte, error) {
+	type plain HealthCheck
+	return json.Marshal(&struct {
+		plain
+		Interval     utils.Duration `json:"interval"`
+		Timeout      utils.Duration `json:"timeout"`
+		InitialDelay utils.Duration `json:"initial_delay"`
+	}{plain(check), utils.Duration(check.Interval), utils.Duration(check.Timeout), utils.Duration(check.InitialDelay)})
+}
+
+// UnmarshalJSON will decode the health check, with its durations as strings such as 1m30s or
+// numbers of nanoseconds.
+// Returns an error in case there's any.
+func (check *HealthCheck) UnmarshalJSON(data []byte) error {
+	type plain HealthCheck
+	return json.Unmarshal(data, &struct {
+		*plain
+		Interval     *utils.Duration `json:"interval"`
+		Timeout      *utils.Duration `json:"timeout"`
+		InitialDelay *utils.Duration `json:"initial_delay"`
+	}{(*plain)(check), (*utils.Duration)(&check.Interval), (*utils.Duration)(&check.Timeout), (*utils.Duration)(&check.InitialDelay)})
+}
+
+// Check will validate the health check.
+// Returns an error in case it is not valid.
+func (check HealthCheck) Check() error {
+	switch check.Type {
+	case "":
+		return nil
+	case HealthCheckHTTP:
+		if !strings.HasPrefix(check.URL, "http://") && !strings.HasPrefix(check.URL, "https://") {
+			return fmt.Errorf("Invalid health check URL %s. Use http:// or https://.", check.URL)
+		}
+	case HealthCheckTCP:
+		if _, _, err := net.SplitHostPort(check.Address); err != nil {
+			return fmt.Errorf("Invalid health check address %s. Use host:port.", check.Address)
+		}
+	case HealthCheckExec:
+		if check.Command == "" {
+			return errors.New("The exec health check needs a command.")
+		}
+	default:
+		return fmt.Errorf("Unknown health check type %s. Use http, tcp or exec.", check.Type)
+	}
+	if check.Interval < 0 || check.Timeout < 0 || check.InitialDelay < 0 || check.FailureThreshold < 0 {
+		return errors.New("Health check durations and threshold can't be negative.")
+	}
+	return nil
+}
+
+// Probe will run the probe once. Exec probes run from dir with env.
+// Returns an error telling why the process is not healthy, or nil in case it is.
+func (check HealthCheck) Probe(dir string, env []string) error {
+	check = check.withDefaults()
+	switch check.Type {
+	case HealthCheckHTTP:
+		return check.probeHTTP()
+	case HealthCheckTCP:
+		conn, err := net.DialTimeout("tcp", check.Address, check.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case HealthCheckExec:
+		return check.probeExec(dir, env)
+	}
+	return fmt.Errorf("Unknown health check type %s.", check.Type)
+}
+
+func (check HealthCheck) probeHTTP() error {
+	client := &http.Client{
+		Timeout: check.Timeout,
+		// Redirects are answers too, they are checked against Status like any other.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	response, err := client.Get(check.URL)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if check.Status == 0 && response.StatusCode >= 200 && response.StatusCode < 400 {
+		return nil
+	}
+	if response.StatusCode == check.Status {
+		return nil
+	}
+	return fmt.Errorf("GET %s answered %s", check.URL, response.Status)
+}
+
+// probeExec runs Command in its own process group, so the whole group is killed when it
+// does not exit within Timeout.
+func (check HealthCheck) probeExec(dir string, env []string) error {
+	var output bytes.Buffer
+	cmd := exec.Command("sh", "-c", check.Command)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			return nil
+		}
+		message := strings.TrimSpace(output.String())
+		if len(message) > maxHealthOutput {
+			message = message[len(message)-maxHealthOutput:]
+		}
+		if message == "" {
+			return err
+		}
+		return fmt.Errorf("%s: %s", err, message)
+	case <-time.After(check.Timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return fmt.Errorf("%s timed out after %s", check.Command, check.Timeout)
+	}
+}
+
+func (check HealthCheck) withDefaults() HealthCheck {
+	if check.Interval <= 0 {
+		check.Interval = DefaultHealthInterval
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = DefaultHealthTimeout
+	}
+	if check.FailureThreshold <= 0 {
+		check.FailureThreshold = DefaultHealthFailureThreshold
+	}
+	return check
+}
@@ -0,0 +1,41 @@
+package process
+
+import "errors"
+
+// DefaultMemoryLimitSamples is how many samples in a row must be above the limit before the
+// process is restarted.
+const DefaultMemoryLimitSamples = 3
+
+// MemoryLimitReason is the restart reason of processes restarted for using too much memory.
+const MemoryLimitReason = "memory limit exceeded"
+
+// MemoryLimit restarts a process gracefully once its resident memory stays above MaxMemory.
+// It is checked each time the process metrics are sampled. A zero MaxMemory disables it.
+type MemoryLimit struct {
+	MaxMemory uint64 `json:"max_memory"` // MaxMemory is the highest resident memory allowed, in bytes.
+	Children  bool   `json:"children"`   // Children adds the memory of the descendants of the process.
+	Samples   int    `json:"samples"`    // Samples is how many samples in a row must be above MaxMemory. Defaults to 3.
+}
+
+// Enabled will check whether the memory limit is set.
+// Returns true in case it is.
+func (limit MemoryLimit) Enabled() bool {
+	return limit.MaxMemory > 0
+}
+
+// Check will validate the memory limit.
+// Returns an error in case it is not valid.
+func (limit MemoryLimit) Check() error {
+	if limit.Samples < 0 {
+		return errors.New("The memory limit samples can't be negative.")
+	}
+	return nil
+}
+
+// GetSamples will return how many samples in a row must be above MaxMemory.
+func (limit MemoryLimit) GetSamples() int {
+	if limit.Samples <= 0 {
+		return DefaultMemoryLimitSamples
+	}
+	return limit.Samples
+}
@@ -1,10 +1,19 @@
 package process
 
+import "io"
+import "io/ioutil"
 import "os"
+import "os/exec"
+import "path/filepath"
 import "syscall"
 import "errors"
 import "strconv"
+import "strings"
+import "sync"
+import "time"
 
+import "github.com/topfreegames/apm/lib/logs"
+import "github.com/topfreegames/apm/lib/procfs"
 import "github.com/topfreegames/apm/lib/utils"
 
 type ProcContainer interface {
@@ -14,6 +23,8 @@ type ProcContainer interface {
 	Restart() error
 	Delete() error
 	IsAlive() bool
+	GroupAlive() bool
+	RecordIdentity() error
 	Identifier() string
 	ShouldKeepAlive() bool
 	AddRestart()
@@ -21,87 +32,297 @@ type ProcContainer interface {
 	SetStatus(status string)
 	GetPid() int
 	GetStatus() *ProcStatus
+	GetStopTimeout() time.Duration
+	GetRestartPolicy() RestartPolicy
+	GetHealthCheck() HealthCheck
+	CheckHealth() error
+	GetReadinessCheck() ReadinessCheck
+	GetMetricsChildren() bool
+	GetMemoryLimit() MemoryLimit
+	CheckReady() error
+	GetLogFiles() []string
+	GetLogRotate() logs.RotateConfig
+	CapturesOutput() bool
+	LogEvent(message string)
+	CloseLogSinks() error
+	SetEnv(vars map[string]string)
+	UnsetEnv(keys []string)
 	Watch() (*os.ProcessState, error)
 	release()
 }
 
+// adoptedWatchInterval is how often a proc adopted after an APM restart is checked, since
+// it is not a child of APM and can't be waited on.
+const adoptedWatchInterval = 1 * time.Second
+
+// DefaultStopTimeout is how long a process has to exit after SIGTERM before it is
+// killed with SIGKILL, when the process does not set its own StopTimeout.
+const DefaultStopTimeout = 10 * time.Second
+
 // Proc is a os.Process wrapper with Status and more info that will be used on Master to maintain
 // the process health.
 type Proc struct {
-	Name      string
-	Cmd       string
-	Args      []string
-	Path      string
-	Pidfile   string
-	Outfile   string
-	Errfile   string
-	KeepAlive bool
-	Pid       int
-	Status    *ProcStatus
-	process   *os.Process
+	Name            string
+	Cmd             string
+	Args            []string
+	Path            string
+	Pidfile         string
+	Outfile         string
+	Errfile         string
+	KeepAlive       bool
+	StopTimeout     time.Duration
+	RestartPolicy   RestartPolicy
+	HealthCheck     HealthCheck
+	ReadinessCheck  ReadinessCheck
+	Env             map[string]string
+	EnvFiles        []string
+	Cwd             string
+	Setsid          bool
+	LogRotate       logs.RotateConfig
+	Capture         bool
+	LogFormat       string
+	LogSinks        []logs.SinkConfig
+	MetricsChildren bool
+	MemoryLimit     MemoryLimit
+	Pid             int
+	Pgid            int
+	Identity        procfs.Identity
+	Status          *ProcStatus
+	process         *os.Process
+	// The sinks are opened on the first captured line and kept across restarts.
+	sinks      []logs.Sink
+	sinksMutex sync.Mutex
+	// The notify socket is created again on each start.
+	notify      *notifySocket
+	notifyMutex sync.Mutex
 }
 
 // Start will execute the command Cmd that should run the process. It will also create an out, err and pidfile
-// in case they do not exist yet.
+// in case they do not exist yet. With Capture set, the JSON LogFormat or LogSinks, the process writes to pipes
+// read by APM, which hands each line to the log sinks with a timestamp and stream tag.
 // Returns an error in case there's any.
 func (proc *Proc) Start() error {
-	outFile, err := utils.GetFile(proc.Outfile)
-	if err != nil {
-		return err
+	var outFile, errFile *os.File
+	var outReader, errReader *os.File
+	var err error
+	if proc.CapturesOutput() {
+		outReader, outFile, err = os.Pipe()
+		if err != nil {
+			return err
+		}
+		errReader, errFile, err = os.Pipe()
+		if err != nil {
+			outReader.Close()
+			outFile.Close()
+			return err
+		}
+	} else {
+		outFile, err = utils.GetFile(proc.Outfile)
+		if err != nil {
+			return err
+		}
+		errFile, err = utils.GetFile(proc.Errfile)
+		if err != nil {
+			return err
+		}
 	}
-	errFile, err := utils.GetFile(proc.Errfile)
+	// The child has its own copies, APM only keeps the read end of the pipes.
+	defer outFile.Close()
+	defer errFile.Close()
+	wd := proc.Cwd
+	if wd == "" {
+		wd, _ = os.Getwd()
+	}
+	env, err := proc.environ()
 	if err != nil {
 		return err
 	}
-	wd, _ := os.Getwd()
+	if proc.ReadinessCheck.Type == ReadinessNotify {
+		notifyPath, err := proc.listenNotify()
+		if err != nil {
+			return err
+		}
+		env = utils.MergeEnv(env, map[string]string{"NOTIFY_SOCKET": notifyPath})
+	}
 	procAtr := &os.ProcAttr{
 		Dir: wd,
-		Env: os.Environ(),
+		Env: env,
 		Files: []*os.File{
 			os.Stdin,
 			outFile,
 			errFile,
 		},
+		// Run the proc in its own process group, or session, so it can be stopped along
+		// with everything it forks.
+		Sys: &syscall.SysProcAttr{
+			Setpgid: !proc.Setsid,
+			Setsid:  proc.Setsid,
+		},
 	}
 	args := append([]string{proc.Name}, proc.Args...)
 	process, err := os.StartProcess(proc.Cmd, args, procAtr)
 	if err != nil {
+		if proc.CapturesOutput() {
+			outReader.Close()
+			errReader.Close()
+		}
 		return err
 	}
+	if proc.CapturesOutput() {
+		go proc.capture(outReader, process.Pid, "out")
+		go proc.capture(errReader, process.Pid, "err")
+	}
 	proc.process = process
 	proc.Pid = proc.process.Pid
+	// Recorded so the proc can be told apart from another program reusing its pid.
+	proc.Identity, _ = procfs.ReadIdentity(proc.Pid)
+	// The proc leads its own process group, which outlives it while its workers run.
+	proc.Pgid = proc.Pid
 	err = utils.WriteFile(proc.Pidfile, []byte(strconv.Itoa(proc.process.Pid)))
 	if err != nil {
 		return err
 	}
 
+	proc.Status.SetStarted(time.Now())
 	proc.Status.SetStatus("started")
 	return nil
 }
 
-// ForceStop will forcefully send a SIGKILL signal to process killing it instantly.
+// capture will hand the lines read from reader to the log sinks until every process holding
+// the write end of the pipe exits.
+func (proc *Proc) capture(reader *os.File, pid int, stream string) {
+	defer reader.Close()
+	sinks, err := proc.getSinks()
+	if err != nil {
+		// Keep draining the pipe, so the process never blocks on a full pipe.
+		io.Copy(ioutil.Discard, reader)
+		return
+	}
+	logs.Capture(reader, proc.Name, pid, stream, func(line *logs.Line) {
+		for _, sink := range sinks {
+			sink.WriteLine(line)
+		}
+	})
+}
+
+// getSinks opens the log sinks of the proc unless they are already open. The out and err
+// files are the only sink of procs that do not set LogSinks.
+func (proc *Proc) getSinks() ([]logs.Sink, error) {
+	proc.sinksMutex.Lock()
+	defer proc.sinksMutex.Unlock()
+	if proc.sinks != nil {
+		return proc.sinks, nil
+	}
+	configs := proc.LogSinks
+	if len(configs) == 0 {
+		configs = []logs.SinkConfig{{Type: logs.SinkFile}}
+	}
+	sinks := []logs.Sink{}
+	for _, config := range configs {
+		sink, err := logs.OpenSink(config, proc.Outfile, proc.Errfile, proc.getLogFormat())
+		if err != nil {
+			for _, sink := range sinks {
+				sink.Close()
+			}
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	proc.sinks = sinks
+	return sinks, nil
+}
+
+// LogEvent will hand a marker line written by APM, such as a restart, to the log sinks of
+// a proc that captures its output. Procs writing straight to their files are left alone.
+func (proc *Proc) LogEvent(message string) {
+	if !proc.CapturesOutput() {
+		return
+	}
+	sinks, err := proc.getSinks()
+	if err != nil {
+		return
+	}
+	line := &logs.Line{
+		Proc:    proc.Name,
+		Pid:     proc.Pid,
+		Time:    time.Now(),
+		Stream:  "apm",
+		Message: message,
+	}
+	for _, sink := range sinks {
+		sink.WriteLine(line)
+	}
+}
+
+// CloseLogSinks will write the lines queued on the log sinks and close them, once the proc
+// is stopped. They are opened again on its next start.
+// Returns an error in case there's any.
+func (proc *Proc) CloseLogSinks() error {
+	proc.sinksMutex.Lock()
+	defer proc.sinksMutex.Unlock()
+	var err error
+	for _, sink := range proc.sinks {
+		if errClose := sink.Close(); err == nil {
+			err = errClose
+		}
+	}
+	proc.sinks = nil
+	return err
+}
+
+// listenNotify creates the notify socket of the proc, closing the one of its previous run.
+// Returns a tuple with the socket path and an error in case there's any.
+func (proc *Proc) listenNotify() (string, error) {
+	proc.notifyMutex.Lock()
+	defer proc.notifyMutex.Unlock()
+	if proc.notify != nil {
+		proc.notify.close()
+		proc.notify = nil
+	}
+	notifyPath, err := filepath.Abs(filepath.Join(proc.Path, NotifySocketFile))
+	if err != nil {
+		return "", err
+	}
+	notify, err := listenNotify(notifyPath)
+	if err != nil {
+		return "", err
+	}
+	proc.notify = notify
+	return notifyPath, nil
+}
+
+func (proc *Proc) closeNotify() {
+	proc.notifyMutex.Lock()
+	defer proc.notifyMutex.Unlock()
+	if proc.notify != nil {
+		proc.notify.close()
+		proc.notify = nil
+	}
+}
+
+// ForceStop will forcefully send a SIGKILL signal to process group killing it instantly.
+// The process is not released, so a watcher waiting on it will still be notified.
 // Returns an error in case there's any.
 func (proc *Proc) ForceStop() error {
-	if proc.process != nil {
-		err := proc.process.Signal(syscall.SIGKILL)
-		proc.Status.SetStatus("stopped")
-		proc.release()
+	err := proc.signal(syscall.SIGKILL)
+	if err != nil {
 		return err
 	}
-	return errors.New("Process does not exist.")
+	proc.Status.SetStatus("killed")
+	return nil
 }
 
-// GracefullyStop will send a SIGTERM signal asking the process to terminate.
+// GracefullyStop will send a SIGTERM signal asking the process group to terminate.
 // The process may choose to die gracefully or ignore this signal completely. In that case
 // the process will keep running unless you call ForceStop()
 // Returns an error in case there's any.
 func (proc *Proc) GracefullyStop() error {
-	if proc.process != nil {
-		err := proc.process.Signal(syscall.SIGTERM)
-		proc.Status.SetStatus("asked to stop")
+	err := proc.signal(syscall.SIGTERM)
+	if err != nil {
 		return err
 	}
-	return errors.New("Process does not exist.")
+	proc.Status.SetStatus("asked to stop")
+	return nil
 }
 
 // Restart will try to gracefully stop the process and then Start it again.
@@ -120,6 +341,8 @@ func (proc *Proc) Restart() error {
 // Returns an error in case there's any.
 func (proc *Proc) Delete() error {
 	proc.release()
+	proc.CloseLogSinks()
+	proc.closeNotify()
 	err := utils.DeleteFile(proc.Outfile)
 	if err != nil {
 		return err
@@ -131,9 +354,21 @@ func (proc *Proc) Delete() error {
 	return os.RemoveAll(proc.Path)
 }
 
-// IsAlive will check if the process is alive or not.
+// IsAlive will check if the process is alive or not. When /proc is available, the pid
+// must also still belong to the program that was started, so a reused pid is not
+// mistaken for the proc.
 // Returns true if the process is alive or false otherwise.
 func (proc *Proc) IsAlive() bool {
+	if proc.Pid <= 0 {
+		return false
+	}
+	if procfs.Available() {
+		if proc.Identity.StartTime == 0 {
+			// Procs saved before identities were recorded only have their pid and command.
+			return procfs.IsRunningCmd(proc.Pid, proc.expectedExe())
+		}
+		return procfs.IsRunning(proc.Pid, proc.Identity)
+	}
 	p, err := os.FindProcess(proc.Pid)
 	if err != nil {
 		return false
@@ -141,12 +376,83 @@ func (proc *Proc) IsAlive() bool {
 	return p.Signal(syscall.Signal(0)) == nil
 }
 
+// GroupAlive will check whether any process of the group led by the proc is still running,
+// which may be the case for the workers it forked after the proc itself exited.
+// Returns true in case there is.
+func (proc *Proc) GroupAlive() bool {
+	if proc.Pgid <= 0 {
+		return false
+	}
+	if procfs.Available() {
+		members, err := procfs.GroupMembers(proc.Pgid)
+		return err == nil && len(members) > 0
+	}
+	return syscall.Kill(-proc.Pgid, syscall.Signal(0)) == nil
+}
+
+// RecordIdentity will record the identity of the running process, in case it was started
+// before identities were recorded, so it is not mistaken for another program later on.
+// Returns an error in case there's any.
+func (proc *Proc) RecordIdentity() error {
+	if proc.Identity.StartTime != 0 {
+		return nil
+	}
+	identity, err := procfs.ReadIdentity(proc.Pid)
+	if err != nil {
+		return err
+	}
+	proc.Identity = identity
+	return nil
+}
+
+// expectedExe returns the absolute path of the executable the proc runs, or its Cmd in case
+// it can't be resolved.
+func (proc *Proc) expectedExe() string {
+	cmd := proc.Cmd
+	if !strings.Contains(cmd, "/") {
+		if found, err := exec.LookPath(cmd); err == nil {
+			cmd = found
+		}
+	} else if !filepath.IsAbs(cmd) && proc.Cwd != "" {
+		cmd = filepath.Join(proc.Cwd, cmd)
+	}
+	if resolved, err := filepath.EvalSymlinks(cmd); err == nil {
+		return resolved
+	}
+	return cmd
+}
+
 // Watch will stop execution and wait until the process change its state. Usually changing state, means that the process died.
+// Procs adopted after an APM restart are not children of APM, so they are polled instead and their state is nil.
+// It runs without the master lock, so the state must be recorded by the caller, through SetExitState.
 // Returns a tuple with the new process state and an error in case there's any.
 func (proc *Proc) Watch() (*os.ProcessState, error) {
+	if proc.process == nil {
+		for proc.IsAlive() {
+			time.Sleep(adoptedWatchInterval)
+		}
+		return nil, nil
+	}
 	return proc.process.Wait()
 }
 
+// Sends sig to the process group led by the proc, so forked workers and children of
+// shell wrappers get it too, even after the proc itself exited. Procs that do not lead a
+// group only get sig themselves. Nothing is sent in case the pid no longer belongs to the proc.
+func (proc *Proc) signal(sig syscall.Signal) error {
+	if proc.Pgid > 0 && (proc.IsAlive() || proc.GroupAlive()) {
+		return syscall.Kill(-proc.Pgid, sig)
+	}
+	if !proc.IsAlive() {
+		return errors.New("Process does not exist.")
+	}
+	pgid, err := syscall.Getpgid(proc.Pid)
+	if err == nil && pgid == proc.Pid {
+		return syscall.Kill(-pgid, sig)
+	}
+	return syscall.Kill(proc.Pid, sig)
+}
+
 // Will release the process and remove its PID file
 func (proc *Proc) release() {
 	if proc.process != nil {
@@ -155,9 +461,13 @@ func (proc *Proc) release() {
 	utils.DeleteFile(proc.Pidfile)
 }
 
-// Notify that process was stopped so we can set its PID to -1
+// Notify that process was stopped so we can set its PID to -1. Its group is kept until
+// its last member exits, so orphaned workers can still be stopped.
 func (proc *Proc) NotifyStopped() {
 	proc.Pid = -1;
+	if !proc.GroupAlive() {
+		proc.Pgid = 0
+	}
 }
 
 // Add one restart to proc status
@@ -165,9 +475,45 @@ func (proc *Proc) AddRestart() {
 	proc.Status.AddRestart()
 }
 
+// Set environment variables that will be passed to the proc on its next start
+func (proc *Proc) SetEnv(vars map[string]string) {
+	if proc.Env == nil {
+		proc.Env = make(map[string]string)
+	}
+	for key, value := range vars {
+		proc.Env[key] = value
+	}
+}
+
+// Unset environment variables previously set with SetEnv
+func (proc *Proc) UnsetEnv(keys []string) {
+	for _, key := range keys {
+		delete(proc.Env, key)
+	}
+}
+
+// Builds the proc environment: the APM environment, overridden by the EnvFiles in order
+// and then by Env.
+func (proc *Proc) environ() ([]string, error) {
+	vars := make(map[string]string)
+	for _, envFile := range proc.EnvFiles {
+		fileVars, err := utils.ReadEnvFile(envFile)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range fileVars {
+			vars[key] = value
+		}
+	}
+	for key, value := range proc.Env {
+		vars[key] = value
+	}
+	return utils.MergeEnv(os.Environ(), vars), nil
+}
+
 // Return proc current PID
 func (proc *Proc) GetPid() int {
-	return proc.Pid;
+	return proc.Pid
 }
 
 // Return proc current status
@@ -175,9 +521,90 @@ func (proc *Proc) GetStatus() *ProcStatus {
 	return proc.Status;
 }
 
+// Return how long the proc has to exit after being asked to stop
+func (proc *Proc) GetStopTimeout() time.Duration {
+	if proc.StopTimeout <= 0 {
+		return DefaultStopTimeout
+	}
+	return proc.StopTimeout
+}
+
+// Return the policy used to restart the proc after it dies
+func (proc *Proc) GetRestartPolicy() RestartPolicy {
+	return proc.RestartPolicy
+}
+
+// Return the liveness probe of the proc
+func (proc *Proc) GetHealthCheck() HealthCheck {
+	return proc.HealthCheck
+}
+
+// CheckHealth will probe the proc once with its HealthCheck. Exec probes run from the proc
+// working directory and with its environment.
+// Returns an error telling why the proc is not healthy, or nil in case it is.
+func (proc *Proc) CheckHealth() error {
+	env, err := proc.environ()
+	if err != nil {
+		return err
+	}
+	return proc.HealthCheck.Probe(proc.Cwd, env)
+}
+
+// Return how the proc tells it is ready
+func (proc *Proc) GetReadinessCheck() ReadinessCheck {
+	return proc.ReadinessCheck
+}
+
+// CheckReady will check once whether the proc is ready, by probing it or, for notify checks,
+// by looking for a READY=1 sent since it started.
+// Returns an error telling why the proc is not ready, or nil in case it is.
+func (proc *Proc) CheckReady() error {
+	if proc.ReadinessCheck.Type != ReadinessNotify {
+		return proc.ReadinessCheck.healthCheck().Probe(proc.Cwd, nil)
+	}
+	proc.notifyMutex.Lock()
+	defer proc.notifyMutex.Unlock()
+	if proc.notify == nil || !proc.notify.isReady() {
+		return errors.New("READY=1 was not received yet.")
+	}
+	return nil
+}
+
+// Return whether the descendants of the proc are added to its metrics
+func (proc *Proc) GetMetricsChildren() bool {
+	return proc.MetricsChildren
+}
+
+// Return the memory limit that restarts the proc
+func (proc *Proc) GetMemoryLimit() MemoryLimit {
+	return proc.MemoryLimit
+}
+
+// Return the out and err files of the proc
+func (proc *Proc) GetLogFiles() []string {
+	return []string{proc.Outfile, proc.Errfile}
+}
+
+// Return when the proc log files are rotated
+func (proc *Proc) GetLogRotate() logs.RotateConfig {
+	return proc.LogRotate
+}
+
+// Returns true if the proc output is read by APM through pipes
+func (proc *Proc) CapturesOutput() bool {
+	return proc.Capture || proc.LogFormat == logs.FormatJSON || len(proc.LogSinks) > 0
+}
+
+func (proc *Proc) getLogFormat() string {
+	if proc.LogFormat == "" {
+		return logs.FormatText
+	}
+	return proc.LogFormat
+}
+
 // Set proc status
 func (proc *Proc) SetStatus(status string) {
-	proc.Status.SetStatus(status);
+	proc.Status.SetStatus(status)
 }
 
 // Proc identifier that will be used by watcher to keep track of its processes
@@ -1,9 +1,30 @@
 package process
 
+import "fmt"
+import "os"
+import "syscall"
+import "time"
+
 // ProcStatus is a wrapper with the process current status.
 type ProcStatus struct {
-	Status   string
-	Restarts int
+	Status         string      `json:"status"`
+	Restarts       int         `json:"restarts"`
+	RecentRestarts []time.Time `json:"recent_restarts"` // RecentRestarts holds the restarts inside the restart policy window.
+	StartedAt      time.Time   `json:"started_at"`      // StartedAt is when the process was last started.
+	ExitedAt       time.Time   `json:"exited_at"`       // ExitedAt is when the process last exited.
+	ExitCode       int         `json:"exit_code"`       // ExitCode is the last exit code, or -1 in case the process was killed by a signal.
+	Signal         int         `json:"signal"`          // Signal is the signal that terminated the process last time, or 0.
+	CoreDumped     bool        `json:"core_dumped"`     // CoreDumped is true in case the process dumped a core when it last exited.
+	ReadyAt        time.Time   `json:"ready_at"`        // ReadyAt is when the process was last found ready, for processes with a readiness check.
+
+	Health          string    `json:"health"`            // Health is healthy or unhealthy once the health check ran since the process started, and empty otherwise.
+	HealthFailures  int       `json:"health_failures"`   // HealthFailures is how many health checks failed in a row.
+	HealthError     string    `json:"health_error"`      // HealthError tells why the last health check failed.
+	HealthCheckedAt time.Time `json:"health_checked_at"` // HealthCheckedAt is when the last health check started.
+
+	MemoryExceeded int    `json:"memory_exceeded"` // MemoryExceeded is how many samples in a row were above the memory limit.
+	MemoryRestarts int    `json:"memory_restarts"` // MemoryRestarts is how many times the process was restarted for exceeding its memory limit. They are not counted in Restarts.
+	RestartReason  string `json:"restart_reason"`  // RestartReason tells why APM last restarted the process, such as the exit that caused it.
 }
 
 // SetStatus will set the process string status.
@@ -11,7 +32,153 @@ func (proc_status *ProcStatus) SetStatus(status string) {
 	proc_status.Status = status
 }
 
+// SetReady will record that the started process was found ready at readyAt.
+func (proc_status *ProcStatus) SetReady(readyAt time.Time) {
+	proc_status.Status = "ready"
+	proc_status.ReadyAt = readyAt
+}
+
+// IsUp will check whether the process is running and, in case it has a readiness check, ready.
+// Returns true in case it is.
+func (proc_status *ProcStatus) IsUp() bool {
+	return proc_status.Status == "running" || proc_status.Status == "ready"
+}
+
+// SetStarted will record that the process started at startedAt. The health of the
+// previous run is forgotten.
+func (proc_status *ProcStatus) SetStarted(startedAt time.Time) {
+	proc_status.StartedAt = startedAt
+	proc_status.Health = ""
+	proc_status.HealthFailures = 0
+	proc_status.HealthError = ""
+	proc_status.HealthCheckedAt = time.Time{}
+	proc_status.MemoryExceeded = 0
+}
+
+// SetExitState will record how and when the process exited based on state. A nil state
+// means the process was not a child of APM, so its exit code is unknown.
+func (proc_status *ProcStatus) SetExitState(state *os.ProcessState, exitedAt time.Time) {
+	proc_status.ExitedAt = exitedAt
+	proc_status.ExitCode = state.ExitCode()
+	proc_status.Signal = 0
+	proc_status.CoreDumped = false
+	if state == nil {
+		return
+	}
+	if waitStatus, ok := state.Sys().(syscall.WaitStatus); ok && waitStatus.Signaled() {
+		proc_status.Signal = int(waitStatus.Signal())
+		proc_status.CoreDumped = waitStatus.CoreDump()
+	}
+}
+
+// LastExit will describe how the process exited last time, such as "exit 0" or "signal 9 (killed)".
+// Returns an empty string in case the process never exited.
+func (proc_status *ProcStatus) LastExit() string {
+	if proc_status.ExitedAt.IsZero() {
+		return ""
+	}
+	if proc_status.Signal == 0 {
+		if proc_status.ExitCode < 0 {
+			return "unknown"
+		}
+		return fmt.Sprintf("exit %d", proc_status.ExitCode)
+	}
+	lastExit := fmt.Sprintf("signal %d (%s)", proc_status.Signal, syscall.Signal(proc_status.Signal))
+	if proc_status.CoreDumped {
+		lastExit += ", core dumped"
+	}
+	return lastExit
+}
+
+// Uptime will return for how long the process has been running at now.
+func (proc_status *ProcStatus) Uptime(now time.Time) time.Duration {
+	if proc_status.StartedAt.IsZero() {
+		return 0
+	}
+	return now.Sub(proc_status.StartedAt)
+}
+
 // AddRestart will add one restart to the process status.
 func (proc_status *ProcStatus) AddRestart() {
 	proc_status.Restarts++
 }
+
+// AddMemoryRestart will add one restart for exceeding the memory limit to the process status.
+func (proc_status *ProcStatus) AddMemoryRestart() {
+	proc_status.MemoryRestarts++
+	proc_status.RestartReason = MemoryLimitReason
+}
+
+// NextRestart will register a restart happening at now according to policy.
+// Returns how long to wait before restarting and false in case the process restarted
+// more than policy.MaxRestarts times inside policy.Window and should not be restarted. A policy
+// with a negative MaxRestarts never stops the restarts.
+func (proc_status *ProcStatus) NextRestart(policy RestartPolicy, now time.Time) (time.Duration, bool) {
+	policy = policy.withDefaults()
+	recent := []time.Time{}
+	for _, restart := range proc_status.RecentRestarts {
+		if now.Sub(restart) < policy.Window {
+			recent = append(recent, restart)
+		}
+	}
+	if !policy.Unlimited() && len(recent) >= policy.MaxRestarts {
+		proc_status.RecentRestarts = recent
+		return 0, false
+	}
+	proc_status.RecentRestarts = append(recent, now)
+	return policy.Backoff(len(proc_status.RecentRestarts)), true
+}
+
+// ResetBackoff will forget the recent restarts, so the next restart happens after the
+// minimum backoff again.
+func (proc_status *ProcStatus) ResetBackoff() {
+	proc_status.RecentRestarts = nil
+}
+
+// HealthCheckDue will check whether the running process should be probed by check at now,
+// that is once its InitialDelay and Interval have passed.
+// Returns true in case it should.
+func (proc_status *ProcStatus) HealthCheckDue(check HealthCheck, now time.Time) bool {
+	if !check.Enabled() || !proc_status.IsUp() {
+		return false
+	}
+	check = check.withDefaults()
+	if now.Sub(proc_status.StartedAt) < check.InitialDelay {
+		return false
+	}
+	return now.Sub(proc_status.HealthCheckedAt) >= check.Interval
+}
+
+// RecordMemory will record a sample of rss, the resident memory of the process, against limit.
+// Returns true in case the process should be restarted, having been above the limit for
+// limit.Samples samples in a row.
+func (proc_status *ProcStatus) RecordMemory(limit MemoryLimit, rss uint64) bool {
+	if !limit.Enabled() || rss <= limit.MaxMemory {
+		proc_status.MemoryExceeded = 0
+		return false
+	}
+	proc_status.MemoryExceeded++
+	return proc_status.MemoryExceeded >= limit.GetSamples()
+}
+
+// RecordHealthCheck will record the result of a probe of check started at checkedAt. A nil err
+// means it passed.
+// Returns true in case the process is unhealthy, having failed check.FailureThreshold probes
+// in a row.
+func (proc_status *ProcStatus) RecordHealthCheck(check HealthCheck, err error, checkedAt time.Time) bool {
+	check = check.withDefaults()
+	proc_status.HealthCheckedAt = checkedAt
+	if err == nil {
+		proc_status.Health = "healthy"
+		proc_status.HealthFailures = 0
+		proc_status.HealthError = ""
+		return false
+	}
+	proc_status.HealthFailures++
+	proc_status.HealthError = err.Error()
+	if proc_status.HealthFailures < check.FailureThreshold {
+		return false
+	}
+	proc_status.Health = "unhealthy"
+	return true
+}
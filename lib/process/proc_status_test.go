@@ -0,0 +1,100 @@
+package process
+
+import "errors"
+import "testing"
+import "time"
+
+func TestRecordMemory(t *testing.T) {
+	limit := MemoryLimit{MaxMemory: 100, Samples: 3}
+	tests := []struct {
+		rss  uint64
+		want bool
+	}{
+		{150, false},
+		{150, false},
+		{50, false},
+		{150, false},
+		{150, false},
+		{150, true},
+		{150, true},
+		{100, false},
+	}
+	status := &ProcStatus{}
+	for i, test := range tests {
+		if got := status.RecordMemory(limit, test.rss); got != test.want {
+			t.Errorf("sample %d of %d bytes = %t, want %t", i+1, test.rss, got, test.want)
+		}
+	}
+}
+
+func TestRecordMemoryDefaults(t *testing.T) {
+	status := &ProcStatus{}
+	for i := 0; i < 10; i++ {
+		if status.RecordMemory(MemoryLimit{}, 1<<40) {
+			t.Fatal("a disabled memory limit should never restart the process")
+		}
+	}
+	limit := MemoryLimit{MaxMemory: 100}
+	for i := 1; i <= DefaultMemoryLimitSamples; i++ {
+		if got, want := status.RecordMemory(limit, 200), i == DefaultMemoryLimitSamples; got != want {
+			t.Errorf("sample %d = %t, want %t", i, got, want)
+		}
+	}
+}
+
+func TestRecordHealthCheck(t *testing.T) {
+	check := HealthCheck{Type: HealthCheckTCP, Address: "localhost:1", FailureThreshold: 2}
+	failure := errors.New("connection refused")
+	tests := []struct {
+		err       error
+		unhealthy bool
+		health    string
+		failures  int
+	}{
+		{nil, false, "healthy", 0},
+		{failure, false, "healthy", 1},
+		{nil, false, "healthy", 0},
+		{failure, false, "healthy", 1},
+		{failure, true, "unhealthy", 2},
+		{failure, true, "unhealthy", 3},
+		{nil, false, "healthy", 0},
+	}
+	status := &ProcStatus{}
+	now := time.Unix(1000, 0)
+	for i, test := range tests {
+		unhealthy := status.RecordHealthCheck(check, test.err, now)
+		if unhealthy != test.unhealthy || status.Health != test.health || status.HealthFailures != test.failures {
+			t.Errorf("probe %d = (%t, %s, %d), want (%t, %s, %d)", i+1, unhealthy, status.Health, status.HealthFailures,
+				test.unhealthy, test.health, test.failures)
+		}
+		if test.err != nil && status.HealthError != test.err.Error() {
+			t.Errorf("probe %d error = %q, want %q", i+1, status.HealthError, test.err.Error())
+		}
+		if !status.HealthCheckedAt.Equal(now) {
+			t.Errorf("probe %d checked at %s, want %s", i+1, status.HealthCheckedAt, now)
+		}
+	}
+}
+
+func TestHealthCheckDue(t *testing.T) {
+	check := HealthCheck{Type: HealthCheckTCP, Address: "localhost:1", Interval: 10 * time.Second, InitialDelay: 5 * time.Second}
+	startedAt := time.Unix(1000, 0)
+	status := &ProcStatus{Status: "running", StartedAt: startedAt}
+	if status.HealthCheckDue(check, startedAt.Add(time.Second)) {
+		t.Error("probe due before its initial delay")
+	}
+	if !status.HealthCheckDue(check, startedAt.Add(5*time.Second)) {
+		t.Error("probe not due after its initial delay")
+	}
+	status.HealthCheckedAt = startedAt.Add(5 * time.Second)
+	if status.HealthCheckDue(check, startedAt.Add(10*time.Second)) {
+		t.Error("probe due before its interval")
+	}
+	if !status.HealthCheckDue(check, startedAt.Add(15*time.Second)) {
+		t.Error("probe not due after its interval")
+	}
+	status.Status = "stopped"
+	if status.HealthCheckDue(check, startedAt.Add(time.Hour)) {
+		t.Error("probe due while the process is stopped")
+	}
+}
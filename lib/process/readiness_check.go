@@ -0,0 +1,144 @@
+package process
+
+import "encoding/json"
+import "errors"
+import "fmt"
+import "net"
+import "os"
+import "strings"
+import "sync/atomic"
+import "time"
+
+import "github.com/topfreegames/apm/lib/utils"
+
+// ReadinessNotify procs are ready once they send READY=1 to the socket in NOTIFY_SOCKET, as
+// with sd_notify.
+const ReadinessNotify = "notify"
+
+// NotifySocketFile is the socket, inside the proc folder, that procs with a notify readiness
+// check send their state to.
+const NotifySocketFile = "notify.sock"
+
+// DefaultReadinessInterval is how often a starting process is checked until it is ready.
+const DefaultReadinessInterval = 500 * time.Millisecond
+
+// ReadinessCheck defines how APM knows a process that just started can take traffic. Until then
+// its status is starting, and ready afterwards. An empty Type disables it, and the process is
+// running as soon as it starts.
+type ReadinessCheck struct {
+	Type     string        `json:"type"`     // Type is tcp, http or notify.
+	URL      string        `json:"url"`      // URL is requested by http checks.
+	Status   int           `json:"status"`   // Status is the status expected by http checks. Defaults to 200.
+	Address  string        `json:"address"`  // Address is host:port, connected to by tcp checks.
+	Interval time.Duration `json:"interval"` // Interval is the time between two checks, and how long each may take.
+}
+
+// Enabled will check whether the readiness check has a probe.
+// Returns true in case it does.
+func (check ReadinessCheck) Enabled() bool {
+	return check.Type != ""
+}
+
+// MarshalJSON will encode the readiness check with its durations as strings such as 1m30s.
+// Returns a tuple with the JSON object and an error in case there's any.
+func (check ReadinessCheck) MarshalJSON() ([]byte, error) {
+	type plain ReadinessCheck
+	return json.Marshal(&struct {
+		plain
+		Interval utils.Duration `json:"interval"`
+	}{plain(check), utils.Duration(check.Interval)})
+}
+
+// UnmarshalJSON will decode the readiness check, with its durations as strings such as 1m30s or
+// numbers of nanoseconds.
+// Returns an error in case there's any.
+func (check *ReadinessCheck) UnmarshalJSON(data []byte) error {
+	type plain ReadinessCheck
+	return json.Unmarshal(data, &struct {
+		*plain
+		Interval *utils.Duration `json:"interval"`
+	}{(*plain)(check), (*utils.Duration)(&check.Interval)})
+}
+
+// Check will validate the readiness check.
+// Returns an error in case it is not valid.
+func (check ReadinessCheck) Check() error {
+	if check.Interval < 0 {
+		return errors.New("The readiness check interval can't be negative.")
+	}
+	switch check.Type {
+	case "", ReadinessNotify:
+		return nil
+	case HealthCheckHTTP, HealthCheckTCP:
+		return check.healthCheck().Check()
+	}
+	return fmt.Errorf("Unknown readiness check type %s. Use tcp, http or notify.", check.Type)
+}
+
+// healthCheck returns the probe of tcp and http checks.
+func (check ReadinessCheck) healthCheck() HealthCheck {
+	status := check.Status
+	if status == 0 {
+		status = 200
+	}
+	return HealthCheck{
+		Type:    check.Type,
+		URL:     check.URL,
+		Status:  status,
+		Address: check.Address,
+		Timeout: check.GetInterval(),
+	}
+}
+
+// GetInterval will return the time between two checks.
+func (check ReadinessCheck) GetInterval() time.Duration {
+	if check.Interval <= 0 {
+		return DefaultReadinessInterval
+	}
+	return check.Interval
+}
+
+// notifySocket receives the datagrams a proc sends to NOTIFY_SOCKET, and remembers whether
+// one of them had READY=1.
+type notifySocket struct {
+	conn  *net.UnixConn
+	ready int32
+}
+
+// listenNotify creates the socket at path, replacing the one of a previous run.
+func listenNotify(path string) (*notifySocket, error) {
+	os.Remove(path)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	socket := &notifySocket{conn: conn}
+	go socket.read()
+	return socket, nil
+}
+
+func (socket *notifySocket) read() {
+	buffer := make([]byte, 4096)
+	for {
+		n, err := socket.conn.Read(buffer)
+		if err != nil {
+			return
+		}
+		// Each datagram holds one or more KEY=VALUE lines, such as READY=1 or STATUS=...
+		for _, line := range strings.Split(string(buffer[:n]), "\n") {
+			if strings.TrimSpace(line) == "READY=1" {
+				atomic.StoreInt32(&socket.ready, 1)
+			}
+		}
+	}
+}
+
+func (socket *notifySocket) isReady() bool {
+	return atomic.LoadInt32(&socket.ready) == 1
+}
+
+func (socket *notifySocket) close() error {
+	err := socket.conn.Close()
+	os.Remove(socket.conn.LocalAddr().String())
+	return err
+}
@@ -0,0 +1,90 @@
+package process
+
+import "encoding/json"
+import "time"
+
+import "github.com/topfreegames/apm/lib/utils"
+
+const (
+	// DefaultMinBackoff is the delay before the first restart of a process that died.
+	DefaultMinBackoff = 1 * time.Second
+	// DefaultMaxBackoff is the longest delay between two restarts of a process.
+	DefaultMaxBackoff = 1 * time.Minute
+	// DefaultMaxRestarts is how many restarts are allowed inside DefaultRestartWindow.
+	DefaultMaxRestarts = 5
+	// DefaultRestartWindow is the sliding window used to count restarts.
+	DefaultRestartWindow = 1 * time.Minute
+)
+
+// RestartPolicy defines how a keep alive process is restarted after it dies.
+// Zero values mean the defaults above. A negative MaxRestarts means unlimited restarts.
+type RestartPolicy struct {
+	MinBackoff  time.Duration `json:"min_backoff"`  // MinBackoff is the delay before the first restart inside Window. It doubles on each following restart.
+	MaxBackoff  time.Duration `json:"max_backoff"`  // MaxBackoff caps the delay between restarts.
+	MaxRestarts int           `json:"max_restarts"` // MaxRestarts is how many restarts are allowed inside Window before the process is considered crash looping.
+	Window      time.Duration `json:"window"`       // Window is the sliding window used to count restarts.
+}
+
+// Backoff will return how long to wait before the restart number restarts inside the window,
+// starting at 1.
+func (policy RestartPolicy) Backoff(restarts int) time.Duration {
+	policy = policy.withDefaults()
+	backoff := policy.MinBackoff
+	for i := 1; i < restarts && backoff < policy.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > policy.MaxBackoff {
+		return policy.MaxBackoff
+	}
+	return backoff
+}
+
+// Unlimited will check whether the process may restart any number of times inside Window.
+// Returns true in case it may.
+func (policy RestartPolicy) Unlimited() bool {
+	return policy.MaxRestarts < 0
+}
+
+// MarshalJSON will encode policy with its durations as strings such as 1m30s.
+// Returns a tuple with the JSON object and an error in case there's any.
+func (policy RestartPolicy) MarshalJSON() ([]byte, error) {
+	type plain RestartPolicy
+	return json.Marshal(&struct {
+		plain
+		MinBackoff utils.Duration `json:"min_backoff"`
+		MaxBackoff utils.Duration `json:"max_backoff"`
+		Window     utils.Duration `json:"window"`
+	}{plain(policy), utils.Duration(policy.MinBackoff), utils.Duration(policy.MaxBackoff), utils.Duration(policy.Window)})
+}
+
+// UnmarshalJSON will decode policy, with its durations as strings such as 1m30s or
+// numbers of nanoseconds.
+// Returns an error in case there's any.
+func (policy *RestartPolicy) UnmarshalJSON(data []byte) error {
+	type plain RestartPolicy
+	return json.Unmarshal(data, &struct {
+		*plain
+		MinBackoff *utils.Duration `json:"min_backoff"`
+		MaxBackoff *utils.Duration `json:"max_backoff"`
+		Window     *utils.Duration `json:"window"`
+	}{(*plain)(policy), (*utils.Duration)(&policy.MinBackoff), (*utils.Duration)(&policy.MaxBackoff), (*utils.Duration)(&policy.Window)})
+}
+
+func (policy RestartPolicy) withDefaults() RestartPolicy {
+	if policy.MinBackoff <= 0 {
+		policy.MinBackoff = DefaultMinBackoff
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = DefaultMaxBackoff
+	}
+	if policy.MaxBackoff < policy.MinBackoff {
+		policy.MaxBackoff = policy.MinBackoff
+	}
+	if policy.MaxRestarts == 0 {
+		policy.MaxRestarts = DefaultMaxRestarts
+	}
+	if policy.Window <= 0 {
+		policy.Window = DefaultRestartWindow
+	}
+	return policy
+}
@@ -0,0 +1,109 @@
+package process
+
+import "encoding/json"
+import "reflect"
+import "testing"
+import "time"
+
+func TestBackoff(t *testing.T) {
+	policy := RestartPolicy{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	tests := []struct {
+		restarts int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+	for _, test := range tests {
+		if got := policy.Backoff(test.restarts); got != test.want {
+			t.Errorf("Backoff(%d) = %s, want %s", test.restarts, got, test.want)
+		}
+	}
+}
+
+func TestBackoffDefaults(t *testing.T) {
+	policy := RestartPolicy{}
+	if got := policy.Backoff(1); got != DefaultMinBackoff {
+		t.Errorf("Backoff(1) = %s, want %s", got, DefaultMinBackoff)
+	}
+	if got := policy.Backoff(100); got != DefaultMaxBackoff {
+		t.Errorf("Backoff(100) = %s, want %s", got, DefaultMaxBackoff)
+	}
+	policy = RestartPolicy{MinBackoff: time.Minute, MaxBackoff: time.Second}
+	if got := policy.Backoff(3); got != time.Minute {
+		t.Errorf("Backoff(3) with MaxBackoff below MinBackoff = %s, want %s", got, time.Minute)
+	}
+}
+
+func TestNextRestart(t *testing.T) {
+	policy := RestartPolicy{MinBackoff: time.Second, MaxBackoff: time.Minute, MaxRestarts: 3, Window: time.Minute}
+	status := &ProcStatus{}
+	now := time.Unix(1000, 0)
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		delay, ok := status.NextRestart(policy, now.Add(time.Duration(i)*time.Second))
+		if !ok || delay != want {
+			t.Fatalf("restart %d = (%s, %t), want (%s, true)", i+1, delay, ok, want)
+		}
+	}
+	if _, ok := status.NextRestart(policy, now.Add(3*time.Second)); ok {
+		t.Fatal("restart 4 inside the window should be refused")
+	}
+	delay, ok := status.NextRestart(policy, now.Add(time.Minute+time.Second))
+	if !ok || delay != 2*time.Second {
+		t.Fatalf("restart after the first one left the window = (%s, %t), want (2s, true)", delay, ok)
+	}
+	status.ResetBackoff()
+	delay, ok = status.NextRestart(policy, now.Add(time.Minute+2*time.Second))
+	if !ok || delay != time.Second {
+		t.Fatalf("restart after ResetBackoff = (%s, %t), want (1s, true)", delay, ok)
+	}
+}
+
+func TestNextRestartDefaults(t *testing.T) {
+	status := &ProcStatus{}
+	now := time.Unix(1000, 0)
+	for i := 1; i <= DefaultMaxRestarts+1; i++ {
+		if _, ok := status.NextRestart(RestartPolicy{}, now); ok != (i <= DefaultMaxRestarts) {
+			t.Fatalf("restart %d with the default policy = %t, want %t", i, ok, i <= DefaultMaxRestarts)
+		}
+	}
+}
+
+func TestNextRestartUnlimited(t *testing.T) {
+	policy := RestartPolicy{MaxRestarts: -1}
+	status := &ProcStatus{}
+	now := time.Unix(1000, 0)
+	for i := 0; i < 100; i++ {
+		if _, ok := status.NextRestart(policy, now); !ok {
+			t.Fatalf("MaxRestarts -1 refused restart %d", i+1)
+		}
+	}
+}
+
+func TestRestartPolicyJSON(t *testing.T) {
+	policy := RestartPolicy{MinBackoff: time.Second, MaxBackoff: 90 * time.Second, MaxRestarts: 3}
+	data, err := json.Marshal(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]interface{}{}
+	json.Unmarshal(data, &fields)
+	if want := map[string]interface{}{"min_backoff": "1s", "max_backoff": "1m30s", "max_restarts": 3.0, "window": "0s"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("Marshal = %s, want %v", data, want)
+	}
+	decoded := RestartPolicy{Window: time.Hour}
+	if err := json.Unmarshal([]byte(`{"min_backoff":"2s","max_backoff":60000000000,"max_restarts":-1}`), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	want := RestartPolicy{MinBackoff: 2 * time.Second, MaxBackoff: time.Minute, MaxRestarts: -1, Window: time.Hour}
+	if decoded != want {
+		t.Errorf("Unmarshal = %+v, want %+v", decoded, want)
+	}
+	if err := json.Unmarshal([]byte(`{"window":"soon"}`), &decoded); err == nil {
+		t.Error("Unmarshal of an invalid window should fail")
+	}
+}
@@ -0,0 +1,258 @@
+/*
+Procfs package reads information about running processes from the Linux /proc filesystem.
+*/
+package procfs
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path"
+import "sort"
+import "strconv"
+import "strings"
+
+// Root is the mount point of the proc filesystem.
+var Root = "/proc"
+
+// Stat holds the fields of /proc/<pid>/stat that APM uses.
+type Stat struct {
+	Pid        int    // Pid is the process id.
+	Comm       string // Comm is the executable name, without the parentheses.
+	State      string // State is the process state, such as R, S or Z.
+	Ppid       int    // Ppid is the parent process id.
+	Pgrp       int    // Pgrp is the process group id.
+	Session    int    // Session is the session id.
+	Utime      uint64 // Utime is the time spent in user mode, in clock ticks.
+	Stime      uint64 // Stime is the time spent in kernel mode, in clock ticks.
+	NumThreads int    // NumThreads is the number of threads.
+	StartTime  uint64 // StartTime is when the process started after boot, in clock ticks.
+	Vsize      uint64 // Vsize is the virtual memory size in bytes.
+	Rss        int64  // Rss is the resident set size in pages.
+}
+
+// Available will check whether the proc filesystem can be read.
+// Returns true in case it can.
+func Available() bool {
+	_, err := os.Stat(path.Join(Root, "self", "stat"))
+	return err == nil
+}
+
+// ReadStat will read and parse /proc/<pid>/stat.
+// Returns a tuple with the stat and an error in case there's any.
+func ReadStat(pid int) (*Stat, error) {
+	data, err := ioutil.ReadFile(path.Join(Root, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return nil, err
+	}
+	return parseStat(string(data))
+}
+
+// The comm field may contain spaces and parentheses, so fields are split after its last ')'.
+func parseStat(data string) (*Stat, error) {
+	start := strings.Index(data, "(")
+	end := strings.LastIndex(data, ")")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("Invalid stat format: %s", data)
+	}
+	// fields[0] is the state, the 3rd field of the stat file.
+	fields := strings.Fields(data[end+1:])
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("Invalid stat format: %s", data)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(data[:start]))
+	if err != nil {
+		return nil, err
+	}
+	// field returns the n-th field of the stat file, numbered as in proc(5).
+	field := func(n int) int64 {
+		value, parseErr := strconv.ParseInt(fields[n-3], 10, 64)
+		if parseErr != nil && err == nil {
+			err = parseErr
+		}
+		return value
+	}
+	stat := &Stat{
+		Pid:        pid,
+		Comm:       data[start+1 : end],
+		State:      fields[0],
+		Ppid:       int(field(4)),
+		Pgrp:       int(field(5)),
+		Session:    int(field(6)),
+		Utime:      uint64(field(14)),
+		Stime:      uint64(field(15)),
+		NumThreads: int(field(20)),
+		StartTime:  uint64(field(22)),
+		Vsize:      uint64(field(23)),
+		Rss:        field(24),
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stat, nil
+}
+
+// Pids will list the ids of all the running processes.
+// Returns a tuple with the pids and an error in case there's any.
+func Pids() ([]int, error) {
+	entries, err := ioutil.ReadDir(Root)
+	if err != nil {
+		return nil, err
+	}
+	pids := []int{}
+	for _, entry := range entries {
+		if pid, err := strconv.Atoi(entry.Name()); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// GroupMembers will find the running processes of the process group pgid. Zombies are left out,
+// since they already exited.
+// Returns a tuple with the sorted member pids and an error in case there's any.
+func GroupMembers(pgid int) ([]int, error) {
+	pids, err := Pids()
+	if err != nil {
+		return nil, err
+	}
+	members := []int{}
+	for _, pid := range pids {
+		stat, err := ReadStat(pid)
+		if err != nil {
+			// The process exited while we were listing them.
+			continue
+		}
+		if stat.Pgrp == pgid && stat.State != "Z" && stat.State != "X" {
+			members = append(members, pid)
+		}
+	}
+	return members, nil
+}
+
+// Descendants will find the children of pid, their children and so on.
+// Returns a tuple with the sorted descendant pids and an error in case there's any.
+func Descendants(pid int) ([]int, error) {
+	pids, err := Pids()
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[int][]int)
+	for _, child := range pids {
+		stat, err := ReadStat(child)
+		if err != nil {
+			// The process exited while we were listing them.
+			continue
+		}
+		children[stat.Ppid] = append(children[stat.Ppid], child)
+	}
+	descendants := []int{}
+	queue := children[pid]
+	for len(queue) > 0 {
+		child := queue[0]
+		queue = append(queue[1:], children[child]...)
+		descendants = append(descendants, child)
+	}
+	sort.Ints(descendants)
+	return descendants, nil
+}
+
+// Identity tells a process apart from any other process that reuses its pid later.
+type Identity struct {
+	StartTime uint64 // StartTime is when the process started after boot, in clock ticks.
+	Exe       string // Exe is the path of the process executable.
+}
+
+// ReadIdentity will read the identity of the process pid.
+// Returns a tuple with the identity and an error in case there's any.
+func ReadIdentity(pid int) (Identity, error) {
+	stat, err := ReadStat(pid)
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{
+		StartTime: stat.StartTime,
+		Exe:       readExe(pid),
+	}, nil
+}
+
+// IsRunning will check whether pid still refers to the process with the given identity, and
+// that this process did not exit yet.
+// Returns true in case it does.
+func IsRunning(pid int, identity Identity) bool {
+	stat, err := ReadStat(pid)
+	if err != nil || stat.State == "Z" || stat.State == "X" {
+		return false
+	}
+	if stat.StartTime != identity.StartTime {
+		return false
+	}
+	// The executable can't be read for processes of other users, in that case the start
+	// time is enough.
+	exe := readExe(pid)
+	return exe == "" || identity.Exe == "" || exe == identity.Exe
+}
+
+// IsRunningCmd will check whether pid is running and, as far as /proc tells, runs cmd, either
+// as its executable or as the script given to its interpreter. It is meant for processes
+// whose identity was never recorded.
+// Returns true in case it does.
+func IsRunningCmd(pid int, cmd string) bool {
+	stat, err := ReadStat(pid)
+	if err != nil || stat.State == "Z" || stat.State == "X" {
+		return false
+	}
+	exe := readExe(pid)
+	if exe == "" || cmd == "" || exe == cmd {
+		return true
+	}
+	data, err := ioutil.ReadFile(path.Join(Root, strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return false
+	}
+	args := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+	for i := 0; i < len(args) && i < 2; i++ {
+		if args[i] == cmd || path.Base(args[i]) == path.Base(cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadGroups will read the supplementary group ids of pid from /proc/<pid>/status.
+// Returns a tuple with the group ids and an error in case there's any.
+func ReadGroups(pid int) ([]int, error) {
+	data, err := ioutil.ReadFile(path.Join(Root, strconv.Itoa(pid), "status"))
+	if err != nil {
+		return nil, err
+	}
+	return parseGroups(string(data))
+}
+
+// parseGroups returns the ids of the Groups line of a status file.
+func parseGroups(data string) ([]int, error) {
+	for _, line := range strings.Split(data, "\n") {
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		groups := []int{}
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			gid, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, gid)
+		}
+		return groups, nil
+	}
+	return nil, fmt.Errorf("Invalid status format: no Groups line")
+}
+
+// readExe returns the executable of pid, or an empty string in case it can't be read.
+// Executables replaced on disk while running keep pointing to the old path.
+func readExe(pid int) string {
+	exe, err := os.Readlink(path.Join(Root, strconv.Itoa(pid), "exe"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(exe, " (deleted)")
+}
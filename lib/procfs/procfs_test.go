@@ -0,0 +1,132 @@
+package procfs
+
+import "os"
+import "reflect"
+import "syscall"
+import "testing"
+
+func TestParseStat(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want *Stat
+	}{
+		{
+			name: "plain",
+			data: "17902 (cat) R 17894 17902 17894 0 -1 4194304 81 0 0 0 12 3 0 0 20 0 1 0 710048 2703360 272 18446744073709551615 0 0\n",
+			want: &Stat{Pid: 17902, Comm: "cat", State: "R", Ppid: 17894, Pgrp: 17902, Session: 17894,
+				Utime: 12, Stime: 3, NumThreads: 1, StartTime: 710048, Vsize: 2703360, Rss: 272},
+		},
+		{
+			name: "comm with spaces and parentheses",
+			data: "42 (my (odd) app) S 1 42 42 0 -1 0 0 0 0 0 7 8 0 0 20 0 4 0 99 1024 16",
+			want: &Stat{Pid: 42, Comm: "my (odd) app", State: "S", Ppid: 1, Pgrp: 42, Session: 42,
+				Utime: 7, Stime: 8, NumThreads: 4, StartTime: 99, Vsize: 1024, Rss: 16},
+		},
+	}
+	for _, test := range tests {
+		got, err := parseStat(test.data)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parseStat = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseStatInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"42 cat S 1 42",
+		"42 (cat) S 1 42 42 0",
+		"abc (cat) S 1 42 42 0 -1 0 0 0 0 0 7 8 0 0 20 0 4 0 99 1024 16",
+		"42 (cat) S 1 x 42 0 -1 0 0 0 0 0 7 8 0 0 20 0 4 0 99 1024 16",
+	}
+	for _, data := range tests {
+		if stat, err := parseStat(data); err == nil {
+			t.Errorf("parseStat(%q) = %+v, want an error", data, stat)
+		}
+	}
+}
+
+func TestReadStatSelf(t *testing.T) {
+	if !Available() {
+		t.Skip("proc filesystem not available")
+	}
+	stat, err := ReadStat(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Pid != os.Getpid() || stat.Ppid != os.Getppid() {
+		t.Errorf("ReadStat(self) = pid %d ppid %d, want pid %d ppid %d", stat.Pid, stat.Ppid, os.Getpid(), os.Getppid())
+	}
+	identity, err := ReadIdentity(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsRunning(os.Getpid(), identity) {
+		t.Error("IsRunning(self) = false, want true")
+	}
+	identity.StartTime++
+	if IsRunning(os.Getpid(), identity) {
+		t.Error("IsRunning(self) with another start time = true, want false")
+	}
+}
+
+func TestIsRunningCmdSelf(t *testing.T) {
+	if !Available() {
+		t.Skip("proc filesystem not available")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{exe, os.Args[0], ""} {
+		if !IsRunningCmd(os.Getpid(), cmd) {
+			t.Errorf("IsRunningCmd(self, %q) = false, want true", cmd)
+		}
+	}
+	if IsRunningCmd(os.Getpid(), "/usr/bin/some-other-program") {
+		t.Error("IsRunningCmd(self) with another command = true, want false")
+	}
+}
+
+func TestGroupMembersSelf(t *testing.T) {
+	if !Available() {
+		t.Skip("proc filesystem not available")
+	}
+	members, err := GroupMembers(syscall.Getpgrp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, pid := range members {
+		found = found || pid == os.Getpid()
+	}
+	if !found {
+		t.Errorf("GroupMembers(own group) = %v, want it to include %d", members, os.Getpid())
+	}
+}
+
+func TestParseGroups(t *testing.T) {
+	tests := []struct {
+		data string
+		want []int
+	}{
+		{"Name:\tapm\nUid:\t1000\t1000\t1000\t1000\nGroups:\t4 24 27 1000 \nVmRSS:\t100 kB\n", []int{4, 24, 27, 1000}},
+		{"Name:\tapm\nGroups:\n", []int{}},
+	}
+	for _, test := range tests {
+		got, err := parseGroups(test.data)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseGroups(%q) = (%v, %v), want %v", test.data, got, err, test.want)
+		}
+	}
+	for _, data := range []string{"Name:\tapm\n", "Groups:\t4 x\n"} {
+		if groups, err := parseGroups(data); err == nil {
+			t.Errorf("parseGroups(%q) = %v, want an error", data, groups)
+		}
+	}
+}
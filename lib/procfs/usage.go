@@ -0,0 +1,110 @@
+package procfs
+
+import "bufio"
+import "io/ioutil"
+import "os"
+import "path"
+import "strconv"
+import "strings"
+import "time"
+
+// ClockTicks is how many clock ticks there are in a second, the unit of the times in
+// /proc/<pid>/stat. It is USER_HZ, which is 100 on every Linux architecture APM runs on.
+const ClockTicks = 100
+
+// Usage is the resource usage of a process, or the sum of the usage of several processes.
+type Usage struct {
+	CPUTime    time.Duration `json:"cpu_time"`    // CPUTime is the user and system CPU time used since the process started.
+	RSS        uint64        `json:"rss"`         // RSS is the resident memory, in bytes.
+	VSZ        uint64        `json:"vsz"`         // VSZ is the virtual memory size, in bytes.
+	FDs        int           `json:"fds"`         // FDs is the number of open file descriptors. Zero in case they can't be read.
+	Threads    int           `json:"threads"`     // Threads is the number of threads.
+	ReadBytes  uint64        `json:"read_bytes"`  // ReadBytes is what the process read from storage, in bytes. Zero in case it can't be read.
+	WriteBytes uint64        `json:"write_bytes"` // WriteBytes is what the process wrote to storage, in bytes. Zero in case it can't be read.
+}
+
+// ReadUsage will read the usage of pid from /proc/<pid>/stat, statm, status, io and fd. The io
+// and fd entries of processes of other users can't be read, so their counts are left at zero.
+// Returns a tuple with the usage and an error in case there's any.
+func ReadUsage(pid int) (Usage, error) {
+	stat, err := ReadStat(pid)
+	if err != nil {
+		return Usage{}, err
+	}
+	usage := Usage{
+		CPUTime: time.Duration(stat.Utime+stat.Stime) * time.Second / ClockTicks,
+		Threads: stat.NumThreads,
+	}
+	pageSize := uint64(os.Getpagesize())
+	statm, err := readFields(pid, "statm")
+	if err != nil {
+		return Usage{}, err
+	}
+	if len(statm) >= 2 {
+		usage.VSZ = parseUint(statm[0]) * pageSize
+		usage.RSS = parseUint(statm[1]) * pageSize
+	}
+	if status, err := readKeyValues(pid, "status"); err == nil {
+		if threads, err := strconv.Atoi(status["Threads"]); err == nil {
+			usage.Threads = threads
+		}
+	}
+	if io, err := readKeyValues(pid, "io"); err == nil {
+		usage.ReadBytes = parseUint(io["read_bytes"])
+		usage.WriteBytes = parseUint(io["write_bytes"])
+	}
+	if fds, err := os.Open(path.Join(Root, strconv.Itoa(pid), "fd")); err == nil {
+		names, _ := fds.Readdirnames(-1)
+		usage.FDs = len(names)
+		fds.Close()
+	}
+	return usage, nil
+}
+
+// Add will add the usage of other to usage.
+func (usage *Usage) Add(other Usage) {
+	usage.CPUTime += other.CPUTime
+	usage.RSS += other.RSS
+	usage.VSZ += other.VSZ
+	usage.FDs += other.FDs
+	usage.Threads += other.Threads
+	usage.ReadBytes += other.ReadBytes
+	usage.WriteBytes += other.WriteBytes
+}
+
+// readFields returns the space separated fields of /proc/<pid>/<name>.
+func readFields(pid int, name string) ([]string, error) {
+	data, err := ioutil.ReadFile(path.Join(Root, strconv.Itoa(pid), name))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// readKeyValues returns the "key: value" lines of /proc/<pid>/<name>. Units such as kB are
+// left out of the values.
+func readKeyValues(pid int, name string) (map[string]string, error) {
+	file, err := os.Open(path.Join(Root, strconv.Itoa(pid), name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		pair := strings.SplitN(scanner.Text(), ":", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		fields := strings.Fields(pair[1])
+		if len(fields) > 0 {
+			values[pair[0]] = fields[0]
+		}
+	}
+	return values, scanner.Err()
+}
+
+func parseUint(value string) uint64 {
+	n, _ := strconv.ParseUint(value, 10, 64)
+	return n
+}
@@ -0,0 +1,36 @@
+package utils
+
+import "encoding/json"
+import "fmt"
+import "strconv"
+import "time"
+
+// Duration is a time.Duration written in JSON as a string such as 1m30s. Numbers are read
+// as nanoseconds, as older clients sent them.
+type Duration time.Duration
+
+// MarshalJSON will encode duration as a string such as 1m30s.
+// Returns a tuple with the JSON string and an error in case there's any.
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(duration).String())
+}
+
+// UnmarshalJSON will decode duration from a string such as 1m30s or a number of nanoseconds.
+// Returns an error in case it is neither.
+func (duration *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("Invalid duration %s. Use a string such as 30s.", data)
+		}
+		*duration = Duration(parsed)
+		return nil
+	}
+	nanoseconds, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid duration %s. Use a string such as 30s.", data)
+	}
+	*duration = Duration(nanoseconds)
+	return nil
+}
@@ -0,0 +1,34 @@
+package utils
+
+import "encoding/json"
+import "testing"
+import "time"
+
+func TestDurationJSON(t *testing.T) {
+	data, err := json.Marshal(Duration(90 * time.Second))
+	if err != nil || string(data) != `"1m30s"` {
+		t.Errorf("Marshal(90s) = (%s, %v), want \"1m30s\"", data, err)
+	}
+	tests := []struct {
+		data string
+		want time.Duration
+	}{
+		{`"1m30s"`, 90 * time.Second},
+		{`"500ms"`, 500 * time.Millisecond},
+		{`"0s"`, 0},
+		{`1500000000`, 1500 * time.Millisecond},
+		{`0`, 0},
+	}
+	for _, test := range tests {
+		var duration Duration
+		if err := json.Unmarshal([]byte(test.data), &duration); err != nil || time.Duration(duration) != test.want {
+			t.Errorf("Unmarshal(%s) = (%s, %v), want %s", test.data, time.Duration(duration), err, test.want)
+		}
+	}
+	for _, data := range []string{`"30"`, `"soon"`, `1.5`, `true`} {
+		var duration Duration
+		if err := json.Unmarshal([]byte(data), &duration); err == nil {
+			t.Errorf("Unmarshal(%s) = %s, want an error", data, time.Duration(duration))
+		}
+	}
+}
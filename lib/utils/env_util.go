@@ -0,0 +1,71 @@
+package utils
+
+import "bufio"
+import "fmt"
+import "os"
+import "sort"
+import "strings"
+
+// ReadEnvFile will read KEY=VALUE pairs from filepath, one per line. Empty lines and lines
+// starting with '#' are ignored, an optional "export " prefix is allowed and values may be
+// wrapped in single or double quotes.
+// Returns a tuple with the variables and an error in case there's any.
+func ReadEnvFile(filepath string) (map[string]string, error) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		pair := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(pair[0])
+		if len(pair) != 2 || key == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", filepath, lineNumber)
+		}
+		value := strings.TrimSpace(pair[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars[key] = value
+	}
+	return vars, scanner.Err()
+}
+
+// MergeEnv will override the KEY=VALUE entries of env with vars, appending the keys that
+// are not in env yet. Each key shows up only once in the result.
+// Returns the merged environment.
+func MergeEnv(env []string, vars map[string]string) []string {
+	merged := []string{}
+	seen := make(map[string]bool)
+	for _, entry := range env {
+		key := strings.SplitN(entry, "=", 2)[0]
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if value, ok := vars[key]; ok {
+			entry = key + "=" + value
+		}
+		merged = append(merged, entry)
+	}
+	keys := []string{}
+	for key := range vars {
+		if !seen[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		merged = append(merged, key+"="+vars[key])
+	}
+	return merged
+}
@@ -0,0 +1,73 @@
+package utils
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "reflect"
+import "testing"
+
+func writeEnvFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "apm-env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, ".env")
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestReadEnvFile(t *testing.T) {
+	filename := writeEnvFile(t, `# comment
+PLAIN=value
+
+  SPACED = spaced value
+export EXPORTED=1
+DOUBLE="double quoted"
+SINGLE='single quoted'
+UNBALANCED="unbalanced
+EQUALS=a=b
+EMPTY=
+`)
+	defer os.RemoveAll(filepath.Dir(filename))
+	vars, err := ReadEnvFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"PLAIN":      "value",
+		"SPACED":     "spaced value",
+		"EXPORTED":   "1",
+		"DOUBLE":     "double quoted",
+		"SINGLE":     "single quoted",
+		"UNBALANCED": `"unbalanced`,
+		"EQUALS":     "a=b",
+		"EMPTY":      "",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("ReadEnvFile = %v, want %v", vars, want)
+	}
+}
+
+func TestReadEnvFileInvalid(t *testing.T) {
+	for _, content := range []string{"NOVALUE\n", "=value\n"} {
+		filename := writeEnvFile(t, content)
+		if vars, err := ReadEnvFile(filename); err == nil {
+			t.Errorf("ReadEnvFile(%q) = %v, want an error", content, vars)
+		}
+		os.RemoveAll(filepath.Dir(filename))
+	}
+	if _, err := ReadEnvFile("/nonexistent/.env"); err == nil {
+		t.Error("ReadEnvFile of a missing file should fail")
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	env := []string{"PATH=/bin", "HOME=/root", "PATH=/usr/bin"}
+	vars := map[string]string{"HOME": "/home/apm", "B": "2", "A": "1"}
+	want := []string{"PATH=/bin", "HOME=/home/apm", "A=1", "B=2"}
+	if got := MergeEnv(env, vars); !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeEnv = %v, want %v", got, want)
+	}
+}
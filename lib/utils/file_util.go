@@ -1,5 +1,6 @@
 package utils
 
+import "io"
 import "io/ioutil"
 import "os"
 
@@ -54,3 +55,25 @@ func DeleteFile(filepath string) error {
 	err = os.Remove(filepath)
 	return err
 }
+
+// CopyFile will copy src to dst, replacing dst in case it exists, and set its permission mode to perm.
+// Returns an error in case there's any.
+func CopyFile(src string, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(dst, perm)
+}
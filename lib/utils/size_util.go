@@ -0,0 +1,53 @@
+package utils
+
+import "fmt"
+import "strconv"
+import "strings"
+
+// sizeUnits are the suffixes accepted by ParseSize, in powers of 1024.
+var sizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"GB", 1 << 30},
+	{"G", 1 << 30},
+	{"MB", 1 << 20},
+	{"M", 1 << 20},
+	{"KB", 1 << 10},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+// ParseSize will parse a size such as 512, 100K, 10MB or 1G. Units are powers of 1024
+// and case insensitive.
+// Returns a tuple with the size in bytes and an error in case there's any.
+func ParseSize(size string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(size))
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size %s. Use a number of bytes or a K, M or G suffix.", size)
+	}
+	return n * multiplier, nil
+}
+
+// FormatSize will format size in bytes with the largest unit it reaches, such as 512B, 1.5K
+// or 10.0M. The output is meant to be read, ParseSize does not accept its decimals.
+func FormatSize(size uint64) string {
+	for _, unit := range []struct {
+		suffix     string
+		multiplier uint64
+	}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if size >= unit.multiplier {
+			return fmt.Sprintf("%.1f%s", float64(size)/float64(unit.multiplier), unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", size)
+}
@@ -2,28 +2,55 @@ package watcher
 
 import "os"
 import "sync"
+import "time"
 
 import "github.com/topfreegames/apm/lib/process"
 import log "github.com/Sirupsen/logrus"
 
 // ProcStatus is a wrapper with the process state and an error in case there's any.
 type ProcStatus struct {
-	state *os.ProcessState
-	err   error
+	watcher  *ProcWatcher
+	proc     process.ProcContainer
+	state    *os.ProcessState
+	exitedAt time.Time
+	err      error
+}
+
+// Proc will return the process that exited.
+func (proc_status *ProcStatus) Proc() process.ProcContainer {
+	return proc_status.proc
+}
+
+// State will return the state of the process that exited. It is nil for processes that
+// were not children of APM.
+func (proc_status *ProcStatus) State() *os.ProcessState {
+	return proc_status.state
+}
+
+// ExitedAt will return when the process exit was noticed.
+func (proc_status *ProcStatus) ExitedAt() time.Time {
+	return proc_status.exitedAt
+}
+
+// Err will return the error of waiting for the process, in case there's any.
+func (proc_status *ProcStatus) Err() error {
+	return proc_status.err
 }
 
 // ProcWatcher is a wrapper that act as a object that watches a process.
 type ProcWatcher struct {
-	procStatus  chan *ProcStatus
+	procStatus  *ProcStatus   // procStatus is the status of the process, set once exited is closed.
+	exited      chan struct{} // exited is closed once the process exits.
 	proc        process.ProcContainer
 	stopWatcher chan bool
+	stopped     bool // stopped tells whoever stopped the watcher handles the process exit.
 }
 
 // Watcher is responsible for watching a list of processes and report to Master in
 // case the process dies at some point.
 type Watcher struct {
 	sync.Mutex
-	restartProc chan process.ProcContainer
+	exitedProcs chan *ProcStatus
 	watchProcs  map[string]*ProcWatcher
 }
 
@@ -31,29 +58,35 @@ type Watcher struct {
 // Returns a Watcher instance.
 func InitWatcher() *Watcher {
 	watcher := &Watcher{
-		restartProc: make(chan process.ProcContainer),
+		exitedProcs: make(chan *ProcStatus),
 		watchProcs:  make(map[string]*ProcWatcher),
 	}
 	return watcher
 }
 
-// RestartProc is a wrapper to export the channel restartProc. It basically keeps track of
-// all the processes that died and need to be restarted.
-// Returns a channel with the dead processes that need to be restarted.
-func (watcher *Watcher) RestartProc() chan process.ProcContainer {
-	return watcher.restartProc
+// ExitedProcs is a wrapper to export the channel exitedProcs. It basically keeps track of
+// all the processes that died, with their exit state, and may need to be restarted.
+// Returns a channel with the status of the dead processes.
+func (watcher *Watcher) ExitedProcs() chan *ProcStatus {
+	return watcher.exitedProcs
 }
 
 // AddProcWatcher will add a watcher on proc.
 func (watcher *Watcher) AddProcWatcher(proc process.ProcContainer) {
 	watcher.Lock()
 	defer watcher.Unlock()
-	if _, ok := watcher.watchProcs[proc.Identifier()]; ok {
-		log.Warnf("A watcher for this process already exists.")
-		return
+	if procWatcher, ok := watcher.watchProcs[proc.Identifier()]; ok {
+		select {
+		case <-procWatcher.exited:
+			// The process it watched is gone and was started again, its exit is stale.
+			procWatcher.stopped = true
+		default:
+			log.Warnf("A watcher for this process already exists.")
+			return
+		}
 	}
 	procWatcher := &ProcWatcher{
-		procStatus:  make(chan *ProcStatus, 1),
+		exited:      make(chan struct{}),
 		proc:        proc,
 		stopWatcher: make(chan bool, 1),
 	}
@@ -61,18 +94,21 @@ func (watcher *Watcher) AddProcWatcher(proc process.ProcContainer) {
 	go func() {
 		log.Infof("Starting watcher on proc %s", proc.Identifier())
 		state, err := proc.Watch()
-		procWatcher.procStatus <- &ProcStatus{
-			state: state,
-			err:   err,
+		procWatcher.procStatus = &ProcStatus{
+			watcher:  procWatcher,
+			proc:     proc,
+			state:    state,
+			exitedAt: time.Now(),
+			err:      err,
 		}
+		close(procWatcher.exited)
 	}()
 	go func() {
-		defer delete(watcher.watchProcs, procWatcher.proc.Identifier())
 		select {
-		case procStatus := <-procWatcher.procStatus:
+		case <-procWatcher.exited:
 			log.Infof("Proc %s is dead, advising master...", procWatcher.proc.Identifier())
-			log.Infof("State is %s", procStatus.state.String())
-			watcher.restartProc <- procWatcher.proc
+			log.Infof("State is %s", procWatcher.procStatus.state.String())
+			watcher.exitedProcs <- procWatcher.procStatus
 			break
 		case <-procWatcher.stopWatcher:
 			break
@@ -80,18 +116,69 @@ func (watcher *Watcher) AddProcWatcher(proc process.ProcContainer) {
 	}()
 }
 
+// IsWatching will check whether there is a running watcher on a process with identifier 'identifier'.
+// Returns true in case there is.
+func (watcher *Watcher) IsWatching(identifier string) bool {
+	watcher.Lock()
+	defer watcher.Unlock()
+	_, ok := watcher.watchProcs[identifier]
+	return ok
+}
+
+// Claim will take over the exit told by procStatus and forget its watcher. Exits received
+// from ExitedProcs must be claimed before they are acted on.
+// Returns false in case the watcher was stopped meanwhile, and whoever stopped it handles
+// the exit instead.
+func (watcher *Watcher) Claim(procStatus *ProcStatus) bool {
+	watcher.Lock()
+	defer watcher.Unlock()
+	procWatcher := procStatus.watcher
+	if procWatcher.stopped {
+		return false
+	}
+	identifier := procWatcher.proc.Identifier()
+	if watcher.watchProcs[identifier] == procWatcher {
+		delete(watcher.watchProcs, identifier)
+	}
+	return true
+}
+
 // StopWatcher will stop a running watcher on a process with identifier 'identifier'
 // Returns a channel that will be populated when the watcher is finally done.
 func (watcher *Watcher) StopWatcher(identifier string) chan bool {
-	if watcher, ok := watcher.watchProcs[identifier]; ok {
-		log.Infof("Stopping watcher on proc %s", identifier)
-		watcher.stopWatcher <- true
-		waitStop := make(chan bool, 1)
-		go func() {
-			<-watcher.procStatus
-			waitStop <- true
-		}()
-		return waitStop
+	exitStatus := watcher.StopWatcherWithStatus(identifier)
+	if exitStatus == nil {
+		return nil
+	}
+	waitStop := make(chan bool, 1)
+	go func() {
+		<-exitStatus
+		waitStop <- true
+	}()
+	return waitStop
+}
+
+// StopWatcherWithStatus will stop a running watcher on a process with identifier 'identifier'.
+// The exit of the process is then handled by the caller, even in case it was already sent
+// to ExitedProcs.
+// Returns a channel that will receive the status of the process once it exits.
+func (watcher *Watcher) StopWatcherWithStatus(identifier string) chan *ProcStatus {
+	watcher.Lock()
+	procWatcher, ok := watcher.watchProcs[identifier]
+	if ok {
+		procWatcher.stopped = true
+		delete(watcher.watchProcs, identifier)
 	}
-	return nil
+	watcher.Unlock()
+	if !ok {
+		return nil
+	}
+	log.Infof("Stopping watcher on proc %s", identifier)
+	procWatcher.stopWatcher <- true
+	exitStatus := make(chan *ProcStatus, 1)
+	go func() {
+		<-procWatcher.exited
+		exitStatus <- procWatcher.procStatus
+	}()
+	return exitStatus
 }